@@ -0,0 +1,247 @@
+// Package api serves invoices, deposits and sweeps over HTTP/JSON, as described in
+// openapi.yaml.
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/handler"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/registry"
+	"allen-liaoo/payment-reciever/util"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Server answers the API from the stores the sweeper and indexer keep. It holds no keys
+// and sends no transactions: manual sweeps are queued for the sweeping process.
+type Server struct {
+	Invoices *invoices.Manager // with an allocator, to create invoices
+	Deposits deposits.Store
+	Wallets  registry.WalletRegistry
+	Tokens   map[uint64][]util.Token // swept, by chain ID
+	// Journal is the sweeping process's, such as one in the registry database (see
+	// reciever.NewSQLiteJournal).
+	Journal  reciever.Journal
+	Requests handler.Requests // manual sweeps, carried out by the sweeping process's cycles
+}
+
+// Handler routes the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /invoices", s.createInvoice)
+	mux.HandleFunc("GET /invoices/{id}", s.getInvoice)
+	mux.HandleFunc("GET /wallets/{address}/deposits", s.walletDeposits)
+	mux.HandleFunc("GET /wallets/{address}/sweeps", s.walletSweeps)
+	mux.HandleFunc("POST /wallets/{address}/sweep", s.sweepWallet)
+	mux.HandleFunc("GET /sweep-requests/{id}", s.getSweepRequest)
+	mux.HandleFunc("GET /openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	})
+	return mux
+}
+
+func (s *Server) createInvoice(w http.ResponseWriter, r *http.Request) {
+	var req createInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	inv, err := req.invoice(time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// only Transfer logs are indexed, so nothing would ever pay the invoice
+	if inv.Token == (common.Address{}) {
+		writeError(w, http.StatusBadRequest, errors.New("invoices in the native asset are not supported, its deposits are not indexed"))
+		return
+	}
+	tokens, ok := s.Tokens[inv.ChainID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("chain %d is not swept", inv.ChainID))
+		return
+	}
+	// a payment in a token that is not swept would sit in the wallet
+	if !slices.ContainsFunc(tokens, func(token util.Token) bool { return token.Address == inv.Token }) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("token %s is not swept on chain %d", inv.Token.Hex(), inv.ChainID))
+		return
+	}
+
+	inv, err = s.Invoices.Create(inv)
+	if errors.Is(err, invoices.ErrInvalidInvoice) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, invoices.ErrInvoiceExists) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newInvoiceJSON(inv, nil))
+}
+
+func (s *Server) getInvoice(w http.ResponseWriter, r *http.Request) {
+	// settled again, as it may have expired since the indexer last ran
+	inv, err := s.Invoices.Refresh(r.PathValue("id"))
+	if errors.Is(err, invoices.ErrInvoiceNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	deps, err := s.Deposits.ByWallet(inv.ChainID, inv.Wallet)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var paying []*deposits.Deposit
+	for _, d := range deps {
+		if d.Token == inv.Token {
+			paying = append(paying, d)
+		}
+	}
+	writeJSON(w, http.StatusOK, newInvoiceJSON(inv, paying))
+}
+
+func (s *Server) walletDeposits(w http.ResponseWriter, r *http.Request) {
+	address, chainIDs, ok := s.walletQuery(w, r)
+	if !ok {
+		return
+	}
+	found := []depositJSON{}
+	for _, chainID := range chainIDs {
+		deps, err := s.Deposits.ByWallet(chainID, address)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, d := range deps {
+			found = append(found, newDepositJSON(d))
+		}
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func (s *Server) walletSweeps(w http.ResponseWriter, r *http.Request) {
+	address, chainIDs, ok := s.walletQuery(w, r)
+	if !ok {
+		return
+	}
+	recs, err := s.Journal.ByMiddleware(address)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	found := []sweepJSON{}
+	for _, chainID := range chainIDs {
+		for _, rec := range recs {
+			if rec.ChainID == chainID {
+				found = append(found, newSweepJSON(rec))
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// sweepWallet queues a sweep of the wallet for the next cycle of its chain
+func (s *Server) sweepWallet(w http.ResponseWriter, r *http.Request) {
+	address, chainIDs, ok := s.walletQuery(w, r)
+	if !ok {
+		return
+	}
+	if len(chainIDs) != 1 {
+		writeError(w, http.StatusBadRequest, errors.New("chainId is required to sweep on one of several chains"))
+		return
+	}
+	if _, err := s.Wallets.Get(address); errors.Is(err, registry.ErrWalletNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	req, err := handler.NewSweepRequest(chainIDs[0], address)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := s.Requests.Add(req); errors.Is(err, handler.ErrSweepRequested) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, req)
+}
+
+func (s *Server) getSweepRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := s.Requests.Get(r.PathValue("id"))
+	if errors.Is(err, handler.ErrRequestNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// walletQuery parses the wallet address of the path and the optional chainId query
+// parameter, returning the chains asked about; it writes the error response if invalid
+func (s *Server) walletQuery(w http.ResponseWriter, r *http.Request) (common.Address, []uint64, bool) {
+	hex := r.PathValue("address")
+	if !common.IsHexAddress(hex) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid address %q", hex))
+		return common.Address{}, nil, false
+	}
+	if param := r.URL.Query().Get("chainId"); param != "" {
+		chainID, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid chainId %q", param))
+			return common.Address{}, nil, false
+		}
+		if _, ok := s.Tokens[chainID]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("chain %d is not swept", chainID))
+			return common.Address{}, nil, false
+		}
+		return common.HexToAddress(hex), []uint64{chainID}, true
+	}
+	var chainIDs []uint64
+	for chainID := range s.Tokens {
+		chainIDs = append(chainIDs, chainID)
+	}
+	sort.Slice(chainIDs, func(a, b int) bool { return chainIDs[a] < chainIDs[b] })
+	return common.HexToAddress(hex), chainIDs, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/handler"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/registry"
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+// newTestServer serves the API over a simulated chain, with middleware wallets allocated
+// from index 24, and returns the handler of the sweeping process it shares its stores with
+func newTestServer(t *testing.T) (*httptest.Server, *Server, *simchain.Chain, *handler.Handler) {
+	chain := simchain.New(t)
+	journal := reciever.NewMemoryJournal()
+	sweeper, err := reciever.NewSweeper(reciever.Config{
+		Client:       chain.Client,
+		TokenAddress: chain.Token,
+		ProviderKey:  chain.FundedKey(t, big.NewInt(1e18)),
+		Destination:  common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+		Journal:      journal,
+	})
+	assert.NoError(t, err)
+
+	wallets := registry.NewMemoryRegistry()
+	allocator, err := registry.NewAllocator(wallets, simchain.Mnemonic, simchain.BasePath)
+	assert.NoError(t, err)
+	start, err := allocator.Address(23)
+	assert.NoError(t, err)
+	assert.NoError(t, wallets.Add(&registry.Wallet{Index: 23, Address: start, Status: registry.StatusRetired}))
+
+	depositStore := deposits.NewMemoryStore()
+	requests := handler.NewMemoryRequests()
+	s := &Server{
+		Invoices: &invoices.Manager{Store: invoices.NewMemoryStore(), Deposits: depositStore, Wallets: allocator},
+		Deposits: depositStore,
+		Wallets:  wallets,
+		Tokens:   map[uint64][]util.Token{simchain.ChainID.Uint64(): sweeper.Tokens()},
+		Journal:  journal,
+		Requests: requests,
+	}
+	h := &handler.Handler{
+		Chains:  []handler.Chain{{Sweeper: sweeper, Client: chain.Client}},
+		Wallets: wallets,
+		KeyFor: func(address common.Address) (*ecdsa.PrivateKey, error) {
+			w, err := wallets.Get(address)
+			if err != nil {
+				return nil, err
+			}
+			_, privateKey, err := util.DeriveWallet(simchain.Mnemonic, allocator.Path(w.Index))
+			return privateKey, err
+		},
+		Requests: requests,
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return srv, s, chain, h
+}
+
+// call sends a JSON request and decodes the JSON response into out, returning the status
+func call(t *testing.T, method string, url string, body any, out any) int {
+	var reader bytes.Buffer
+	if body != nil {
+		assert.NoError(t, json.NewEncoder(&reader).Encode(body))
+	}
+	req, err := http.NewRequest(method, url, &reader)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	if out != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func TestInvoiceEndpoints(t *testing.T) {
+	srv, s, chain, _ := newTestServer(t)
+
+	var created invoiceJSON
+	status := call(t, "POST", srv.URL+"/invoices", map[string]any{
+		"id": "order-1", "chainId": 1337, "token": chain.Token.Hex(), "amount": "20",
+		"customer": "alice", "metadata": map[string]string{"sku": "mug"}, "expiresIn": "15m",
+	}, &created)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "order-1", created.ID)
+	assert.Equal(t, invoices.StatusUnpaid, created.Status)
+	assert.Equal(t, "0", created.Paid)
+	assert.Equal(t, map[string]string{"sku": "mug"}, created.Metadata)
+	if assert.NotNil(t, created.ExpiresAt) {
+		assert.WithinDuration(t, time.Now().Add(15*time.Minute), *created.ExpiresAt, time.Minute)
+	}
+	w, err := s.Wallets.Get(created.Wallet)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(24), w.Index)
+	assert.Equal(t, "order-1", w.Invoice)
+
+	var failed errorResponse
+	status = call(t, "POST", srv.URL+"/invoices", map[string]any{"id": "order-1", "chainId": 1337, "token": chain.Token.Hex(), "amount": "20"}, &failed)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.NotEmpty(t, failed.Error)
+	for _, body := range []map[string]any{
+		{"chainId": 1337, "token": "usdc", "amount": "20"},
+		{"chainId": 1337, "token": chain.Token.Hex(), "amount": "twenty"},
+		{"chainId": 1337, "token": chain.Token.Hex(), "amount": "0"},
+		{"chainId": 1337, "token": chain.Token.Hex(), "amount": "20", "expiresIn": "soon"},
+		{"chainId": 10, "token": chain.Token.Hex(), "amount": "20"},
+		{"chainId": 1337, "token": common.HexToAddress("0x02").Hex(), "amount": "20"},
+	} {
+		status = call(t, "POST", srv.URL+"/invoices", body, nil)
+		assert.Equal(t, http.StatusBadRequest, status, "%v", body)
+	}
+	// a native sweeper sweeps the zero address, but native deposits are not indexed
+	s.Tokens[1337] = append(s.Tokens[1337], util.Token{})
+	status = call(t, "POST", srv.URL+"/invoices", map[string]any{"chainId": 1337, "token": common.Address{}.Hex(), "amount": "20"}, &failed)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, failed.Error, "native")
+
+	// paid in full by a confirmed deposit
+	_, err = s.Deposits.Add(&deposits.Deposit{ChainID: 1337, TxHash: common.Hash{1}, Token: chain.Token, Wallet: created.Wallet,
+		Amount: big.NewInt(20), Status: deposits.StatusConfirmed, DetectedAt: time.Now()})
+	assert.NoError(t, err)
+	var got invoiceJSON
+	status = call(t, "GET", srv.URL+"/invoices/order-1", nil, &got)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, invoices.StatusPaid, got.Status)
+	assert.Equal(t, "20", got.Paid)
+	assert.NotNil(t, got.PaidAt)
+	if assert.Len(t, got.Deposits, 1) {
+		assert.Equal(t, "20", got.Deposits[0].Amount)
+	}
+
+	status = call(t, "GET", srv.URL+"/invoices/order-2", nil, &failed)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestWalletEndpoints(t *testing.T) {
+	srv, s, chain, h := newTestServer(t)
+	inv, err := s.Invoices.Create(&invoices.Invoice{ChainID: 1337, Token: chain.Token, Amount: big.NewInt(20)})
+	assert.NoError(t, err)
+	wallet := srv.URL + "/wallets/" + inv.Wallet.Hex()
+
+	chain.SendToken(t, chain.Token, inv.Wallet, big.NewInt(20))
+	_, err = s.Deposits.Add(&deposits.Deposit{ChainID: 1337, TxHash: common.Hash{1}, Token: chain.Token, Wallet: inv.Wallet,
+		Amount: big.NewInt(20), Status: deposits.StatusPending, DetectedAt: time.Now()})
+	assert.NoError(t, err)
+	var queued handler.SweepRequest
+	status := call(t, "POST", wallet+"/sweep?chainId=1337", nil, &queued)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, handler.RequestQueued, queued.Status)
+	assert.Equal(t, inv.Wallet, queued.Wallet)
+	var failed errorResponse
+	status = call(t, "POST", wallet+"/sweep", nil, &failed)
+	assert.Equal(t, http.StatusConflict, status, "already queued")
+	assert.Equal(t, handler.ErrSweepRequested.Error(), failed.Error)
+
+	// the sweeping process carries the request out
+	_, err = h.Handle(context.Background(), handler.Event{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), chain.TokenBalance(t, chain.Token, inv.Wallet).Int64())
+	var done handler.SweepRequest
+	status = call(t, "GET", srv.URL+"/sweep-requests/"+queued.ID, nil, &done)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, handler.RequestDone, done.Status)
+	assert.Equal(t, handler.OutcomeSwept, done.Outcome)
+	assert.Len(t, done.Txs, 1)
+	assert.Equal(t, http.StatusNotFound, call(t, "GET", srv.URL+"/sweep-requests/missing", nil, nil))
+
+	var sweeps []sweepJSON
+	status = call(t, "GET", wallet+"/sweeps", nil, &sweeps)
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, sweeps, 1) && assert.Len(t, done.Txs, 1) {
+		assert.Equal(t, uint64(1337), sweeps[0].ChainID)
+		assert.Equal(t, reciever.StateConfirmed, sweeps[0].State)
+		assert.Equal(t, "20", sweeps[0].Amount)
+		assert.Equal(t, &done.Txs[0], sweeps[0].TokenTx)
+	}
+
+	var found []depositJSON
+	status = call(t, "GET", wallet+"/deposits?chainId=1337", nil, &found)
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, deposits.StatusPending, found[0].Status)
+	}
+
+	for url, want := range map[string]int{
+		srv.URL + "/wallets/0x01/deposits":                                   http.StatusBadRequest,
+		wallet + "/deposits?chainId=one":                                     http.StatusBadRequest,
+		wallet + "/sweeps?chainId=10":                                        http.StatusNotFound,
+		fmt.Sprintf("%s/wallets/%s/sweeps", srv.URL, common.Address{}.Hex()): http.StatusOK,
+	} {
+		assert.Equal(t, want, call(t, "GET", url, nil, nil), url)
+	}
+	unregistered := fmt.Sprintf("%s/wallets/%s/sweep", srv.URL, common.HexToAddress("0x01").Hex())
+	assert.Equal(t, http.StatusNotFound, call(t, "POST", unregistered, nil, nil))
+
+	// with several chains, a sweep names its chain
+	s.Tokens[8453] = nil
+	assert.Equal(t, http.StatusBadRequest, call(t, "POST", wallet+"/sweep", nil, nil))
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	srv, _, _, _ := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/openapi.yaml")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+)
+
+// Amounts are decimal strings in the token's (or for ETH, wei's) smallest unit, as they
+// overflow JSON numbers.
+
+type createInvoiceRequest struct {
+	ID        string            `json:"id"`
+	ChainID   uint64            `json:"chainId"`
+	Token     string            `json:"token"`
+	Amount    string            `json:"amount"`
+	Customer  string            `json:"customer"`
+	Metadata  map[string]string `json:"metadata"`
+	ExpiresAt *time.Time        `json:"expiresAt"`
+	ExpiresIn string            `json:"expiresIn"` // Go duration, e.g. "15m"; instead of expiresAt
+}
+
+// invoice checks the request and returns the invoice it asks for
+func (req *createInvoiceRequest) invoice(now time.Time) (*invoices.Invoice, error) {
+	if !common.IsHexAddress(req.Token) {
+		return nil, fmt.Errorf("invalid token address %q", req.Token)
+	}
+	amount, ok := new(big.Int).SetString(req.Amount, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid amount %q", req.Amount)
+	}
+	inv := &invoices.Invoice{
+		ID:       req.ID,
+		ChainID:  req.ChainID,
+		Token:    common.HexToAddress(req.Token),
+		Amount:   amount,
+		Customer: req.Customer,
+		Metadata: req.Metadata,
+	}
+	switch {
+	case req.ExpiresAt != nil && req.ExpiresIn != "":
+		return nil, errors.New("set expiresAt or expiresIn, not both")
+	case req.ExpiresAt != nil:
+		inv.ExpiresAt = *req.ExpiresAt
+	case req.ExpiresIn != "":
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid expiresIn %q", req.ExpiresIn)
+		}
+		inv.ExpiresAt = now.Add(d)
+	}
+	return inv, nil
+}
+
+type invoiceJSON struct {
+	ID        string            `json:"id"`
+	ChainID   uint64            `json:"chainId"`
+	Wallet    common.Address    `json:"wallet"`
+	Token     common.Address    `json:"token"`
+	Amount    string            `json:"amount"`
+	Customer  string            `json:"customer,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+	Status    invoices.Status   `json:"status"`
+	Paid      string            `json:"paid"`
+	Pending   string            `json:"pending"`
+	PaidAt    *time.Time        `json:"paidAt,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Deposits  []depositJSON     `json:"deposits,omitempty"`
+}
+
+func newInvoiceJSON(inv *invoices.Invoice, deps []*deposits.Deposit) invoiceJSON {
+	j := invoiceJSON{
+		ID:        inv.ID,
+		ChainID:   inv.ChainID,
+		Wallet:    inv.Wallet,
+		Token:     inv.Token,
+		Amount:    amountString(inv.Amount),
+		Customer:  inv.Customer,
+		Metadata:  inv.Metadata,
+		ExpiresAt: optionalTime(inv.ExpiresAt),
+		Status:    inv.Status,
+		Paid:      amountString(inv.Paid),
+		Pending:   amountString(inv.Pending),
+		PaidAt:    optionalTime(inv.PaidAt),
+		CreatedAt: inv.CreatedAt,
+		UpdatedAt: inv.UpdatedAt,
+	}
+	for _, d := range deps {
+		j.Deposits = append(j.Deposits, newDepositJSON(d))
+	}
+	return j
+}
+
+type depositJSON struct {
+	ChainID     uint64          `json:"chainId"`
+	TxHash      common.Hash     `json:"txHash"`
+	LogIndex    uint            `json:"logIndex"`
+	Token       common.Address  `json:"token"`
+	From        common.Address  `json:"from"`
+	Wallet      common.Address  `json:"wallet"`
+	Amount      string          `json:"amount"`
+	BlockNumber uint64          `json:"blockNumber"`
+	BlockHash   common.Hash     `json:"blockHash"`
+	BlockTime   time.Time       `json:"blockTime"`
+	Status      deposits.Status `json:"status"`
+	DetectedAt  time.Time       `json:"detectedAt"`
+}
+
+func newDepositJSON(d *deposits.Deposit) depositJSON {
+	return depositJSON{
+		ChainID:     d.ChainID,
+		TxHash:      d.TxHash,
+		LogIndex:    d.LogIndex,
+		Token:       d.Token,
+		From:        d.From,
+		Wallet:      d.Wallet,
+		Amount:      amountString(d.Amount),
+		BlockNumber: d.BlockNumber,
+		BlockHash:   d.BlockHash,
+		BlockTime:   d.BlockTime,
+		Status:      d.Status,
+		DetectedAt:  d.DetectedAt,
+	}
+}
+
+type sweepJSON struct {
+	ID          string               `json:"id"`
+	ChainID     uint64               `json:"chainId"`
+	State       reciever.SweepState  `json:"state"`
+	Token       common.Address       `json:"token"`
+	Destination common.Address       `json:"destination"`
+	Amount      string               `json:"amount"`
+	FundingPath reciever.FundingPath `json:"fundingPath,omitempty"`
+	FundingTx   *common.Hash         `json:"fundingTx,omitempty"`
+	TokenTx     *common.Hash         `json:"tokenTx,omitempty"`
+	Flag        string               `json:"flag,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	CreatedAt   time.Time            `json:"createdAt"`
+	UpdatedAt   time.Time            `json:"updatedAt"`
+}
+
+func newSweepJSON(rec *reciever.SweepRecord) sweepJSON {
+	return sweepJSON{
+		ID:          rec.ID,
+		ChainID:     rec.ChainID,
+		State:       rec.State,
+		Token:       rec.Token,
+		Destination: rec.Destination,
+		Amount:      amountString(rec.Amount),
+		FundingPath: rec.FundingPath,
+		FundingTx:   optionalHash(rec.FundingTx),
+		TokenTx:     optionalHash(rec.TokenTx),
+		Flag:        rec.Flag,
+		Error:       rec.Error,
+		CreatedAt:   rec.CreatedAt,
+		UpdatedAt:   rec.UpdatedAt,
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func amountString(amount *big.Int) string {
+	if amount == nil {
+		return "0"
+	}
+	return amount.String()
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func optionalHash(hash common.Hash) *common.Hash {
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	return &hash
+}
@@ -0,0 +1,280 @@
+// Package daemon runs sweep cycles of a handler.Handler for as long as a process lives: on
+// an interval, and on new blocks of chains that notify them. A stop signal lets the cycle
+// in flight finish, so a wallet funded with gas is swept rather than abandoned.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"allen-liaoo/payment-reciever/handler"
+)
+
+const (
+	defaultInterval     = time.Minute
+	defaultCycleTimeout = 5 * time.Minute
+)
+
+// HeadSubscriber notifies new blocks, as ethclient.Client does over websockets or IPC.
+type HeadSubscriber interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// Daemon runs Handle, e.g. a handler.Handler's, one cycle at a time. Triggers arriving
+// during a cycle are merged into the next one.
+type Daemon struct {
+	Handle   func(ctx context.Context, event handler.Event) (*handler.Summary, error)
+	Interval time.Duration // between cycles of every chain; defaults to 1m
+	// Heads, if set, runs a cycle of a chain, by chain ID, on each of its new blocks. A
+	// chain whose subscription fails is subscribed again after Interval.
+	Heads map[uint64]HeadSubscriber
+	// CycleTimeout is the deadline of a cycle; defaults to 5m. A stop signal does not
+	// shorten it.
+	CycleTimeout time.Duration
+	// MaxStale is how long after the last successful cycle Health reports unhealthy;
+	// defaults to three Intervals.
+	MaxStale time.Duration
+
+	wake chan struct{} // pending has something
+
+	mu       sync.Mutex
+	pending  map[uint64]bool // chains whose blocks triggered the next cycle
+	all      bool            // the next cycle is of every chain
+	started  time.Time
+	stopping bool
+	running  bool
+	cycles   int
+	last     *handler.Summary
+	lastErr  error
+	lastOK   time.Time
+}
+
+// Run runs a cycle of every chain at once, then cycles on triggers until ctx is done. The
+// cycle in flight then finishes before Run returns.
+func (d *Daemon) Run(ctx context.Context) error {
+	d.mu.Lock()
+	d.wake = make(chan struct{}, 1)
+	d.pending = make(map[uint64]bool)
+	d.started = time.Now()
+	d.mu.Unlock()
+	// reported at once, though the cycle in flight goes on
+	stop := context.AfterFunc(ctx, func() {
+		d.mu.Lock()
+		d.stopping = true
+		d.mu.Unlock()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer func() {
+		stopWatching()
+		wg.Wait()
+	}()
+	for chainID, heads := range d.Heads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.watchHeads(watchCtx, chainID, heads)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(d.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case <-ticker.C:
+				d.trigger(0, true)
+			}
+		}
+	}()
+
+	d.trigger(0, true)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.wake:
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		event, ok := d.take()
+		if !ok {
+			// woken by a trigger the last cycle already took
+			continue
+		}
+		// a stop signal arriving now waits for the cycle
+		d.cycle(context.WithoutCancel(ctx), event)
+	}
+}
+
+// trigger asks for a cycle of chainID, or of every chain
+func (d *Daemon) trigger(chainID uint64, all bool) {
+	d.mu.Lock()
+	if all {
+		d.all = true
+	} else {
+		d.pending[chainID] = true
+	}
+	d.mu.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the event of the triggered chains, false if none were, and marks the cycle
+// running
+func (d *Daemon) take() (handler.Event, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var event handler.Event
+	if !d.all {
+		if len(d.pending) == 0 {
+			return event, false
+		}
+		for chainID := range d.pending {
+			event.ChainIDs = append(event.ChainIDs, chainID)
+		}
+		sort.Slice(event.ChainIDs, func(a, b int) bool { return event.ChainIDs[a] < event.ChainIDs[b] })
+	}
+	d.all = false
+	clear(d.pending)
+	d.running = true
+	return event, true
+}
+
+// cycle runs one cycle
+func (d *Daemon) cycle(ctx context.Context, event handler.Event) {
+	timeout := d.CycleTimeout
+	if timeout <= 0 {
+		timeout = defaultCycleTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	summary, err := d.Handle(ctx, event)
+	if err != nil {
+		log.Printf("sweep cycle: %v", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = false
+	d.cycles++
+	d.last, d.lastErr = summary, err
+	if err == nil {
+		d.lastOK = time.Now()
+	}
+}
+
+// watchHeads triggers a cycle of chainID on each of its new blocks until ctx is done
+func (d *Daemon) watchHeads(ctx context.Context, chainID uint64, heads HeadSubscriber) {
+	for {
+		ch := make(chan *types.Header, 1)
+		sub, err := heads.SubscribeNewHead(ctx, ch)
+		if err == nil {
+			err = d.forwardHeads(ctx, chainID, sub, ch)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("chain %d: new blocks: %v", chainID, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.interval()):
+		}
+	}
+}
+
+// forwardHeads triggers cycles of a subscription's blocks until it fails or ctx is done
+func (d *Daemon) forwardHeads(ctx context.Context, chainID uint64, sub ethereum.Subscription, ch <-chan *types.Header) error {
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sub.Err():
+			return err
+		case <-ch:
+			d.trigger(chainID, false)
+		}
+	}
+}
+
+func (d *Daemon) interval() time.Duration {
+	if d.Interval > 0 {
+		return d.Interval
+	}
+	return defaultInterval
+}
+
+// Status is the JSON body of the health endpoint.
+type Status struct {
+	Status    string           `json:"status"` // ok, starting, failing, stale or stopping
+	Running   bool             `json:"running"`
+	Cycles    int              `json:"cycles"`
+	LastOK    *time.Time       `json:"lastOk,omitempty"`
+	LastError string           `json:"lastError,omitempty"`
+	Last      *handler.Summary `json:"last,omitempty"`
+}
+
+// Health serves the daemon's Status, with 200 while cycles succeed and 503 otherwise: when
+// the last cycle failed, when none succeeded within MaxStale, or once it is stopping.
+func (d *Daemon) Health() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := d.status(time.Now())
+		code := http.StatusOK
+		if status.Status != "ok" && status.Status != "starting" {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("writing health: %v", err)
+		}
+	})
+}
+
+func (d *Daemon) status(now time.Time) Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := Status{Running: d.running, Cycles: d.cycles, Last: d.last}
+	if !d.lastOK.IsZero() {
+		lastOK := d.lastOK
+		s.LastOK = &lastOK
+	}
+	if d.lastErr != nil {
+		s.LastError = d.lastErr.Error()
+	}
+	maxStale := d.MaxStale
+	if maxStale <= 0 {
+		maxStale = 3 * d.interval()
+	}
+	switch {
+	case d.stopping:
+		s.Status = "stopping"
+	case d.lastErr != nil:
+		s.Status = "failing"
+	case d.lastOK.IsZero() && (d.started.IsZero() || now.Sub(d.started) < maxStale):
+		s.Status = "starting"
+	case now.Sub(d.lastOK) > maxStale:
+		s.Status = "stale"
+	default:
+		s.Status = "ok"
+	}
+	return s
+}
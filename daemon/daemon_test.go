@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/handler"
+)
+
+// cycles is a Handle reporting each call's event and holding it until released
+type cycles struct {
+	events  chan handler.Event
+	release chan error
+}
+
+func newCycles() *cycles {
+	return &cycles{events: make(chan handler.Event), release: make(chan error)}
+}
+
+func (c *cycles) handle(ctx context.Context, event handler.Event) (*handler.Summary, error) {
+	c.events <- event
+	err := <-c.release
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return &handler.Summary{}, err
+}
+
+func (c *cycles) next(t *testing.T) handler.Event {
+	select {
+	case event := <-c.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no cycle")
+		return handler.Event{}
+	}
+}
+
+func health(t *testing.T, d *Daemon) (int, Status) {
+	rec := httptest.NewRecorder()
+	d.Health().ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var status Status
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	return rec.Code, status
+}
+
+func TestRunShutdown(t *testing.T) {
+	c := newCycles()
+	d := &Daemon{Handle: c.handle, Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+
+	assert.Empty(t, c.next(t).ChainIDs, "the first cycle is of every chain")
+	code, status := health(t, d)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "starting", status.Status)
+	assert.True(t, status.Running)
+
+	// the cycle in flight finishes, with a context the stop did not cancel
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("stopped mid-cycle")
+	case <-time.After(50 * time.Millisecond):
+	}
+	code, status = health(t, d)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "stopping", status.Status)
+	c.release <- nil
+	assert.NoError(t, <-done)
+	_, status = health(t, d)
+	assert.Equal(t, 1, status.Cycles)
+	assert.NotNil(t, status.LastOK)
+	assert.Empty(t, status.LastError)
+}
+
+// heads hands out the channel of each subscription
+type heads chan chan<- *types.Header
+
+func (h heads) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	h <- ch
+	return subscription{}, nil
+}
+
+type subscription struct{}
+
+func (subscription) Unsubscribe()      {}
+func (subscription) Err() <-chan error { return nil }
+
+func TestRunHeads(t *testing.T) {
+	c := newCycles()
+	base := make(heads)
+	d := &Daemon{Handle: c.handle, Interval: time.Hour, Heads: map[uint64]HeadSubscriber{8453: base}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+
+	blocks := <-base
+	c.next(t)
+	c.release <- errors.New("node down")
+	assert.Eventually(t, func() bool { return d.status(time.Now()).Cycles == 1 }, 5*time.Second, time.Millisecond)
+	code, status := health(t, d)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "failing", status.Status)
+	assert.Equal(t, "node down", status.LastError)
+
+	// a block triggers a cycle of its chain; blocks during it are merged into one more
+	blocks <- &types.Header{}
+	assert.Equal(t, []uint64{8453}, c.next(t).ChainIDs)
+	blocks <- &types.Header{}
+	blocks <- &types.Header{}
+	c.release <- nil
+	assert.Equal(t, []uint64{8453}, c.next(t).ChainIDs)
+	cancel()
+	c.release <- nil
+	assert.NoError(t, <-done)
+	_, status = health(t, d)
+	assert.Equal(t, 3, status.Cycles)
+}
+
+func TestStatus(t *testing.T) {
+	now := time.Now()
+	d := &Daemon{Interval: time.Minute, started: now.Add(-time.Hour)}
+	assert.Equal(t, "stale", d.status(now).Status, "no cycle since starting")
+	d.lastOK = now.Add(-time.Minute)
+	assert.Equal(t, "ok", d.status(now).Status)
+	assert.Equal(t, "stale", d.status(now.Add(3*time.Minute)).Status)
+	d.MaxStale = time.Hour
+	assert.Equal(t, "ok", d.status(now.Add(3*time.Minute)).Status)
+}
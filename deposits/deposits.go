@@ -0,0 +1,232 @@
+// Package deposits records token payments into middleware wallets, found by indexing
+// ERC-20 Transfer logs rather than polling balances.
+package deposits
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Status is how final a deposit is. A deposit moves pending -> confirmed once enough
+// blocks are built on its block, or becomes orphaned if a reorg takes its block away.
+type Status string
+
+const (
+	StatusPending   Status = "pending"   // seen in a block, not yet deep enough to credit
+	StatusConfirmed Status = "confirmed" // deep enough, can be credited
+	StatusOrphaned  Status = "orphaned"  // its block was reorged out
+)
+
+// Deposit is a Transfer log crediting a middleware wallet.
+type Deposit struct {
+	ChainID     uint64
+	TxHash      common.Hash
+	LogIndex    uint
+	Token       common.Address
+	From        common.Address
+	Wallet      common.Address // the middleware wallet paid
+	Amount      *big.Int
+	BlockNumber uint64
+	BlockHash   common.Hash
+	BlockTime   time.Time // of its block, which tells whether it paid an invoice in time
+	Status      Status
+	DetectedAt  time.Time
+	Swept       bool // its wallet was swept of it, see Store.Unswept
+}
+
+// Checkpoint is an indexed block, its hash kept to notice when a reorg replaces it.
+type Checkpoint struct {
+	Number uint64
+	Hash   common.Hash
+}
+
+// maxCheckpoints is how many indexed blocks per chain keep their hash; a reorg deeper
+// than the oldest of them is rewound to it
+const maxCheckpoints = 256
+
+// key identifies a deposit: a log is credited once
+type key struct {
+	chainID  uint64
+	txHash   common.Hash
+	logIndex uint
+}
+
+func (d *Deposit) key() key {
+	return key{d.ChainID, d.TxHash, d.LogIndex}
+}
+
+// Store persists deposits and how far each chain has been indexed.
+type Store interface {
+	// Add stores a deposit, reporting false if the same log was already stored. An
+	// orphaned deposit found again, in the block that replaced its own, is stored anew.
+	Add(d *Deposit) (bool, error)
+	// ByWallet returns a wallet's deposits on a chain, oldest block first.
+	ByWallet(chainID uint64, wallet common.Address) ([]*Deposit, error)
+	// Pending returns a chain's pending deposits, oldest block first.
+	Pending(chainID uint64) ([]*Deposit, error)
+	SetStatus(d *Deposit, status Status) error
+	// Unswept returns a chain's confirmed deposits not yet marked swept, oldest block first.
+	Unswept(chainID uint64) ([]*Deposit, error)
+	// SetSwept marks a deposit swept out of its wallet.
+	SetSwept(d *Deposit) error
+	// LastBlock returns the last block indexed on a chain, and false if none was.
+	LastBlock(chainID uint64) (Checkpoint, bool, error)
+	// SetLastBlock records the last block indexed on a chain.
+	SetLastBlock(chainID uint64, block Checkpoint) error
+	// Checkpoints returns the latest indexed blocks of a chain, newest first.
+	Checkpoints(chainID uint64) ([]Checkpoint, error)
+	// Rewind forgets the blocks indexed after block, as if they never were, and marks the
+	// deposits in them orphaned. It returns the newly orphaned deposits.
+	Rewind(chainID uint64, block uint64) ([]*Deposit, error)
+}
+
+var ErrDepositNotFound = errors.New("deposit not found")
+
+// MemoryStore keeps deposits and checkpoints in maps. An indexer using it starts again at
+// the current block after a restart, missing the payments made in between.
+type MemoryStore struct {
+	mu          sync.Mutex
+	deposits    map[key]*Deposit
+	checkpoints map[uint64][]Checkpoint // newest first
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{deposits: make(map[key]*Deposit), checkpoints: make(map[uint64][]Checkpoint)}
+}
+
+func (s *MemoryStore) Add(d *Deposit) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.deposits[d.key()]; ok && existing.Status != StatusOrphaned {
+		return false, nil
+	}
+	c := *d
+	s.deposits[d.key()] = &c
+	return true, nil
+}
+
+func (s *MemoryStore) ByWallet(chainID uint64, wallet common.Address) ([]*Deposit, error) {
+	return s.find(func(d *Deposit) bool { return d.ChainID == chainID && d.Wallet == wallet }), nil
+}
+
+func (s *MemoryStore) Pending(chainID uint64) ([]*Deposit, error) {
+	return s.find(func(d *Deposit) bool { return d.ChainID == chainID && d.Status == StatusPending }), nil
+}
+
+func (s *MemoryStore) SetStatus(d *Deposit, status Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.deposits[d.key()]
+	if !ok {
+		return ErrDepositNotFound
+	}
+	existing.Status = status
+	return nil
+}
+
+func (s *MemoryStore) Unswept(chainID uint64) ([]*Deposit, error) {
+	return s.find(func(d *Deposit) bool { return d.ChainID == chainID && d.Status == StatusConfirmed && !d.Swept }), nil
+}
+
+func (s *MemoryStore) SetSwept(d *Deposit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.deposits[d.key()]
+	if !ok {
+		return ErrDepositNotFound
+	}
+	existing.Swept = true
+	return nil
+}
+
+func (s *MemoryStore) LastBlock(chainID uint64) (Checkpoint, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoints := s.checkpoints[chainID]
+	if len(checkpoints) == 0 {
+		return Checkpoint{}, false, nil
+	}
+	return checkpoints[0], true, nil
+}
+
+func (s *MemoryStore) SetLastBlock(chainID uint64, block Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoints := append([]Checkpoint{block}, s.checkpoints[chainID]...)
+	s.checkpoints[chainID] = checkpoints[:min(len(checkpoints), maxCheckpoints)]
+	return nil
+}
+
+func (s *MemoryStore) Checkpoints(chainID uint64) ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Checkpoint(nil), s.checkpoints[chainID]...), nil
+}
+
+func (s *MemoryStore) Rewind(chainID uint64, block uint64) ([]*Deposit, error) {
+	s.mu.Lock()
+	checkpoints := s.checkpoints[chainID]
+	for len(checkpoints) > 0 && checkpoints[0].Number > block {
+		checkpoints = checkpoints[1:]
+	}
+	if len(checkpoints) == 0 || checkpoints[0].Number < block {
+		// the block itself is still indexed, its hash unknown
+		checkpoints = append([]Checkpoint{{Number: block}}, checkpoints...)
+	}
+	s.checkpoints[chainID] = checkpoints
+	s.mu.Unlock()
+
+	orphaned := s.find(func(d *Deposit) bool {
+		return d.ChainID == chainID && d.BlockNumber > block && d.Status != StatusOrphaned
+	})
+	for _, d := range orphaned {
+		d.Status = StatusOrphaned
+		if err := s.SetStatus(d, StatusOrphaned); err != nil {
+			return nil, err
+		}
+	}
+	return orphaned, nil
+}
+
+// find returns copies of the deposits matching fn, oldest block first
+func (s *MemoryStore) find(fn func(d *Deposit) bool) []*Deposit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []*Deposit
+	for _, d := range s.deposits {
+		if fn(d) {
+			c := *d
+			found = append(found, &c)
+		}
+	}
+	sortDeposits(found)
+	return found
+}
+
+// sortDeposits orders deposits by block, then position in the block
+func sortDeposits(deposits []*Deposit) {
+	sort.Slice(deposits, func(a, b int) bool {
+		if deposits[a].BlockNumber != deposits[b].BlockNumber {
+			return deposits[a].BlockNumber < deposits[b].BlockNumber
+		}
+		return deposits[a].LogIndex < deposits[b].LogIndex
+	})
+}
+
+// Wallets returns the wallets deposits were paid into, each once, in order of first deposit.
+func Wallets(deposits []*Deposit) []common.Address {
+	seen := make(map[common.Address]bool)
+	var wallets []common.Address
+	for _, d := range deposits {
+		if !seen[d.Wallet] {
+			seen[d.Wallet] = true
+			wallets = append(wallets, d.Wallet)
+		}
+	}
+	return wallets
+}
@@ -0,0 +1,124 @@
+package deposits
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/testdb"
+)
+
+// stores returns every Store implementation, empty
+func stores(t *testing.T) map[string]Store {
+	sqlite, err := NewSQLiteStore(testdb.Open(t))
+	assert.NoError(t, err)
+
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestStore(t *testing.T) {
+	wallet := common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+	token := common.HexToAddress("0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238")
+	deposit := func(chainID uint64, block uint64, logIndex uint) *Deposit {
+		return &Deposit{
+			ChainID:     chainID,
+			TxHash:      common.BigToHash(big.NewInt(int64(block))),
+			LogIndex:    logIndex,
+			Token:       token,
+			From:        common.HexToAddress("0x01"),
+			Wallet:      wallet,
+			Amount:      big.NewInt(20),
+			BlockNumber: block,
+			BlockHash:   common.BigToHash(big.NewInt(int64(block * 1000))),
+			BlockTime:   time.Unix(1700000000-int64(12*block), 0),
+			Status:      StatusPending,
+			DetectedAt:  time.Unix(1700000000, 0),
+		}
+	}
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, d := range []*Deposit{deposit(1, 12, 0), deposit(1, 10, 3), deposit(10, 11, 0)} {
+				added, err := store.Add(d)
+				assert.NoError(t, err)
+				assert.True(t, added)
+			}
+			added, err := store.Add(deposit(1, 10, 3))
+			assert.NoError(t, err)
+			assert.False(t, added, "the same log is stored once")
+
+			found, err := store.ByWallet(1, wallet)
+			assert.NoError(t, err)
+			if assert.Len(t, found, 2) {
+				assert.Equal(t, *deposit(1, 10, 3), *found[0])
+				assert.Equal(t, uint64(12), found[1].BlockNumber)
+			}
+
+			_, ok, err := store.LastBlock(1)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			for _, block := range []uint64{10, 12, 15} {
+				assert.NoError(t, store.SetLastBlock(1, Checkpoint{Number: block, Hash: common.BigToHash(big.NewInt(int64(block)))}))
+			}
+			last, ok, err := store.LastBlock(1)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, Checkpoint{Number: 15, Hash: common.BigToHash(big.NewInt(15))}, last)
+
+			assert.NoError(t, store.SetStatus(deposit(1, 10, 3), StatusConfirmed))
+			pending, err := store.Pending(1)
+			assert.NoError(t, err)
+			if assert.Len(t, pending, 1) {
+				assert.Equal(t, uint64(12), pending[0].BlockNumber)
+			}
+			assert.ErrorIs(t, store.SetStatus(deposit(1, 99, 0), StatusConfirmed), ErrDepositNotFound)
+
+			// confirmed deposits are unswept until marked
+			unswept, err := store.Unswept(1)
+			assert.NoError(t, err)
+			if assert.Len(t, unswept, 1) {
+				assert.Equal(t, uint64(10), unswept[0].BlockNumber)
+			}
+			assert.NoError(t, store.SetSwept(unswept[0]))
+			unswept, err = store.Unswept(1)
+			assert.NoError(t, err)
+			assert.Empty(t, unswept)
+			found, err = store.ByWallet(1, wallet)
+			assert.NoError(t, err)
+			assert.True(t, found[0].Swept)
+			assert.ErrorIs(t, store.SetSwept(deposit(1, 99, 0)), ErrDepositNotFound)
+
+			// a reorg after block 11 orphans the deposit of block 12 and forgets blocks 12 and 15
+			orphaned, err := store.Rewind(1, 11)
+			assert.NoError(t, err)
+			if assert.Len(t, orphaned, 1) {
+				assert.Equal(t, uint64(12), orphaned[0].BlockNumber)
+				assert.Equal(t, StatusOrphaned, orphaned[0].Status)
+			}
+			checkpoints, err := store.Checkpoints(1)
+			assert.NoError(t, err)
+			assert.Equal(t, []Checkpoint{{Number: 11}, {Number: 10, Hash: common.BigToHash(big.NewInt(10))}}, checkpoints)
+			pending, err = store.Pending(1)
+			assert.NoError(t, err)
+			assert.Empty(t, pending)
+
+			// the orphaned log found again in the block replacing its own
+			again := deposit(1, 12, 0)
+			again.BlockNumber, again.BlockHash = 13, common.HexToHash("0x13")
+			added, err = store.Add(again)
+			assert.NoError(t, err)
+			assert.True(t, added)
+			found, err = store.ByWallet(1, wallet)
+			assert.NoError(t, err)
+			if assert.Len(t, found, 2) {
+				assert.Equal(t, *again, *found[1])
+			}
+		})
+	}
+}
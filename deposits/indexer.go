@@ -0,0 +1,282 @@
+package deposits
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"allen-liaoo/payment-reciever/erc20"
+	"allen-liaoo/payment-reciever/registry"
+)
+
+const (
+	defaultMaxRange = 2000 // blocks per log query, within common node limits
+	walletsPerQuery = 500  // recipient addresses per log query
+)
+
+// Client is the part of a node the indexer reads logs and block hashes from.
+type Client interface {
+	bind.ContractFilterer
+	ethereum.BlockNumberReader
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// Indexer finds Transfer logs of registered tokens paying active middleware wallets. Each
+// Poll scans the blocks after the last one it indexed, as persisted in the store.
+//
+// Deposits are pending until Confirmations blocks are built on theirs. Before scanning,
+// a Poll compares the hashes of the blocks it indexed and of the blocks of pending deposits
+// with the node's; when a reorg replaced some, it rewinds to the last block still on the
+// chain, orphaning the deposits after it, and scans the new blocks again.
+type Indexer struct {
+	Client        Client
+	ChainID       uint64
+	Tokens        []common.Address
+	Wallets       registry.WalletRegistry
+	Store         Store
+	StartBlock    uint64 // first block to index on a chain never indexed; 0 for the current head
+	MaxRange      uint64 // blocks per log query; defaults to 2000
+	Confirmations uint64 // blocks on top of a deposit's before it is confirmed; 0 confirms it once mined
+}
+
+// PollResult is what changed in a Poll, each list oldest first.
+type PollResult struct {
+	Detected  []*Deposit // deposits new to the store
+	Confirmed []*Deposit // deposits that became confirmed, including detected ones
+	Orphaned  []*Deposit // deposits whose block a reorg replaced
+}
+
+// Poll indexes the blocks up to the current head. Deposits are stored as they are found,
+// and the last indexed block after each range of blocks, so an interrupted poll does not
+// miss or repeat deposits.
+func (ix *Indexer) Poll(ctx context.Context) (*PollResult, error) {
+	result := &PollResult{}
+	head, err := ix.Client.BlockNumber(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Orphaned, err = ix.rewind(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	last, ok, err := ix.Store.LastBlock(ix.ChainID)
+	if err != nil {
+		return result, err
+	}
+	from := last.Number + 1
+	if !ok {
+		from = ix.StartBlock
+		if from == 0 {
+			from = head
+		}
+	}
+	if from <= head {
+		result.Detected, err = ix.index(ctx, from, head)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Confirmed, err = ix.confirm(head)
+	if err != nil {
+		return result, err
+	}
+	confirmed := make(map[key]bool, len(result.Confirmed))
+	for _, d := range result.Confirmed {
+		confirmed[d.key()] = true
+	}
+	for _, d := range result.Detected {
+		if confirmed[d.key()] {
+			d.Status = StatusConfirmed
+		}
+	}
+	return result, nil
+}
+
+// index scans blocks from to head and returns the deposits found in them
+func (ix *Indexer) index(ctx context.Context, from uint64, head uint64) ([]*Deposit, error) {
+	active, err := ix.Wallets.Active()
+	if err != nil {
+		return nil, err
+	}
+	wallets := make(map[common.Address]bool, len(active))
+	var addresses []common.Address
+	for _, w := range active {
+		wallets[w.Address] = true
+		addresses = append(addresses, w.Address)
+	}
+
+	maxRange := ix.MaxRange
+	if maxRange == 0 {
+		maxRange = defaultMaxRange
+	}
+	var found []*Deposit
+	for start := from; start <= head; start += maxRange {
+		end := min(start+maxRange-1, head)
+		for i := 0; i < len(addresses); i += walletsPerQuery {
+			recipients := addresses[i:min(i+walletsPerQuery, len(addresses))]
+			for _, token := range ix.Tokens {
+				deposits, err := ix.scan(ctx, token, start, end, recipients, wallets)
+				if err != nil {
+					return found, err
+				}
+				found = append(found, deposits...)
+			}
+		}
+		header, err := ix.Client.HeaderByNumber(ctx, new(big.Int).SetUint64(end))
+		if err != nil {
+			return found, err
+		}
+		if err := ix.Store.SetLastBlock(ix.ChainID, Checkpoint{Number: end, Hash: header.Hash()}); err != nil {
+			return found, err
+		}
+	}
+	sortDeposits(found)
+	return found, nil
+}
+
+// scan stores and returns the new deposits of a token into recipients in blocks start to end
+func (ix *Indexer) scan(ctx context.Context, token common.Address, start uint64, end uint64, recipients []common.Address, wallets map[common.Address]bool) ([]*Deposit, error) {
+	filterer, err := erc20.NewErc20Filterer(token, ix.Client)
+	if err != nil {
+		return nil, err
+	}
+	it, err := filterer.FilterTransfer(&bind.FilterOpts{Start: start, End: &end, Context: ctx}, nil, recipients)
+	if err != nil {
+		return nil, fmt.Errorf("transfers of %s in blocks %d to %d: %w", token.Hex(), start, end, err)
+	}
+	defer it.Close()
+
+	var found []*Deposit
+	blockTimes := make(map[uint64]time.Time)
+	for it.Next() {
+		transfer := it.Event
+		if transfer.Raw.Removed || !wallets[transfer.To] || transfer.Value.Sign() == 0 {
+			continue
+		}
+		blockTime, ok := blockTimes[transfer.Raw.BlockNumber]
+		if !ok {
+			header, err := ix.Client.HeaderByNumber(ctx, new(big.Int).SetUint64(transfer.Raw.BlockNumber))
+			if err != nil {
+				return found, err
+			}
+			blockTime = time.Unix(int64(header.Time), 0)
+			blockTimes[transfer.Raw.BlockNumber] = blockTime
+		}
+		d := &Deposit{
+			ChainID:     ix.ChainID,
+			TxHash:      transfer.Raw.TxHash,
+			LogIndex:    transfer.Raw.Index,
+			Token:       token,
+			From:        transfer.From,
+			Wallet:      transfer.To,
+			Amount:      transfer.Value,
+			BlockNumber: transfer.Raw.BlockNumber,
+			BlockHash:   transfer.Raw.BlockHash,
+			BlockTime:   blockTime,
+			Status:      StatusPending,
+			DetectedAt:  time.Now(),
+		}
+		added, err := ix.Store.Add(d)
+		if err != nil {
+			return found, err
+		}
+		if added {
+			found = append(found, d)
+		}
+	}
+	return found, it.Error()
+}
+
+// rewind finds the last indexed block a reorg left on the chain, rewinds the store to it,
+// and returns the deposits orphaned after it
+func (ix *Indexer) rewind(ctx context.Context) ([]*Deposit, error) {
+	checkpoints, err := ix.Store.Checkpoints(ix.ChainID)
+	if err != nil || len(checkpoints) == 0 {
+		return nil, err
+	}
+	last := checkpoints[0].Number
+	// a reorg deeper than every checkpoint is rewound to before the oldest
+	fork := checkpoints[len(checkpoints)-1].Number
+	if fork > 0 {
+		fork--
+	}
+	for _, cp := range checkpoints {
+		onChain, err := ix.onChain(ctx, cp.Number, cp.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if onChain {
+			fork = cp.Number
+			break
+		}
+	}
+
+	// a reorg between finding a deposit and checkpointing its range leaves a pending
+	// deposit of a replaced block below the checkpoint
+	pending, err := ix.Store.Pending(ix.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range pending {
+		if d.BlockNumber > fork {
+			break
+		}
+		onChain, err := ix.onChain(ctx, d.BlockNumber, d.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		if !onChain {
+			fork = d.BlockNumber - 1
+			break
+		}
+	}
+
+	if fork >= last {
+		return nil, nil
+	}
+	log.Printf("chain %d: blocks after %d were reorged, indexing them again", ix.ChainID, fork)
+	return ix.Store.Rewind(ix.ChainID, fork)
+}
+
+// onChain reports whether block number of the node's chain has hash; an unknown (zero)
+// hash is taken to match
+func (ix *Indexer) onChain(ctx context.Context, number uint64, hash common.Hash) (bool, error) {
+	if hash == (common.Hash{}) {
+		return true, nil
+	}
+	header, err := ix.Client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return false, err
+	}
+	return header.Hash() == hash, nil
+}
+
+// confirm marks pending deposits with enough blocks on top of theirs, up to head,
+// confirmed and returns them
+func (ix *Indexer) confirm(head uint64) ([]*Deposit, error) {
+	pending, err := ix.Store.Pending(ix.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	var confirmed []*Deposit
+	for _, d := range pending {
+		if d.BlockNumber+ix.Confirmations > head {
+			break
+		}
+		if err := ix.Store.SetStatus(d, StatusConfirmed); err != nil {
+			return confirmed, err
+		}
+		d.Status = StatusConfirmed
+		confirmed = append(confirmed, d)
+	}
+	return confirmed, nil
+}
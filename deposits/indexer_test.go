@@ -0,0 +1,151 @@
+package deposits
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/registry"
+	"allen-liaoo/payment-reciever/testing/simchain"
+)
+
+func TestIndexerPoll(t *testing.T) {
+	chain := simchain.New(t)
+	other := chain.DeployToken(t, big.NewInt(1_000_000), "Tether", 6, "USDT")
+	unknown := chain.DeployToken(t, big.NewInt(1_000_000), "Junk", 6, "JUNK")
+	a := common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+	b := common.HexToAddress("0x8464135c8F25Da09e49BC8782676a84730C318bC")
+	retired := common.HexToAddress("0x4B20993Bc481177ec7E8f571ceCaE8A9e22C02db")
+	wallets := registry.NewMemoryRegistry()
+	assert.NoError(t, wallets.Add(&registry.Wallet{Index: 1, Address: a, Status: registry.StatusActive}))
+	assert.NoError(t, wallets.Add(&registry.Wallet{Index: 2, Address: b, Status: registry.StatusActive}))
+	assert.NoError(t, wallets.Add(&registry.Wallet{Index: 3, Address: retired, Status: registry.StatusRetired}))
+
+	store := NewMemoryStore()
+	ix := &Indexer{
+		Client:     chain.Client,
+		ChainID:    simchain.ChainID.Uint64(),
+		Tokens:     []common.Address{chain.Token, other},
+		Wallets:    wallets,
+		Store:      store,
+		StartBlock: 1,
+		MaxRange:   2,
+	}
+
+	chain.SendToken(t, chain.Token, a, big.NewInt(20))
+	chain.SendToken(t, other, b, big.NewInt(30))
+	chain.SendToken(t, chain.Token, retired, big.NewInt(5))
+	chain.SendToken(t, unknown, a, big.NewInt(5))
+	chain.SendToken(t, chain.Token, common.HexToAddress("0x01"), big.NewInt(5))
+
+	res, err := ix.Poll(context.Background())
+	assert.NoError(t, err)
+	found := res.Detected
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, a, found[0].Wallet)
+		assert.Equal(t, chain.Token, found[0].Token)
+		assert.Equal(t, chain.Funder, found[0].From)
+		assert.Equal(t, int64(20), found[0].Amount.Int64())
+		assert.NotEqual(t, common.Hash{}, found[0].TxHash)
+		assert.NotEqual(t, common.Hash{}, found[0].BlockHash)
+		header, err := chain.Client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(found[0].BlockNumber))
+		assert.NoError(t, err)
+		assert.Equal(t, time.Unix(int64(header.Time), 0), found[0].BlockTime)
+		assert.Equal(t, other, found[1].Token)
+		assert.Equal(t, b, found[1].Wallet)
+	}
+	assert.Equal(t, []common.Address{a, b}, Wallets(found))
+
+	head, err := chain.Client.BlockNumber(context.Background())
+	assert.NoError(t, err)
+	last, _, err := store.LastBlock(ix.ChainID)
+	assert.NoError(t, err)
+	assert.Equal(t, head, last.Number)
+	assert.Equal(t, found, res.Confirmed, "no confirmations needed")
+	assert.Equal(t, StatusConfirmed, found[0].Status)
+
+	// only blocks after the last indexed one are scanned
+	res, err = ix.Poll(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, res.Detected)
+	chain.SendToken(t, chain.Token, a, big.NewInt(7))
+	res, err = ix.Poll(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, res.Detected, 1) {
+		assert.Equal(t, int64(7), res.Detected[0].Amount.Int64())
+	}
+	all, err := store.ByWallet(ix.ChainID, a)
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func TestIndexerReorg(t *testing.T) {
+	ctx := context.Background()
+	chain := simchain.New(t)
+	a := common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+	b := common.HexToAddress("0x8464135c8F25Da09e49BC8782676a84730C318bC")
+	wallets := registry.NewMemoryRegistry()
+	assert.NoError(t, wallets.Add(&registry.Wallet{Index: 1, Address: a, Status: registry.StatusActive}))
+	assert.NoError(t, wallets.Add(&registry.Wallet{Index: 2, Address: b, Status: registry.StatusActive}))
+
+	store := NewMemoryStore()
+	ix := &Indexer{
+		Client:        chain.Client,
+		ChainID:       simchain.ChainID.Uint64(),
+		Tokens:        []common.Address{chain.Token},
+		Wallets:       wallets,
+		Store:         store,
+		StartBlock:    1,
+		Confirmations: 2,
+	}
+
+	chain.SendToken(t, chain.Token, a, big.NewInt(20))
+	res, err := ix.Poll(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, res.Detected, 1) {
+		assert.Equal(t, StatusPending, res.Detected[0].Status)
+	}
+	assert.Empty(t, res.Confirmed)
+
+	// fork off before the deposit to b, and outgrow its chain
+	head, err := chain.Client.HeaderByNumber(ctx, nil)
+	assert.NoError(t, err)
+	chain.SendToken(t, chain.Token, b, big.NewInt(30))
+	res, err = ix.Poll(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, res.Detected, 1)
+	assert.Empty(t, res.Confirmed, "a has 1 block on top of its deposit")
+
+	assert.NoError(t, chain.Backend.Fork(head.Hash()))
+	chain.Backend.Commit()
+	chain.Backend.Commit()
+	res, err = ix.Poll(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, res.Orphaned, 1) {
+		assert.Equal(t, b, res.Orphaned[0].Wallet)
+		assert.Equal(t, StatusOrphaned, res.Orphaned[0].Status)
+	}
+	if assert.Len(t, res.Confirmed, 1) {
+		assert.Equal(t, a, res.Confirmed[0].Wallet)
+	}
+
+	last, _, err := store.LastBlock(ix.ChainID)
+	assert.NoError(t, err)
+	current, err := chain.Client.HeaderByNumber(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Checkpoint{Number: current.Number.Uint64(), Hash: current.Hash()}, last)
+
+	// the pool mined the orphaned transfer again on the fork, where it is a new deposit
+	if assert.Len(t, res.Detected, 1) {
+		assert.Equal(t, res.Orphaned[0].TxHash, res.Detected[0].TxHash)
+		assert.NotEqual(t, res.Orphaned[0].BlockHash, res.Detected[0].BlockHash)
+		assert.Equal(t, StatusPending, res.Detected[0].Status)
+	}
+	found, err := store.ByWallet(ix.ChainID, b)
+	assert.NoError(t, err)
+	assert.Equal(t, res.Detected, found)
+}
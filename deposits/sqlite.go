@@ -0,0 +1,271 @@
+package deposits
+
+import (
+	"database/sql"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const depositsSchema = `
+CREATE TABLE IF NOT EXISTS deposits (
+	chain_id     INTEGER NOT NULL,
+	tx_hash      TEXT NOT NULL,
+	log_index    INTEGER NOT NULL,
+	token        TEXT NOT NULL,
+	sender       TEXT NOT NULL,
+	wallet       TEXT NOT NULL,
+	amount       TEXT NOT NULL,
+	block_number INTEGER NOT NULL,
+	block_hash   TEXT NOT NULL,
+	block_time   INTEGER NOT NULL,
+	detected_at  INTEGER NOT NULL,
+	status       TEXT NOT NULL DEFAULT 'pending',
+	swept        INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (chain_id, tx_hash, log_index)
+);
+CREATE INDEX IF NOT EXISTS deposits_wallet ON deposits (chain_id, wallet);
+CREATE TABLE IF NOT EXISTS checkpoints (
+	chain_id INTEGER NOT NULL,
+	number   INTEGER NOT NULL,
+	hash     TEXT NOT NULL,
+	PRIMARY KEY (chain_id, number)
+)`
+
+const depositColumns = `chain_id, tx_hash, log_index, token, sender, wallet, amount, block_number, block_hash, block_time, detected_at, status, swept`
+
+// SQLiteStore keeps a row per transfer log, keyed by chain, transaction and log index,
+// and the last checkpoints of each chain, so indexing resumes where it stopped.
+type SQLiteStore struct {
+	db *sql.DB
+	// OnSave, if set, runs in the transaction of each deposit Add writes, and of each
+	// SetStatus with the deposit in its new status; its error rolls the write back.
+	// webhooks.SQLiteOutbox.DepositSaved queues a deposit's events this way.
+	OnSave func(tx *sql.Tx, d *Deposit) error
+}
+
+// NewSQLiteStore creates the deposit tables in db if they do not exist.
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	if _, err := db.Exec(depositsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Add(d *Deposit) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// a stored log is only replaced if it was orphaned, found again after a reorg
+	res, err := tx.Exec(`INSERT INTO deposits (`+depositColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chain_id, tx_hash, log_index) DO UPDATE SET
+			token = excluded.token, sender = excluded.sender, wallet = excluded.wallet, amount = excluded.amount,
+			block_number = excluded.block_number, block_hash = excluded.block_hash, block_time = excluded.block_time,
+			detected_at = excluded.detected_at, status = excluded.status, swept = excluded.swept
+		WHERE deposits.status = ?`,
+		d.ChainID, d.TxHash.Hex(), d.LogIndex, d.Token.Hex(), d.From.Hex(), d.Wallet.Hex(), d.Amount.String(),
+		d.BlockNumber, d.BlockHash.Hex(), d.BlockTime.Unix(), d.DetectedAt.UnixNano(), d.Status, d.Swept, StatusOrphaned)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := s.saved(tx, d); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *SQLiteStore) ByWallet(chainID uint64, wallet common.Address) ([]*Deposit, error) {
+	return s.query(`SELECT `+depositColumns+` FROM deposits WHERE chain_id = ? AND wallet = ?
+		ORDER BY block_number, log_index`, chainID, wallet.Hex())
+}
+
+func (s *SQLiteStore) Pending(chainID uint64) ([]*Deposit, error) {
+	return s.query(`SELECT `+depositColumns+` FROM deposits WHERE chain_id = ? AND status = ?
+		ORDER BY block_number, log_index`, chainID, StatusPending)
+}
+
+func (s *SQLiteStore) SetStatus(d *Deposit, status Status) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE deposits SET status = ? WHERE chain_id = ? AND tx_hash = ? AND log_index = ?`,
+		status, d.ChainID, d.TxHash.Hex(), d.LogIndex)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDepositNotFound
+	}
+	c := *d
+	c.Status = status
+	if err := s.saved(tx, &c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saved calls OnSave, if set
+func (s *SQLiteStore) saved(tx *sql.Tx, d *Deposit) error {
+	if s.OnSave == nil {
+		return nil
+	}
+	return s.OnSave(tx, d)
+}
+
+func (s *SQLiteStore) Unswept(chainID uint64) ([]*Deposit, error) {
+	return s.query(`SELECT `+depositColumns+` FROM deposits WHERE chain_id = ? AND status = ? AND NOT swept
+		ORDER BY block_number, log_index`, chainID, StatusConfirmed)
+}
+
+func (s *SQLiteStore) SetSwept(d *Deposit) error {
+	res, err := s.db.Exec(`UPDATE deposits SET swept = 1 WHERE chain_id = ? AND tx_hash = ? AND log_index = ?`,
+		d.ChainID, d.TxHash.Hex(), d.LogIndex)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDepositNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) LastBlock(chainID uint64) (Checkpoint, bool, error) {
+	var block Checkpoint
+	var hash string
+	err := s.db.QueryRow(`SELECT number, hash FROM checkpoints WHERE chain_id = ? ORDER BY number DESC LIMIT 1`,
+		chainID).Scan(&block.Number, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+	block.Hash = common.HexToHash(hash)
+	return block, true, nil
+}
+
+func (s *SQLiteStore) SetLastBlock(chainID uint64, block Checkpoint) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO checkpoints (chain_id, number, hash) VALUES (?, ?, ?)`,
+		chainID, block.Number, block.Hash.Hex()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM checkpoints WHERE chain_id = ? AND number NOT IN
+		(SELECT number FROM checkpoints WHERE chain_id = ? ORDER BY number DESC LIMIT ?)`,
+		chainID, chainID, maxCheckpoints); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Checkpoints(chainID uint64) ([]Checkpoint, error) {
+	rows, err := s.db.Query(`SELECT number, hash FROM checkpoints WHERE chain_id = ? ORDER BY number DESC`, chainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		var block Checkpoint
+		var hash string
+		if err := rows.Scan(&block.Number, &hash); err != nil {
+			return nil, err
+		}
+		block.Hash = common.HexToHash(hash)
+		checkpoints = append(checkpoints, block)
+	}
+	return checkpoints, rows.Err()
+}
+
+func (s *SQLiteStore) Rewind(chainID uint64, block uint64) ([]*Deposit, error) {
+	orphaned, err := s.query(`SELECT `+depositColumns+` FROM deposits WHERE chain_id = ? AND block_number > ? AND status != ?
+		ORDER BY block_number, log_index`, chainID, block, StatusOrphaned)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE deposits SET status = ? WHERE chain_id = ? AND block_number > ?`,
+		StatusOrphaned, chainID, block); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM checkpoints WHERE chain_id = ? AND number > ?`, chainID, block); err != nil {
+		return nil, err
+	}
+	// the block itself is still indexed, its hash unknown ('' reads as the zero hash)
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO checkpoints (chain_id, number, hash) VALUES (?, ?, '')`,
+		chainID, block); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, d := range orphaned {
+		d.Status = StatusOrphaned
+	}
+	return orphaned, nil
+}
+
+func (s *SQLiteStore) query(query string, args ...any) ([]*Deposit, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deposits []*Deposit
+	for rows.Next() {
+		d, err := scanDeposit(rows)
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, d)
+	}
+	return deposits, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDeposit(row scanner) (*Deposit, error) {
+	var d Deposit
+	var txHash, token, from, wallet, amount, blockHash, status string
+	var blockTime, detectedAt int64
+	if err := row.Scan(&d.ChainID, &txHash, &d.LogIndex, &token, &from, &wallet, &amount, &d.BlockNumber, &blockHash, &blockTime, &detectedAt, &status, &d.Swept); err != nil {
+		return nil, err
+	}
+	d.TxHash = common.HexToHash(txHash)
+	d.Token = common.HexToAddress(token)
+	d.From = common.HexToAddress(from)
+	d.Wallet = common.HexToAddress(wallet)
+	d.Amount, _ = new(big.Int).SetString(amount, 10)
+	d.BlockHash = common.HexToHash(blockHash)
+	d.BlockTime = time.Unix(blockTime, 0)
+	d.DetectedAt = time.Unix(0, detectedAt)
+	d.Status = Status(status)
+	return &d, nil
+}
@@ -0,0 +1,431 @@
+// Package handler runs one sweep cycle per call, as a scheduled serverless function: load
+// the registry's wallets (or index which were paid), sweep them, persist what was swept
+// and report it. Handler.Handle has the signature serverless Go runtimes (e.g. AWS
+// Lambda's lambda.Start) accept, and Invoke calls it with JSON as they do, without one.
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/registry"
+	"allen-liaoo/payment-reciever/webhooks"
+)
+
+// defaultReserve is used when Handler.Reserve is not set
+const defaultReserve = 10 * time.Second
+
+// Chain is a chain swept by the handler.
+type Chain struct {
+	Sweeper *reciever.Sweeper
+	// Client and Confirmations index the chain's deposits, with Handler.Deposits
+	Client        deposits.Client
+	Confirmations uint64
+}
+
+// Handler sweeps the wallets of a registry on every chain.
+type Handler struct {
+	Chains  []Chain
+	Wallets registry.WalletRegistry
+	// KeyFor returns the private key of a registered middleware wallet.
+	KeyFor func(middleware common.Address) (*ecdsa.PrivateKey, error)
+	// Deposits, if set, indexes Transfer logs so only wallets with confirmed deposits not
+	// yet swept are swept, instead of every active wallet; its chains are indexed by Token.
+	Deposits deposits.Store
+	Invoices *invoices.Manager    // settled from the indexed deposits, if set
+	Webhooks *webhooks.Dispatcher // queues deposit and invoice events and sends them, if set
+	// Requests, if set, queues wallets to sweep on demand, such as from the API; each cycle
+	// sweeps those of its chain along with the others and completes their requests.
+	Requests Requests
+	// Concurrency is the wallets swept at once; defaults to reciever's batch default.
+	Concurrency int
+	// Reserve is kept before the context's deadline to persist the sweeps and report them;
+	// sweeping stops when it is reached. Defaults to 10s.
+	Reserve time.Duration
+}
+
+// Event is what a call asks for; the zero Event, such as a scheduler's, sweeps every chain.
+type Event struct {
+	ChainIDs []uint64 `json:"chainIds,omitempty"` // only these chains
+}
+
+// Outcome is what happened to a wallet in a cycle.
+type Outcome string
+
+const (
+	OutcomeSwept    Outcome = "swept"
+	OutcomeSkipped  Outcome = "skipped"  // nothing to sweep
+	OutcomeDeferred Outcome = "deferred" // not worth its gas now
+	OutcomeFailed   Outcome = "failed"
+)
+
+// Summary reports a cycle.
+type Summary struct {
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	Chains     []ChainSummary `json:"chains"`
+	Webhooks   int            `json:"webhooksSent"`
+	// Incomplete is set when the deadline came before every wallet was swept. Sweeps it
+	// interrupted are journaled, and the next cycle finishes them.
+	Incomplete bool `json:"incomplete"`
+}
+
+type ChainSummary struct {
+	ChainID   uint64          `json:"chainId"`
+	Detected  int             `json:"depositsDetected"`
+	Confirmed int             `json:"depositsConfirmed"`
+	Orphaned  int             `json:"depositsOrphaned"`
+	Invoices  int             `json:"invoicesUpdated"`
+	Flagged   int             `json:"sweepsFlagged"` // of deposits a reorg took back
+	Resumed   int             `json:"sweepsResumed"` // left half done by an earlier cycle
+	Wallets   []WalletSummary `json:"wallets"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type WalletSummary struct {
+	Address common.Address `json:"address"`
+	Outcome Outcome        `json:"outcome"`
+	Txs     []common.Hash  `json:"txs,omitempty"` // token transfers to the destination
+	Error   string         `json:"error,omitempty"`
+}
+
+// Handle runs a cycle, stopping Reserve before the context's deadline. Wallets failing to
+// sweep are reported in the summary; chains failing (e.g. an unreachable node) are also
+// returned as an error, so the runtime can retry the call.
+func (h *Handler) Handle(ctx context.Context, event Event) (*Summary, error) {
+	summary := &Summary{StartedAt: time.Now(), Chains: []ChainSummary{}}
+	sweepCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		reserve := h.Reserve
+		if reserve <= 0 {
+			reserve = defaultReserve
+		}
+		var cancel context.CancelFunc
+		sweepCtx, cancel = context.WithDeadline(ctx, deadline.Add(-reserve))
+		defer cancel()
+	}
+
+	var errs []error
+	for _, chain := range h.Chains {
+		chainID, err := chain.Sweeper.ChainID(sweepCtx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(event.ChainIDs) > 0 && !slices.Contains(event.ChainIDs, chainID) {
+			continue
+		}
+		cs := ChainSummary{ChainID: chainID, Wallets: []WalletSummary{}}
+		if err := h.sweepChain(sweepCtx, chain, &cs); err != nil {
+			cs.Error = err.Error()
+			errs = append(errs, fmt.Errorf("chain %d: %w", chainID, err))
+		}
+		summary.Chains = append(summary.Chains, cs)
+	}
+	summary.Incomplete = sweepCtx.Err() != nil
+
+	if h.Webhooks != nil {
+		// sends what this cycle queued, and what earlier ones could not deliver
+		delivered, err := h.Webhooks.Dispatch(ctx)
+		if err != nil {
+			log.Printf("sending webhooks: %v", err)
+		}
+		summary.Webhooks = delivered
+	}
+	summary.FinishedAt = time.Now()
+	return summary, errors.Join(errs...)
+}
+
+// sweepChain finishes the sweeps an earlier cycle left half done, then sweeps the wallets
+// with unswept confirmed deposits, or every active wallet without indexing, and those
+// requested
+func (h *Handler) sweepChain(ctx context.Context, chain Chain, cs *ChainSummary) error {
+	resumed, err := chain.Sweeper.Resume(ctx, h.KeyFor)
+	cs.Resumed = len(resumed)
+	if err != nil {
+		log.Printf("chain %d: resuming sweeps: %v", cs.ChainID, err)
+	}
+	if err := h.recordSwept(resumed); err != nil {
+		return err
+	}
+
+	var targets []*registry.Wallet
+	if h.Deposits != nil {
+		targets, err = h.depositedWallets(ctx, chain, cs)
+	} else {
+		targets, err = h.Wallets.Active()
+	}
+	if err != nil {
+		return err
+	}
+
+	requests, err := h.requested(cs, &targets)
+	if err != nil {
+		return err
+	}
+
+	var batch []reciever.BatchWallet
+	for _, w := range targets {
+		privateKey, err := h.KeyFor(w.Address)
+		if err != nil {
+			cs.Wallets = append(cs.Wallets, WalletSummary{Address: w.Address, Outcome: OutcomeFailed, Error: err.Error()})
+			continue
+		}
+		batch = append(batch, reciever.BatchWallet{Account: &accounts.Account{Address: w.Address}, PrivateKey: privateKey})
+	}
+	if len(batch) > 0 {
+		if err := h.sweepBatch(ctx, chain, cs, batch); err != nil {
+			return err
+		}
+	}
+	return h.finishRequests(requests, cs.Wallets)
+}
+
+// sweepBatch sweeps the wallets of batch and waits for their token transfers
+func (h *Handler) sweepBatch(ctx context.Context, chain Chain, cs *ChainSummary, batch []reciever.BatchWallet) error {
+	results := chain.Sweeper.SweepBatch(ctx, batch, reciever.BatchOptions{
+		MinBalance:  big.NewInt(1),
+		Concurrency: h.Concurrency,
+	})
+	var empty []common.Address
+	for _, r := range results {
+		ws := WalletSummary{Address: r.Address}
+		switch {
+		case r.Err != nil:
+			ws.Outcome, ws.Error = OutcomeFailed, r.Err.Error()
+			log.Printf("chain %d wallet %s: %v", cs.ChainID, r.Address.Hex(), r.Err)
+		case r.Skipped:
+			ws.Outcome = OutcomeSkipped
+			empty = append(empty, r.Address)
+		case r.Deferred:
+			ws.Outcome = OutcomeDeferred
+		default:
+			ws.Outcome = OutcomeSwept
+		}
+		for _, result := range r.Results {
+			if result.Deferred == nil && result.MiddlewareToDestinationTx != nil {
+				ws.Txs = append(ws.Txs, result.MiddlewareToDestinationTx.Hash())
+			}
+		}
+		cs.Wallets = append(cs.Wallets, ws)
+	}
+
+	// wait for the token transfers just sent; those not mined by the deadline are confirmed
+	// by the next cycle
+	confirmed, err := chain.Sweeper.Resume(ctx, h.KeyFor)
+	if err != nil {
+		log.Printf("chain %d: confirming sweeps: %v", cs.ChainID, err)
+	}
+	if err := h.recordSwept(confirmed); err != nil {
+		return err
+	}
+	if h.Deposits != nil {
+		if _, err := h.unswept(ctx, chain, cs.ChainID, empty); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requested adds the wallets of the chain's queued sweep requests to targets, and returns
+// the requests. Requested wallets no longer registered fail.
+func (h *Handler) requested(cs *ChainSummary, targets *[]*registry.Wallet) ([]*SweepRequest, error) {
+	if h.Requests == nil {
+		return nil, nil
+	}
+	requests, err := h.Requests.Queued(cs.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range requests {
+		if slices.ContainsFunc(*targets, func(w *registry.Wallet) bool { return w.Address == req.Wallet }) {
+			continue
+		}
+		w, err := h.Wallets.Get(req.Wallet)
+		if errors.Is(err, registry.ErrWalletNotFound) {
+			cs.Wallets = append(cs.Wallets, WalletSummary{Address: req.Wallet, Outcome: OutcomeFailed, Error: err.Error()})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		*targets = append(*targets, w)
+	}
+	return requests, nil
+}
+
+// finishRequests completes each request with its wallet's outcome in the cycle
+func (h *Handler) finishRequests(requests []*SweepRequest, wallets []WalletSummary) error {
+	for _, req := range requests {
+		i := slices.IndexFunc(wallets, func(ws WalletSummary) bool { return ws.Address == req.Wallet })
+		if i < 0 {
+			continue
+		}
+		ws := wallets[i]
+		req.Status, req.Outcome, req.Txs, req.Error = RequestDone, ws.Outcome, ws.Txs, ws.Error
+		if ws.Outcome == OutcomeFailed {
+			req.Status = RequestFailed
+		}
+		req.UpdatedAt = time.Now()
+		if err := h.Requests.Save(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordSwept sets the last swept block of the wallets of confirmed sweeps, to the block
+// their token transfer was mined in. The registry keeps one block per wallet, which names
+// no block once several chains are swept, so nothing is recorded then.
+func (h *Handler) recordSwept(recs []*reciever.SweepRecord) error {
+	if len(h.Chains) != 1 {
+		return nil
+	}
+	blocks := make(map[common.Address]uint64)
+	for _, rec := range recs {
+		if rec.State == reciever.StateConfirmed {
+			blocks[rec.Middleware] = max(blocks[rec.Middleware], rec.Block)
+		}
+	}
+	for address, block := range blocks {
+		if err := h.Wallets.SetLastSweptBlock(address, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// depositedWallets indexes the Transfer logs of the chain's tokens since the last cycle
+// and returns the registered wallets with confirmed deposits not yet swept, including
+// those an earlier cycle failed, deferred or ran out of time to sweep. The invoices of
+// wallets with changed deposits are settled again, and sweeps of deposits a reorg took
+// back are flagged in the journal.
+func (h *Handler) depositedWallets(ctx context.Context, chain Chain, cs *ChainSummary) ([]*registry.Wallet, error) {
+	var tokens []common.Address
+	for _, token := range chain.Sweeper.Tokens() {
+		tokens = append(tokens, token.Address)
+	}
+	indexer := &deposits.Indexer{
+		Client:        chain.Client,
+		ChainID:       cs.ChainID,
+		Tokens:        tokens,
+		Wallets:       h.Wallets,
+		Store:         h.Deposits,
+		Confirmations: chain.Confirmations,
+	}
+	res, err := indexer.Poll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cs.Detected, cs.Confirmed, cs.Orphaned = len(res.Detected), len(res.Confirmed), len(res.Orphaned)
+	// stores hooked to a SQLite outbox (see webhooks.SQLiteOutbox.DepositSaved) queued these
+	// events with their writes, and queue them once; for other stores a crash since Poll
+	// loses them
+	var events *webhooks.Recorder
+	if h.Webhooks != nil {
+		events = &webhooks.Recorder{Outbox: h.Webhooks.Outbox}
+		if err := events.Deposits(res); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range res.Orphaned {
+		log.Printf("chain %d wallet %s: deposit tx %s reorged out of block %d", d.ChainID, d.Wallet.Hex(), d.TxHash.Hex(), d.BlockNumber)
+		reason := fmt.Sprintf("deposit tx %s reorged out of block %d", d.TxHash.Hex(), d.BlockNumber)
+		flagged, err := chain.Sweeper.FlagSweeps(ctx, d.Wallet, d.Token, d.DetectedAt, reason)
+		if err != nil {
+			return nil, err
+		}
+		cs.Flagged += len(flagged)
+	}
+
+	if h.Invoices != nil {
+		changed := append(append(append([]*deposits.Deposit(nil), res.Detected...), res.Confirmed...), res.Orphaned...)
+		updated, err := h.Invoices.Update(changed)
+		cs.Invoices = len(updated)
+		if err != nil {
+			return nil, err
+		}
+		// a hooked store (see webhooks.SQLiteOutbox.InvoiceSaved) queued these, and also
+		// those of changes saved elsewhere, such as by the API's Refresh
+		if events != nil {
+			if err := events.Invoices(updated); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	unswept, err := h.unswept(ctx, chain, cs.ChainID, nil)
+	if err != nil {
+		return nil, err
+	}
+	var deposited []*registry.Wallet
+	for _, address := range deposits.Wallets(unswept) {
+		w, err := h.Wallets.Get(address)
+		if err != nil {
+			return nil, err
+		}
+		deposited = append(deposited, w)
+	}
+	return deposited, nil
+}
+
+// unswept returns the chain's confirmed deposits still to be swept, and marks the others
+// swept: those moved by a confirmed sweep of their token planned after they were detected,
+// and those of wallets found with nothing to sweep
+func (h *Handler) unswept(ctx context.Context, chain Chain, chainID uint64, empty []common.Address) ([]*deposits.Deposit, error) {
+	found, err := h.Deposits.Unswept(chainID)
+	if err != nil {
+		return nil, err
+	}
+	sweeps := make(map[common.Address][]*reciever.SweepRecord)
+	var unswept []*deposits.Deposit
+	for _, d := range found {
+		recs, ok := sweeps[d.Wallet]
+		if !ok {
+			if recs, err = chain.Sweeper.Sweeps(ctx, d.Wallet); err != nil {
+				return nil, err
+			}
+			sweeps[d.Wallet] = recs
+		}
+		swept := slices.ContainsFunc(recs, func(rec *reciever.SweepRecord) bool {
+			return rec.Token == d.Token && rec.State == reciever.StateConfirmed && !rec.CreatedAt.Before(d.DetectedAt)
+		})
+		if !swept && !slices.Contains(empty, d.Wallet) {
+			unswept = append(unswept, d)
+			continue
+		}
+		if err := h.Deposits.SetSwept(d); err != nil {
+			return nil, err
+		}
+	}
+	return unswept, nil
+}
+
+// Invoke calls the handler with a JSON event, as a serverless runtime does, and returns
+// the JSON summary along with the handler's error. An empty payload is the zero Event.
+func Invoke(ctx context.Context, h *Handler, payload []byte) ([]byte, error) {
+	var event Event
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("invalid event: %w", err)
+		}
+	}
+	summary, err := h.Handle(ctx, event)
+	out, jsonErr := json.Marshal(summary)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	return out, err
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/registry"
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/webhooks"
+)
+
+var destination = common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+
+// newTestHandler returns a handler over a simulated chain, with the active wallets of
+// hardhat indices 26 and 27 registered
+func newTestHandler(t *testing.T) (*Handler, *simchain.Chain, []common.Address) {
+	chain := simchain.New(t)
+	sweeper, err := reciever.NewSweeper(reciever.Config{
+		Client:       chain.Client,
+		ChainID:      simchain.ChainID.Uint64(),
+		TokenAddress: chain.Token,
+		ProviderKey:  chain.FundedKey(t, big.NewInt(1e18)),
+		Destination:  destination,
+	})
+	assert.NoError(t, err)
+
+	wallets := registry.NewMemoryRegistry()
+	keys := map[common.Address]*ecdsa.PrivateKey{}
+	var addresses []common.Address
+	for _, index := range []uint32{26, 27} {
+		account, privateKey := simchain.Wallet(t, index)
+		assert.NoError(t, wallets.Add(&registry.Wallet{Index: index, Address: account.Address, Status: registry.StatusActive}))
+		keys[account.Address] = privateKey
+		addresses = append(addresses, account.Address)
+	}
+	h := &Handler{
+		Chains:  []Chain{{Sweeper: sweeper, Client: chain.Client}},
+		Wallets: wallets,
+		KeyFor: func(middleware common.Address) (*ecdsa.PrivateKey, error) {
+			return keys[middleware], nil
+		},
+	}
+	return h, chain, addresses
+}
+
+func TestHandle(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	chain.SendToken(t, chain.Token, wallets[0], big.NewInt(20))
+
+	summary, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.False(t, summary.Incomplete)
+	if assert.Len(t, summary.Chains, 1) && assert.Len(t, summary.Chains[0].Wallets, 2) {
+		swept, empty := summary.Chains[0].Wallets[0], summary.Chains[0].Wallets[1]
+		assert.Equal(t, wallets[0], swept.Address)
+		assert.Equal(t, OutcomeSwept, swept.Outcome)
+		assert.Len(t, swept.Txs, 1)
+		assert.Equal(t, OutcomeSkipped, empty.Outcome)
+	}
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, destination).Int64())
+	w, err := h.Wallets.Get(wallets[0])
+	assert.NoError(t, err)
+	assert.NotZero(t, w.LastSweptBlock)
+
+	// other chains are not swept
+	summary, err = h.Handle(context.Background(), Event{ChainIDs: []uint64{1}})
+	assert.NoError(t, err)
+	assert.Empty(t, summary.Chains)
+}
+
+func TestHandleIndexed(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer srv.Close()
+	h.Deposits = deposits.NewMemoryStore()
+	h.Invoices = &invoices.Manager{Store: invoices.NewMemoryStore(), Deposits: h.Deposits}
+	h.Webhooks = &webhooks.Dispatcher{Outbox: webhooks.NewMemoryOutbox(), URL: srv.URL, Secret: []byte("shh")}
+	err := h.Invoices.Store.Create(&invoices.Invoice{ID: "order-1", ChainID: simchain.ChainID.Uint64(), Wallet: wallets[1],
+		Token: chain.Token, Amount: big.NewInt(30), Status: invoices.StatusUnpaid, CreatedAt: time.Now()})
+	assert.NoError(t, err)
+
+	// the first cycle starts indexing at the current block
+	summary, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.Empty(t, summary.Chains[0].Wallets)
+
+	chain.SendToken(t, chain.Token, wallets[1], big.NewInt(30))
+	out, err := Invoke(context.Background(), h, []byte(`{"chainIds": [1337]}`))
+	assert.NoError(t, err)
+	var got Summary
+	assert.NoError(t, json.Unmarshal(out, &got))
+	if assert.Len(t, got.Chains, 1) {
+		cs := got.Chains[0]
+		assert.Equal(t, 1, cs.Detected)
+		assert.Equal(t, 1, cs.Confirmed)
+		assert.Equal(t, 1, cs.Invoices)
+		if assert.Len(t, cs.Wallets, 1) {
+			assert.Equal(t, wallets[1], cs.Wallets[0].Address)
+			assert.Equal(t, OutcomeSwept, cs.Wallets[0].Outcome)
+		}
+	}
+	// deposit.detected, deposit.confirmed and invoice.paid
+	assert.Equal(t, 3, got.Webhooks)
+	assert.Equal(t, int32(3), received.Load())
+	inv, err := h.Invoices.Store.Get("order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, invoices.StatusPaid, inv.Status)
+
+	_, err = Invoke(context.Background(), h, []byte(`chains please`))
+	assert.Error(t, err)
+}
+
+// A wallet whose sweep failed is swept by a later cycle, though no new deposit came
+func TestHandleRetry(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	h.Deposits = deposits.NewMemoryStore()
+	keyFor := h.KeyFor
+	var keysDown atomic.Bool
+	h.KeyFor = func(middleware common.Address) (*ecdsa.PrivateKey, error) {
+		if keysDown.Load() {
+			return nil, errors.New("key vault down")
+		}
+		return keyFor(middleware)
+	}
+	_, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+
+	chain.SendToken(t, chain.Token, wallets[0], big.NewInt(20))
+	keysDown.Store(true)
+	summary, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Chains[0].Confirmed)
+	if assert.Len(t, summary.Chains[0].Wallets, 1) {
+		assert.Equal(t, OutcomeFailed, summary.Chains[0].Wallets[0].Outcome)
+	}
+
+	keysDown.Store(false)
+	summary, err = h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.Zero(t, summary.Chains[0].Detected)
+	if assert.Len(t, summary.Chains[0].Wallets, 1) {
+		assert.Equal(t, wallets[0], summary.Chains[0].Wallets[0].Address)
+		assert.Equal(t, OutcomeSwept, summary.Chains[0].Wallets[0].Outcome)
+	}
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, destination).Int64())
+
+	// swept deposits are not swept again
+	summary, err = h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.Empty(t, summary.Chains[0].Wallets)
+}
+
+// A wallet paying its own gas records the block of its token transfer as swept
+func TestHandleLastSweptBlock(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	chain.SendToken(t, chain.Token, wallets[0], big.NewInt(20))
+	chain.SendETH(t, wallets[0], big.NewInt(1e16))
+
+	summary, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	swept := summary.Chains[0].Wallets[0]
+	assert.Equal(t, OutcomeSwept, swept.Outcome)
+	if assert.Len(t, swept.Txs, 1) {
+		receipt, err := chain.Client.TransactionReceipt(context.Background(), swept.Txs[0])
+		assert.NoError(t, err)
+		w, err := h.Wallets.Get(wallets[0])
+		assert.NoError(t, err)
+		assert.Equal(t, receipt.BlockNumber.Uint64(), w.LastSweptBlock)
+	}
+}
+
+// With several chains a block number is ambiguous, so none is recorded
+func TestHandleLastSweptBlockMultiChain(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	other := simchain.New(t)
+	sweeper, err := reciever.NewSweeper(reciever.Config{
+		Client:       other.Client,
+		ChainID:      simchain.ChainID.Uint64(),
+		TokenAddress: other.Token,
+		ProviderKey:  other.FunderKey,
+		Destination:  destination,
+	})
+	assert.NoError(t, err)
+	h.Chains = append(h.Chains, Chain{Sweeper: sweeper, Client: other.Client})
+	chain.SendToken(t, chain.Token, wallets[0], big.NewInt(20))
+	chain.SendETH(t, wallets[0], big.NewInt(1e16))
+
+	summary, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	if assert.Len(t, summary.Chains, 2) {
+		assert.Equal(t, OutcomeSwept, summary.Chains[0].Wallets[0].Outcome)
+	}
+	w, err := h.Wallets.Get(wallets[0])
+	assert.NoError(t, err)
+	assert.Zero(t, w.LastSweptBlock)
+}
+
+func TestHandleDeadline(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	chain.SendToken(t, chain.Token, wallets[0], big.NewInt(20))
+
+	// no time left besides the reserve
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	h.Reserve = time.Minute
+	summary, err := h.Handle(ctx, Event{})
+	assert.NoError(t, err, "wallets failing are not the call failing")
+	assert.True(t, summary.Incomplete)
+	for _, w := range summary.Chains[0].Wallets {
+		assert.Equal(t, OutcomeFailed, w.Outcome)
+	}
+	assert.Zero(t, chain.TokenBalance(t, chain.Token, destination).Int64())
+
+	// the next cycle sweeps them
+	h.Reserve = 0
+	summary, err = h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.False(t, summary.Incomplete)
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, destination).Int64())
+}
+
+// Requested wallets are swept along with the deposited ones, and their requests completed
+func TestHandleRequests(t *testing.T) {
+	h, chain, wallets := newTestHandler(t)
+	h.Deposits = deposits.NewMemoryStore()
+	h.Requests = NewMemoryRequests()
+	// paid before the block indexing starts at, so only a request sweeps it
+	chain.SendToken(t, chain.Token, wallets[0], big.NewInt(20))
+	chain.SendETH(t, destination, big.NewInt(1))
+	summary, err := h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.Empty(t, summary.Chains[0].Wallets)
+
+	chainID := simchain.ChainID.Uint64()
+	var requests []*SweepRequest
+	for _, wallet := range append(wallets, common.HexToAddress("0x01")) {
+		req, err := NewSweepRequest(chainID, wallet)
+		assert.NoError(t, err)
+		assert.NoError(t, h.Requests.Add(req))
+		requests = append(requests, req)
+	}
+	summary, err = h.Handle(context.Background(), Event{})
+	assert.NoError(t, err)
+	assert.Len(t, summary.Chains[0].Wallets, 3)
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, destination).Int64())
+
+	swept, err := h.Requests.Get(requests[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, RequestDone, swept.Status)
+	assert.Equal(t, OutcomeSwept, swept.Outcome)
+	assert.Len(t, swept.Txs, 1)
+	empty, err := h.Requests.Get(requests[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, RequestDone, empty.Status)
+	assert.Equal(t, OutcomeSkipped, empty.Outcome)
+	unregistered, err := h.Requests.Get(requests[2].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, RequestFailed, unregistered.Status)
+	assert.NotEmpty(t, unregistered.Error)
+
+	queued, err := h.Requests.Queued(chainID)
+	assert.NoError(t, err)
+	assert.Empty(t, queued)
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// RequestStatus is how far a sweep request got.
+type RequestStatus string
+
+const (
+	RequestQueued RequestStatus = "queued" // waiting for, or in, a cycle of its chain
+	RequestDone   RequestStatus = "done"   // a cycle swept the wallet, or found nothing to sweep; see Outcome
+	RequestFailed RequestStatus = "failed" // a cycle failed to sweep the wallet; see Error
+)
+
+// SweepRequest asks for a wallet to be swept by the next cycle of its chain, such as on
+// behalf of the API, which holds no keys: a cycle is the only place a wallet is swept, so
+// two processes never sweep it, or spend the provider wallet's nonces, at once.
+type SweepRequest struct {
+	ID        string         `json:"id"`
+	ChainID   uint64         `json:"chainId"`
+	Wallet    common.Address `json:"wallet"`
+	Status    RequestStatus  `json:"status"`
+	Outcome   Outcome        `json:"outcome,omitempty"` // of the wallet in the cycle that took the request
+	Txs       []common.Hash  `json:"txs,omitempty"`     // token transfers to the destination
+	Error     string         `json:"error,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// NewSweepRequest returns a queued request, with a random ID, to sweep wallet on a chain.
+func NewSweepRequest(chainID uint64, wallet common.Address) (*SweepRequest, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &SweepRequest{ID: hex.EncodeToString(id), ChainID: chainID, Wallet: wallet, Status: RequestQueued, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+// Requests queues sweep requests.
+type Requests interface {
+	// Add queues a request, failing with ErrSweepRequested if one of the same wallet and
+	// chain is still queued.
+	Add(req *SweepRequest) error
+	Get(id string) (*SweepRequest, error)
+	// Queued returns the queued requests of a chain, oldest first.
+	Queued(chainID uint64) ([]*SweepRequest, error)
+	// Save replaces a stored request.
+	Save(req *SweepRequest) error
+}
+
+var (
+	ErrSweepRequested  = errors.New("a sweep of the wallet is already requested")
+	ErrRequestNotFound = errors.New("sweep request not found")
+)
+
+// MemoryRequests keeps requests in a map, for a requester in the same process as the
+// handler taking them.
+type MemoryRequests struct {
+	mu       sync.Mutex
+	requests map[string]*SweepRequest
+}
+
+func NewMemoryRequests() *MemoryRequests {
+	return &MemoryRequests{requests: make(map[string]*SweepRequest)}
+}
+
+func (q *MemoryRequests) Add(req *SweepRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, queued := range q.requests {
+		if queued.Status == RequestQueued && queued.ChainID == req.ChainID && queued.Wallet == req.Wallet {
+			return ErrSweepRequested
+		}
+	}
+	q.requests[req.ID] = copyRequest(req)
+	return nil
+}
+
+func (q *MemoryRequests) Get(id string) (*SweepRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	req, ok := q.requests[id]
+	if !ok {
+		return nil, ErrRequestNotFound
+	}
+	return copyRequest(req), nil
+}
+
+func (q *MemoryRequests) Queued(chainID uint64) ([]*SweepRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var queued []*SweepRequest
+	for _, req := range q.requests {
+		if req.Status == RequestQueued && req.ChainID == chainID {
+			queued = append(queued, copyRequest(req))
+		}
+	}
+	sort.Slice(queued, func(a, b int) bool { return queued[a].CreatedAt.Before(queued[b].CreatedAt) })
+	return queued, nil
+}
+
+func (q *MemoryRequests) Save(req *SweepRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.requests[req.ID]; !ok {
+		return ErrRequestNotFound
+	}
+	q.requests[req.ID] = copyRequest(req)
+	return nil
+}
+
+func copyRequest(req *SweepRequest) *SweepRequest {
+	c := *req
+	c.Txs = append([]common.Hash(nil), req.Txs...)
+	return &c
+}
+
+// a wallet has one queued request per chain at a time
+const requestsSchema = `
+CREATE TABLE IF NOT EXISTS sweep_requests (
+	id         TEXT PRIMARY KEY,
+	chain_id   INTEGER NOT NULL,
+	wallet     TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	request    TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS sweep_requests_queued ON sweep_requests (chain_id, wallet) WHERE status = 'queued'`
+
+// SQLiteRequests keeps a row per request, with at most one queued per wallet and chain, so
+// the API can queue requests for a sweeping process sharing its database.
+type SQLiteRequests struct {
+	db *sql.DB
+}
+
+// NewSQLiteRequests creates the requests table in db if it does not exist.
+func NewSQLiteRequests(db *sql.DB) (*SQLiteRequests, error) {
+	if _, err := db.Exec(requestsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteRequests{db: db}, nil
+}
+
+func (q *SQLiteRequests) Add(req *SweepRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec(`INSERT INTO sweep_requests (id, chain_id, wallet, status, created_at, request) VALUES (?, ?, ?, ?, ?, ?)`,
+		req.ID, req.ChainID, req.Wallet.Hex(), req.Status, req.CreatedAt.UnixNano(), string(data))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: sweep_requests.chain_id") {
+		return ErrSweepRequested
+	}
+	return err
+}
+
+func (q *SQLiteRequests) Get(id string) (*SweepRequest, error) {
+	var data string
+	err := q.db.QueryRow(`SELECT request FROM sweep_requests WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRequestNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeRequest(data)
+}
+
+func (q *SQLiteRequests) Queued(chainID uint64) ([]*SweepRequest, error) {
+	rows, err := q.db.Query(`SELECT request FROM sweep_requests WHERE chain_id = ? AND status = ? ORDER BY created_at`,
+		chainID, RequestQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queued []*SweepRequest
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		req, err := decodeRequest(data)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, req)
+	}
+	return queued, rows.Err()
+}
+
+func (q *SQLiteRequests) Save(req *SweepRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := q.db.Exec(`UPDATE sweep_requests SET status = ?, request = ? WHERE id = ?`, req.Status, string(data), req.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrRequestNotFound
+	}
+	return nil
+}
+
+func decodeRequest(data string) (*SweepRequest, error) {
+	var req SweepRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
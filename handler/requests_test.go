@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/testdb"
+)
+
+func TestRequests(t *testing.T) {
+	sqlite, err := NewSQLiteRequests(testdb.Open(t))
+	assert.NoError(t, err)
+
+	for name, q := range map[string]Requests{"memory": NewMemoryRequests(), "sqlite": sqlite} {
+		t.Run(name, func(t *testing.T) {
+			wallet := common.HexToAddress("0x01")
+			first, err := NewSweepRequest(1, wallet)
+			assert.NoError(t, err)
+			assert.NoError(t, q.Add(first))
+			again, err := NewSweepRequest(1, wallet)
+			assert.NoError(t, err)
+			assert.ErrorIs(t, q.Add(again), ErrSweepRequested)
+			other, err := NewSweepRequest(8453, wallet)
+			assert.NoError(t, err)
+			assert.NoError(t, q.Add(other), "one queued request per chain")
+
+			queued, err := q.Queued(1)
+			assert.NoError(t, err)
+			if assert.Len(t, queued, 1) {
+				assert.Equal(t, first.ID, queued[0].ID)
+			}
+
+			first.Status, first.Outcome, first.Txs = RequestDone, OutcomeSwept, []common.Hash{{1}}
+			first.UpdatedAt = time.Now()
+			assert.NoError(t, q.Save(first))
+			got, err := q.Get(first.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, RequestDone, got.Status)
+			assert.Equal(t, first.Txs, got.Txs)
+			queued, err = q.Queued(1)
+			assert.NoError(t, err)
+			assert.Empty(t, queued)
+			assert.NoError(t, q.Add(again), "the wallet can be requested again once done")
+
+			_, err = q.Get("missing")
+			assert.ErrorIs(t, err, ErrRequestNotFound)
+			assert.ErrorIs(t, q.Save(&SweepRequest{ID: "missing"}), ErrRequestNotFound)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Package invoices tracks what customers are asked to pay into their middleware wallets,
+// and how much of it detected deposits paid.
+package invoices
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Status is how much of an invoice is paid, counting confirmed deposits.
+type Status string
+
+const (
+	StatusUnpaid        Status = "unpaid"
+	StatusPartiallyPaid Status = "partially-paid"
+	StatusPaid          Status = "paid"     // exactly the amount
+	StatusOverpaid      Status = "overpaid" // more than the amount
+	StatusExpired       Status = "expired"  // not fully paid before its expiry
+)
+
+// Settled reports whether the invoice is paid in full or expired, so only a new deposit
+// or a reorg changes its status.
+func (st Status) Settled() bool {
+	return st == StatusPaid || st == StatusOverpaid || st == StatusExpired
+}
+
+// Invoice asks for Amount of Token into a middleware wallet on a chain.
+type Invoice struct {
+	ID        string
+	ChainID   uint64
+	Wallet    common.Address // the middleware wallet it is paid into, one invoice per wallet
+	Token     common.Address
+	Amount    *big.Int // expected, in the token's smallest unit
+	Customer  string
+	Metadata  map[string]string // the checkout's own data, returned as is
+	ExpiresAt time.Time
+
+	Status  Status
+	Paid    *big.Int // confirmed deposits detected before expiry
+	Pending *big.Int // deposits waiting for confirmations
+	PaidAt  time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Store persists invoices.
+type Store interface {
+	// Create stores a new invoice. Its ID and wallet must both be unused.
+	Create(inv *Invoice) error
+	Get(id string) (*Invoice, error)
+	ByWallet(wallet common.Address) (*Invoice, error)
+	// Save replaces the stored invoice with the same ID.
+	Save(inv *Invoice) error
+	// Open returns the invoices that are not settled, oldest first.
+	Open() ([]*Invoice, error)
+}
+
+var (
+	ErrInvoiceNotFound = errors.New("invoice not found")
+	ErrInvoiceExists   = errors.New("invoice ID or wallet already used")
+	ErrInvalidInvoice  = errors.New("invalid invoice")
+)
+
+// MemoryStore keeps invoices in a map, for a Manager whose invoices need not outlive its
+// process.
+type MemoryStore struct {
+	mu       sync.Mutex
+	invoices map[string]*Invoice
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{invoices: make(map[string]*Invoice)}
+}
+
+func (s *MemoryStore) Create(inv *Invoice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.invoices {
+		if existing.ID == inv.ID || existing.Wallet == inv.Wallet {
+			return ErrInvoiceExists
+		}
+	}
+	s.invoices[inv.ID] = copyInvoice(inv)
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invoices[id]
+	if !ok {
+		return nil, ErrInvoiceNotFound
+	}
+	return copyInvoice(inv), nil
+}
+
+func (s *MemoryStore) ByWallet(wallet common.Address) (*Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, inv := range s.invoices {
+		if inv.Wallet == wallet {
+			return copyInvoice(inv), nil
+		}
+	}
+	return nil, ErrInvoiceNotFound
+}
+
+func (s *MemoryStore) Save(inv *Invoice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.invoices[inv.ID]; !ok {
+		return ErrInvoiceNotFound
+	}
+	s.invoices[inv.ID] = copyInvoice(inv)
+	return nil
+}
+
+func (s *MemoryStore) Open() ([]*Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var open []*Invoice
+	for _, inv := range s.invoices {
+		if !inv.Status.Settled() {
+			open = append(open, copyInvoice(inv))
+		}
+	}
+	sort.Slice(open, func(a, b int) bool {
+		return open[a].CreatedAt.Before(open[b].CreatedAt)
+	})
+	return open, nil
+}
+
+// copyInvoice copies an invoice so callers cannot modify what a store holds.
+// Big ints are never mutated in place, so they are shared.
+func copyInvoice(inv *Invoice) *Invoice {
+	c := *inv
+	if inv.Metadata != nil {
+		c.Metadata = make(map[string]string, len(inv.Metadata))
+		for k, v := range inv.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return &c
+}
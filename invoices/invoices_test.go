@@ -0,0 +1,77 @@
+package invoices
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/testdb"
+)
+
+// stores returns every Store implementation, empty
+func stores(t *testing.T) map[string]Store {
+	sqlite, err := NewSQLiteStore(testdb.Open(t))
+	assert.NoError(t, err)
+
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestStore(t *testing.T) {
+	invoice := func(id string, wallet string, created int64) *Invoice {
+		return &Invoice{
+			ID:        id,
+			ChainID:   1,
+			Wallet:    common.HexToAddress(wallet),
+			Token:     common.HexToAddress("0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238"),
+			Amount:    big.NewInt(20),
+			Customer:  "alice",
+			Metadata:  map[string]string{"order": id},
+			ExpiresAt: time.Unix(1700003600, 0),
+			Status:    StatusUnpaid,
+			Paid:      big.NewInt(0),
+			Pending:   big.NewInt(0),
+			CreatedAt: time.Unix(created, 0),
+			UpdatedAt: time.Unix(created, 0),
+		}
+	}
+
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, store.Create(invoice("b", "0x02", 1700000002)))
+			assert.NoError(t, store.Create(invoice("a", "0x01", 1700000001)))
+			assert.ErrorIs(t, store.Create(invoice("a", "0x03", 1700000003)), ErrInvoiceExists)
+			assert.ErrorIs(t, store.Create(invoice("c", "0x01", 1700000003)), ErrInvoiceExists)
+
+			got, err := store.Get("a")
+			assert.NoError(t, err)
+			assert.Equal(t, invoice("a", "0x01", 1700000001), got)
+			got, err = store.ByWallet(common.HexToAddress("0x02"))
+			assert.NoError(t, err)
+			assert.Equal(t, "b", got.ID)
+			_, err = store.Get("c")
+			assert.ErrorIs(t, err, ErrInvoiceNotFound)
+			_, err = store.ByWallet(common.HexToAddress("0x03"))
+			assert.ErrorIs(t, err, ErrInvoiceNotFound)
+
+			paid := invoice("b", "0x02", 1700000002)
+			paid.Status, paid.Paid, paid.PaidAt = StatusPaid, big.NewInt(20), time.Unix(1700000100, 0)
+			assert.NoError(t, store.Save(paid))
+			got, err = store.Get("b")
+			assert.NoError(t, err)
+			assert.Equal(t, paid, got)
+			assert.ErrorIs(t, store.Save(invoice("c", "0x03", 1700000003)), ErrInvoiceNotFound)
+
+			open, err := store.Open()
+			assert.NoError(t, err)
+			if assert.Len(t, open, 1) {
+				assert.Equal(t, "a", open[0].ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package invoices
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/registry"
+)
+
+// Manager opens invoices on newly allocated middleware wallets and settles them from the
+// deposits indexed into those wallets.
+type Manager struct {
+	Store    Store
+	Deposits deposits.Store
+	Wallets  *registry.Allocator // hands out the wallets of new invoices; only Create needs it
+}
+
+// Create allocates a middleware wallet for inv and stores it unpaid. An empty ID is
+// filled with a random one; ChainID, Token and a positive Amount are required.
+func (m *Manager) Create(inv *Invoice) (*Invoice, error) {
+	if inv.ChainID == 0 || inv.Token == (common.Address{}) {
+		return nil, fmt.Errorf("%w: a chain and a token are required", ErrInvalidInvoice)
+	}
+	if inv.Amount == nil || inv.Amount.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidInvoice)
+	}
+	inv = copyInvoice(inv)
+	if inv.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		inv.ID = hex.EncodeToString(id)
+	}
+	// checked before a wallet is allocated for nothing
+	if _, err := m.Store.Get(inv.ID); err == nil {
+		return nil, ErrInvoiceExists
+	} else if !errors.Is(err, ErrInvoiceNotFound) {
+		return nil, err
+	}
+
+	w, err := m.Wallets.Allocate(inv.Customer, inv.ID)
+	if err != nil {
+		return nil, fmt.Errorf("allocating a wallet for invoice %s: %w", inv.ID, err)
+	}
+	inv.Wallet = w.Address
+	inv.Status = StatusUnpaid
+	inv.Paid = big.NewInt(0)
+	inv.Pending = big.NewInt(0)
+	inv.PaidAt = time.Time{}
+	inv.CreatedAt = time.Now()
+	inv.UpdatedAt = inv.CreatedAt
+	if err := m.Store.Create(inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Refresh settles an invoice again from the deposits into its wallet, and returns it. A
+// status it changes is saved, so a later Update does not report it; a store notifying of
+// saves, such as SQLiteStore.OnSave, sees it.
+func (m *Manager) Refresh(id string) (*Invoice, error) {
+	inv, err := m.Store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.refresh(inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Update settles again the invoices of the wallets deposits were paid into, such as the
+// deposits a poll of the indexer detected, confirmed or orphaned, and the open invoices
+// past their expiry. It returns the invoices whose status changed.
+func (m *Manager) Update(changed []*deposits.Deposit) ([]*Invoice, error) {
+	seen := make(map[string]bool)
+	var updated []*Invoice
+	update := func(inv *Invoice) error {
+		if seen[inv.ID] {
+			return nil
+		}
+		seen[inv.ID] = true
+		statusChanged, err := m.refresh(inv)
+		if statusChanged {
+			updated = append(updated, inv)
+		}
+		return err
+	}
+
+	for _, wallet := range deposits.Wallets(changed) {
+		inv, err := m.Store.ByWallet(wallet)
+		if errors.Is(err, ErrInvoiceNotFound) {
+			continue // a wallet handed out without an invoice
+		} else if err != nil {
+			return updated, err
+		}
+		if err := update(inv); err != nil {
+			return updated, err
+		}
+	}
+
+	open, err := m.Store.Open()
+	if err != nil {
+		return updated, err
+	}
+	now := time.Now()
+	for _, inv := range open {
+		if expired(inv, now) {
+			if err := update(inv); err != nil {
+				return updated, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+// refresh settles inv from its wallet's deposits and saves it if anything changed,
+// reporting whether its status did
+func (m *Manager) refresh(inv *Invoice) (bool, error) {
+	deps, err := m.Deposits.ByWallet(inv.ChainID, inv.Wallet)
+	if err != nil {
+		return false, err
+	}
+	prev := copyInvoice(inv)
+	settle(inv, deps, time.Now())
+	if inv.Status == prev.Status && inv.Paid.Cmp(prev.Paid) == 0 && inv.Pending.Cmp(prev.Pending) == 0 {
+		return false, nil
+	}
+	inv.UpdatedAt = time.Now()
+	if err := m.Store.Save(inv); err != nil {
+		return false, err
+	}
+	return inv.Status != prev.Status, nil
+}
+
+// settle sets what deposits paid inv and its status at now. Only deposits of the invoice's
+// token mined in a block before its expiry count, however late they were indexed; orphaned
+// deposits never do.
+func settle(inv *Invoice, deps []*deposits.Deposit, now time.Time) {
+	paid, pending := new(big.Int), new(big.Int)
+	for _, d := range deps {
+		if d.ChainID != inv.ChainID || d.Wallet != inv.Wallet || d.Token != inv.Token {
+			continue
+		}
+		if !inv.ExpiresAt.IsZero() && d.BlockTime.After(inv.ExpiresAt) {
+			continue // paid too late, to be refunded by hand
+		}
+		switch d.Status {
+		case deposits.StatusConfirmed:
+			paid.Add(paid, d.Amount)
+		case deposits.StatusPending:
+			pending.Add(pending, d.Amount)
+		}
+	}
+	inv.Paid, inv.Pending = paid, pending
+
+	switch cmp := paid.Cmp(inv.Amount); {
+	case cmp > 0:
+		inv.Status = StatusOverpaid
+	case cmp == 0:
+		inv.Status = StatusPaid
+	case expired(inv, now):
+		inv.Status = StatusExpired
+	case paid.Sign() > 0:
+		inv.Status = StatusPartiallyPaid
+	default:
+		inv.Status = StatusUnpaid
+	}
+	if inv.Status == StatusPaid || inv.Status == StatusOverpaid {
+		if inv.PaidAt.IsZero() {
+			inv.PaidAt = now
+		}
+	} else {
+		inv.PaidAt = time.Time{} // a reorg took a payment back
+	}
+}
+
+func expired(inv *Invoice, now time.Time) bool {
+	return !inv.ExpiresAt.IsZero() && now.After(inv.ExpiresAt)
+}
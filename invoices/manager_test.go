@@ -0,0 +1,166 @@
+package invoices
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/registry"
+	"allen-liaoo/payment-reciever/testing/simchain"
+)
+
+var testToken = common.HexToAddress("0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238")
+
+func newManager(t *testing.T) (*Manager, *registry.MemoryRegistry) {
+	wallets := registry.NewMemoryRegistry()
+	allocator, err := registry.NewAllocator(wallets, simchain.Mnemonic, simchain.BasePath)
+	assert.NoError(t, err)
+	return &Manager{Store: NewMemoryStore(), Deposits: deposits.NewMemoryStore(), Wallets: allocator}, wallets
+}
+
+func TestManager(t *testing.T) {
+	m, wallets := newManager(t)
+	inv, err := m.Create(&Invoice{ChainID: 1, Token: testToken, Amount: big.NewInt(20), Customer: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, inv.ID, 32)
+	assert.Equal(t, StatusUnpaid, inv.Status)
+	w, err := wallets.Get(inv.Wallet)
+	assert.NoError(t, err)
+	assert.Equal(t, inv.ID, w.Invoice)
+	assert.Equal(t, "alice", w.Customer)
+
+	_, err = m.Create(&Invoice{ID: inv.ID, ChainID: 1, Token: testToken, Amount: big.NewInt(20)})
+	assert.ErrorIs(t, err, ErrInvoiceExists)
+	_, err = m.Create(&Invoice{ChainID: 1, Token: testToken, Amount: big.NewInt(0)})
+	assert.ErrorIs(t, err, ErrInvalidInvoice)
+	next, err := wallets.NextIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), next, "no wallet allocated for rejected invoices")
+
+	deposit := func(txHash byte, amount int64, status deposits.Status) *deposits.Deposit {
+		d := &deposits.Deposit{ChainID: 1, TxHash: common.Hash{txHash}, Token: testToken, Wallet: inv.Wallet,
+			Amount: big.NewInt(amount), Status: status, DetectedAt: time.Now()}
+		_, err := m.Deposits.Add(d)
+		assert.NoError(t, err)
+		return d
+	}
+
+	first := deposit(1, 5, deposits.StatusPending)
+	updated, err := m.Update([]*deposits.Deposit{first})
+	assert.NoError(t, err)
+	assert.Empty(t, updated, "pending deposits do not pay")
+	got, err := m.Store.Get(inv.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), got.Pending.Int64())
+
+	assert.NoError(t, m.Deposits.SetStatus(first, deposits.StatusConfirmed))
+	updated, err = m.Update([]*deposits.Deposit{first})
+	assert.NoError(t, err)
+	if assert.Len(t, updated, 1) {
+		assert.Equal(t, StatusPartiallyPaid, updated[0].Status)
+		assert.Equal(t, int64(5), updated[0].Paid.Int64())
+		assert.Equal(t, int64(0), updated[0].Pending.Int64())
+	}
+
+	second := deposit(2, 15, deposits.StatusConfirmed)
+	updated, err = m.Update([]*deposits.Deposit{second})
+	assert.NoError(t, err)
+	if assert.Len(t, updated, 1) {
+		assert.Equal(t, StatusPaid, updated[0].Status)
+		assert.False(t, updated[0].PaidAt.IsZero())
+	}
+	open, err := m.Store.Open()
+	assert.NoError(t, err)
+	assert.Empty(t, open)
+
+	// a reorg takes the second payment back
+	assert.NoError(t, m.Deposits.SetStatus(second, deposits.StatusOrphaned))
+	got, err = m.Refresh(inv.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPartiallyPaid, got.Status)
+	assert.True(t, got.PaidAt.IsZero())
+}
+
+// Open invoices expire without deposits to settle them
+func TestManagerExpiry(t *testing.T) {
+	m, _ := newManager(t)
+	inv, err := m.Create(&Invoice{ChainID: 1, Token: testToken, Amount: big.NewInt(20), ExpiresAt: time.Now().Add(-time.Second)})
+	assert.NoError(t, err)
+	lasting, err := m.Create(&Invoice{ChainID: 1, Token: testToken, Amount: big.NewInt(20)})
+	assert.NoError(t, err)
+
+	updated, err := m.Update(nil)
+	assert.NoError(t, err)
+	if assert.Len(t, updated, 1) {
+		assert.Equal(t, inv.ID, updated[0].ID)
+		assert.Equal(t, StatusExpired, updated[0].Status)
+	}
+	open, err := m.Store.Open()
+	assert.NoError(t, err)
+	if assert.Len(t, open, 1) {
+		assert.Equal(t, lasting.ID, open[0].ID)
+	}
+}
+
+// A deposit mined before the expiry pays, though it was indexed after
+func TestManagerLateIndexing(t *testing.T) {
+	m, _ := newManager(t)
+	inv, err := m.Create(&Invoice{ChainID: 1, Token: testToken, Amount: big.NewInt(20), ExpiresAt: time.Now().Add(-time.Minute)})
+	assert.NoError(t, err)
+	d := &deposits.Deposit{ChainID: 1, TxHash: common.Hash{1}, Token: testToken, Wallet: inv.Wallet, Amount: big.NewInt(20),
+		Status: deposits.StatusConfirmed, BlockTime: time.Now().Add(-2 * time.Minute), DetectedAt: time.Now()}
+	_, err = m.Deposits.Add(d)
+	assert.NoError(t, err)
+
+	updated, err := m.Update([]*deposits.Deposit{d})
+	assert.NoError(t, err)
+	if assert.Len(t, updated, 1) {
+		assert.Equal(t, StatusPaid, updated[0].Status)
+		assert.Equal(t, int64(20), updated[0].Paid.Int64())
+	}
+}
+
+func TestSettle(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	wallet := common.HexToAddress("0x01")
+	deposit := func(amount int64, status deposits.Status, mined time.Time) *deposits.Deposit {
+		return &deposits.Deposit{ChainID: 1, Token: testToken, Wallet: wallet, Amount: big.NewInt(amount), Status: status, BlockTime: mined, DetectedAt: now}
+	}
+	confirmed := func(amount int64) *deposits.Deposit { return deposit(amount, deposits.StatusConfirmed, now) }
+	otherToken := confirmed(20)
+	otherToken.Token = common.HexToAddress("0x02")
+	otherChain := confirmed(20)
+	otherChain.ChainID = 10
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		deps      []*deposits.Deposit
+		status    Status
+		paid      int64
+	}{
+		{"unpaid", time.Time{}, nil, StatusUnpaid, 0},
+		{"pending only", time.Time{}, []*deposits.Deposit{deposit(20, deposits.StatusPending, now)}, StatusUnpaid, 0},
+		{"partially paid", time.Time{}, []*deposits.Deposit{confirmed(5), confirmed(10)}, StatusPartiallyPaid, 15},
+		{"paid", time.Time{}, []*deposits.Deposit{confirmed(5), confirmed(15)}, StatusPaid, 20},
+		{"overpaid", time.Time{}, []*deposits.Deposit{confirmed(25)}, StatusOverpaid, 25},
+		{"orphaned", time.Time{}, []*deposits.Deposit{deposit(20, deposits.StatusOrphaned, now)}, StatusUnpaid, 0},
+		{"other token and chain", time.Time{}, []*deposits.Deposit{otherToken, otherChain}, StatusUnpaid, 0},
+		{"expired", now.Add(-time.Minute), []*deposits.Deposit{deposit(5, deposits.StatusConfirmed, now.Add(-time.Hour))}, StatusExpired, 5},
+		{"paid before expiry", now.Add(-time.Minute), []*deposits.Deposit{deposit(20, deposits.StatusConfirmed, now.Add(-time.Hour))}, StatusPaid, 20},
+		{"paid after expiry", now.Add(-time.Minute), []*deposits.Deposit{confirmed(20)}, StatusExpired, 0},
+		{"paid before expiry, indexed after", now.Add(-time.Minute), []*deposits.Deposit{deposit(20, deposits.StatusConfirmed, now.Add(-2*time.Minute))}, StatusPaid, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := &Invoice{ChainID: 1, Wallet: wallet, Token: testToken, Amount: big.NewInt(20), ExpiresAt: tt.expiresAt}
+			settle(inv, tt.deps, now)
+			assert.Equal(t, tt.status, inv.Status)
+			assert.Equal(t, tt.paid, inv.Paid.Int64())
+		})
+	}
+}
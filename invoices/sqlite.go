@@ -0,0 +1,204 @@
+package invoices
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const invoicesSchema = `
+CREATE TABLE IF NOT EXISTS invoices (
+	id         TEXT PRIMARY KEY,
+	chain_id   INTEGER NOT NULL,
+	wallet     TEXT NOT NULL UNIQUE,
+	token      TEXT NOT NULL,
+	amount     TEXT NOT NULL,
+	customer   TEXT NOT NULL DEFAULT '',
+	metadata   TEXT NOT NULL DEFAULT '{}',
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	status     TEXT NOT NULL,
+	paid       TEXT NOT NULL,
+	pending    TEXT NOT NULL,
+	paid_at    INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS invoices_status ON invoices (status)`
+
+const invoiceColumns = `id, chain_id, wallet, token, amount, customer, metadata, expires_at, status, paid, pending, paid_at, created_at, updated_at`
+
+// SQLiteStore keeps a row per invoice, its wallet unique so a wallet pays one invoice.
+// The API creates and refreshes invoices in it while the sweeping process settles them.
+type SQLiteStore struct {
+	db *sql.DB
+	// OnSave, if set, runs in the same transaction as each Create and Save. Manager.Update
+	// and Manager.Refresh both save the status changes they make, so a hook such as
+	// webhooks.SQLiteOutbox.InvoiceSaved sees every one.
+	OnSave func(tx *sql.Tx, inv *Invoice) error
+}
+
+// NewSQLiteStore creates the invoices table in db if it does not exist.
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	if _, err := db.Exec(invoicesSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Create(inv *Invoice) error {
+	args, err := invoiceArgs(inv)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO invoices (`+invoiceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...)
+	if err != nil && strings.Contains(err.Error(), "constraint failed") {
+		return ErrInvoiceExists
+	} else if err != nil {
+		return err
+	}
+	if err := s.saved(tx, inv); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Get(id string) (*Invoice, error) {
+	return s.get(`SELECT `+invoiceColumns+` FROM invoices WHERE id = ?`, id)
+}
+
+func (s *SQLiteStore) ByWallet(wallet common.Address) (*Invoice, error) {
+	return s.get(`SELECT `+invoiceColumns+` FROM invoices WHERE wallet = ?`, wallet.Hex())
+}
+
+func (s *SQLiteStore) Save(inv *Invoice) error {
+	args, err := invoiceArgs(inv)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE invoices SET chain_id = ?, wallet = ?, token = ?, amount = ?, customer = ?, metadata = ?,
+		expires_at = ?, status = ?, paid = ?, pending = ?, paid_at = ?, created_at = ?, updated_at = ?
+		WHERE id = ?`, append(args[1:], inv.ID)...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvoiceNotFound
+	}
+	if err := s.saved(tx, inv); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saved calls OnSave, if set
+func (s *SQLiteStore) saved(tx *sql.Tx, inv *Invoice) error {
+	if s.OnSave == nil {
+		return nil
+	}
+	return s.OnSave(tx, inv)
+}
+
+func (s *SQLiteStore) Open() ([]*Invoice, error) {
+	rows, err := s.db.Query(`SELECT `+invoiceColumns+` FROM invoices WHERE status IN (?, ?) ORDER BY created_at`,
+		StatusUnpaid, StatusPartiallyPaid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var open []*Invoice
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		open = append(open, inv)
+	}
+	return open, rows.Err()
+}
+
+func (s *SQLiteStore) get(query string, args ...any) (*Invoice, error) {
+	inv, err := scanInvoice(s.db.QueryRow(query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvoiceNotFound
+	}
+	return inv, err
+}
+
+// invoiceArgs returns the values of invoiceColumns for inv
+func invoiceArgs(inv *Invoice) ([]any, error) {
+	metadata, err := json.Marshal(inv.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return []any{inv.ID, inv.ChainID, inv.Wallet.Hex(), inv.Token.Hex(), inv.Amount.String(), inv.Customer, string(metadata),
+		unixNano(inv.ExpiresAt), inv.Status, amountString(inv.Paid), amountString(inv.Pending), unixNano(inv.PaidAt),
+		inv.CreatedAt.UnixNano(), inv.UpdatedAt.UnixNano()}, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanInvoice(row scanner) (*Invoice, error) {
+	var inv Invoice
+	var wallet, token, amount, metadata, status, paid, pending string
+	var expiresAt, paidAt, createdAt, updatedAt int64
+	if err := row.Scan(&inv.ID, &inv.ChainID, &wallet, &token, &amount, &inv.Customer, &metadata, &expiresAt,
+		&status, &paid, &pending, &paidAt, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	inv.Wallet = common.HexToAddress(wallet)
+	inv.Token = common.HexToAddress(token)
+	inv.Amount, _ = new(big.Int).SetString(amount, 10)
+	if err := json.Unmarshal([]byte(metadata), &inv.Metadata); err != nil {
+		return nil, err
+	}
+	inv.ExpiresAt = fromUnixNano(expiresAt)
+	inv.Status = Status(status)
+	inv.Paid, _ = new(big.Int).SetString(paid, 10)
+	inv.Pending, _ = new(big.Int).SetString(pending, 10)
+	inv.PaidAt = fromUnixNano(paidAt)
+	inv.CreatedAt = time.Unix(0, createdAt)
+	inv.UpdatedAt = time.Unix(0, updatedAt)
+	return &inv, nil
+}
+
+func amountString(amount *big.Int) string {
+	if amount == nil {
+		return "0"
+	}
+	return amount.String()
+}
+
+// unixNano stores the zero time, such as no expiry, as 0
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -1,37 +1,778 @@
 package main
 
 import (
+	"allen-liaoo/payment-reciever/api"
+	"allen-liaoo/payment-reciever/daemon"
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/handler"
+	"allen-liaoo/payment-reciever/invoices"
 	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/registry"
 	"allen-liaoo/payment-reciever/util"
+	"allen-liaoo/payment-reciever/webhooks"
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"math/big"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/joho/godotenv"
 )
 
-var middlewareWalletMneumonic string
+// middleware wallets are derived at middlewareBasePath/<index>
+const middlewareBasePath = "m/44'/60'/0'/0"
+
+var chainsPath = flag.String("chains", "", "JSON chain registry; sweep on every chain in it instead of RPC_URL's")
+var registryPath = flag.String("registry", "", "SQLite wallet registry; sweep every active wallet in it")
+var concurrency = flag.Int("concurrency", 8, "wallets swept at once in registry mode")
+var feeSpeed = flag.String("fees", "", "price sweeps from recent fee history: slow, standard or fast (default twice the base fee plus tip)")
+var native = flag.Bool("native", false, "sweep ETH paid to middleware wallets instead of USDC_ADDRESS tokens")
+var index = flag.Bool("index", false, "in registry mode, sweep only wallets paid since the last run, found in Transfer logs")
+var recoverDust = flag.Bool("recover-dust", false, "in registry mode, return leftover ETH of active wallets to the provider wallet instead of sweeping")
+var httpAddr = flag.String("http", "", "in registry mode, serve the HTTP API (see api/openapi.yaml) on this address, e.g. :8080, instead of sweeping")
+var invoke = flag.Bool("invoke", false, "in registry mode, run one sweep cycle as the scheduled handler does, with its JSON event read from stdin, and print its JSON summary")
+var timeout = flag.Duration("timeout", 0, "in registry mode, deadline of the sweep cycle, e.g. 5m (none by default; 5m with -daemon)")
+var runDaemon = flag.Bool("daemon", false, "in registry mode, run sweep cycles every -interval until SIGTERM or SIGINT, which let the cycle in flight finish")
+var interval = flag.Duration("interval", time.Minute, "with -daemon, time between sweep cycles")
+var onBlocks = flag.Bool("on-blocks", false, "with -daemon, also run a cycle of a chain on each of its new blocks (needs websocket or IPC RPC URLs)")
+var healthAddr = flag.String("health", "", "with -daemon, serve its health on this address, e.g. :8081, at /health")
+var replayWebhook = flag.String("replay-webhook", "", "in registry mode, send the webhook event with this ID again, or every failed one with \"failed\", and exit")
+var exportXpub = flag.String("export-xpub", "", "print the extended public key at this path (e.g. m/44'/60'/0') and exit")
 
 func init() {
 	godotenv.Load()
-	middlewareWalletMneumonic = os.Getenv("MIDDLEWARE_MNEUMONIC")
-	if middlewareWalletMneumonic == "" {
-		panic("USDC_ADDRESS or PROVIDER_WALLET_ADDRESS or PROVIDER_WALLET_PK or MIDDLEWARE_MNEUMONIC environment variable is not set")
+}
+
+// middlewareMnemonic returns MIDDLEWARE_MNEUMONIC, which only modes deriving private keys
+// of middleware wallets need
+func middlewareMnemonic() string {
+	mnemonic := os.Getenv("MIDDLEWARE_MNEUMONIC")
+	if mnemonic == "" {
+		panic("MIDDLEWARE_MNEUMONIC environment variable is not set")
+	}
+	return mnemonic
+}
+
+// middlewareHDWallet derives the middleware wallets, from a seed computed on first use
+var middlewareHDWallet = sync.OnceValues(func() (*util.HDWallet, error) {
+	return util.NewHDWallet(middlewareMnemonic())
+})
+
+// chainTarget is a chain to sweep and the tokens swept on it
+type chainTarget struct {
+	client        *ethclient.Client
+	chainID       uint64
+	confirmations uint64
+	feeModel      util.FeeModel
+	tokenAddress  common.Address
+	tokens        []util.Token
+}
+
+// chainsFromEnv returns the chains of the -chains file, or else the chain of RPC_URL and
+// INFURA_KEY with the USDC_ADDRESS token, the TOKEN_REGISTRY tokens of that chain, and the
+// optional FEE_MODEL and CONFIRMATIONS.
+func chainsFromEnv() ([]chainTarget, error) {
+	ctx := context.Background()
+	if *chainsPath != "" {
+		chains, err := util.LoadChains(*chainsPath)
+		if err != nil {
+			return nil, err
+		}
+		var targets []chainTarget
+		for _, chain := range chains {
+			client, err := util.DialChain(ctx, chain)
+			if err != nil {
+				return nil, err
+			}
+			target := chainTarget{client: client, chainID: chain.ID, confirmations: chain.Confirmations, feeModel: chain.FeeModel}
+			if !*native {
+				if len(chain.Tokens) == 0 {
+					return nil, fmt.Errorf("chain %d has no tokens to sweep", chain.ID)
+				}
+				target.tokens = chain.Tokens
+			}
+			targets = append(targets, target)
+		}
+		return targets, nil
+	}
+
+	var rpcUrl = os.Getenv("RPC_URL")
+	var infuraKey = os.Getenv("INFURA_KEY")
+	var usdcAddr = os.Getenv("USDC_ADDRESS")
+	var tokenRegistry = os.Getenv("TOKEN_REGISTRY")
+	if rpcUrl == "" || (usdcAddr == "" && tokenRegistry == "" && !*native) {
+		return nil, fmt.Errorf("RPC_URL or USDC_ADDRESS environment variable is not set")
+	}
+	client, err := ethclient.Dial(rpcUrl + infuraKey)
+	if err != nil {
+		return nil, err
+	}
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	target := chainTarget{client: client, chainID: chainID.Uint64(), feeModel: util.FeeModel(os.Getenv("FEE_MODEL"))}
+	if confirmations := os.Getenv("CONFIRMATIONS"); confirmations != "" {
+		if target.confirmations, err = strconv.ParseUint(confirmations, 10, 64); err != nil {
+			return nil, fmt.Errorf("CONFIRMATIONS: %w", err)
+		}
+	}
+	if !*native && usdcAddr != "" {
+		target.tokenAddress = common.HexToAddress(usdcAddr)
+	}
+	if tokenRegistry != "" && !*native {
+		reg, err := util.LoadTokenRegistry(tokenRegistry)
+		if err != nil {
+			return nil, err
+		}
+		target.tokens = reg.ForChain(target.chainID)
+		if len(target.tokens) == 0 && target.tokenAddress == (common.Address{}) {
+			return nil, fmt.Errorf("%s has no tokens for chain %d", tokenRegistry, target.chainID)
+		}
+	}
+	return []chainTarget{target}, nil
+}
+
+// sweptTokens returns the tokens a sweeper of the chain sweeps, as reciever.NewSweeper
+// combines them
+func (target chainTarget) sweptTokens() []util.Token {
+	var tokens []util.Token
+	if *native || target.tokenAddress != (common.Address{}) {
+		tokens = append(tokens, util.Token{Address: target.tokenAddress})
+	}
+	for _, token := range target.tokens {
+		if token.Address != target.tokenAddress {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// journalFromEnv returns the journal of sweeps. With -registry it is the registry
+// database's, shared by every process using the database, and the unfinished sweeps of a
+// SWEEP_JOURNAL file are copied into it, queueing sweep events in outbox, if set, as they
+// are saved; otherwise it is the SWEEP_JOURNAL file, or nil to keep sweeps in memory.
+func journalFromEnv(db *sql.DB, outbox *webhooks.SQLiteOutbox) (reciever.Journal, error) {
+	var file reciever.Journal
+	if journalPath := os.Getenv("SWEEP_JOURNAL"); journalPath != "" {
+		var err error
+		if file, err = reciever.OpenFileJournal(journalPath); err != nil {
+			return nil, err
+		}
+	}
+	if db == nil {
+		return file, nil
+	}
+	journal, err := reciever.NewSQLiteJournal(db)
+	if err != nil {
+		return nil, err
+	}
+	if outbox != nil {
+		journal.OnSave = outbox.SweepSaved
+	}
+	if file != nil {
+		copied, err := reciever.CopyUnfinished(file, journal)
+		if err != nil {
+			return nil, err
+		}
+		if copied > 0 {
+			log.Printf("copied %d unfinished sweeps from SWEEP_JOURNAL into the registry database", copied)
+		}
+	}
+	return journal, nil
+}
+
+// chainSweeper is the sweeper of a chain, with the client it sweeps through
+type chainSweeper struct {
+	*reciever.Sweeper
+	chainTarget
+}
+
+// sweepersFromEnv builds a sweeper for each chain of chainsFromEnv from PROVIDER_WALLET_PK,
+// the optional DESTINATION_ADDRESS (defaults to the provider wallet), and the optional
+// NONCE_STORE file (defaults to keeping nonces in memory). The sweepers share journal;
+// with -chains, each chain keeps its nonces in its own file, NONCE_STORE with the chain ID
+// before the extension.
+func sweepersFromEnv(journal reciever.Journal, onStateChange func(rec *reciever.SweepRecord)) ([]chainSweeper, error) {
+	var providerWalletPrivateKey = os.Getenv("PROVIDER_WALLET_PK")
+	if providerWalletPrivateKey == "" {
+		return nil, fmt.Errorf("PROVIDER_WALLET_PK environment variable is not set")
+	}
+	targets, err := chainsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	providerWalletPK, err := crypto.HexToECDSA(providerWalletPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	desAddress := crypto.PubkeyToAddress(providerWalletPK.PublicKey)
+	if desAddr := os.Getenv("DESTINATION_ADDRESS"); desAddr != "" {
+		desAddress = common.HexToAddress(desAddr)
+	}
+
+	var bump reciever.BumpPolicy
+	if after := os.Getenv("SWEEP_BUMP_AFTER"); after != "" {
+		if bump.After, err = time.ParseDuration(after); err != nil {
+			return nil, fmt.Errorf("SWEEP_BUMP_AFTER: %w", err)
+		}
+	}
+	if maxFeeCap := os.Getenv("SWEEP_MAX_FEE_CAP"); maxFeeCap != "" {
+		var ok bool
+		if bump.MaxFeeCap, ok = new(big.Int).SetString(maxFeeCap, 10); !ok {
+			return nil, fmt.Errorf("SWEEP_MAX_FEE_CAP: invalid wei amount %q", maxFeeCap)
+		}
+	}
+
+	fees, err := feeStrategy(*feeSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	var profit reciever.ProfitPolicy
+	if maxCost := os.Getenv("SWEEP_MAX_COST"); maxCost != "" {
+		var ok bool
+		if profit.MaxCost, ok = new(big.Int).SetString(maxCost, 10); !ok {
+			return nil, fmt.Errorf("SWEEP_MAX_COST: invalid wei amount %q", maxCost)
+		}
+	}
+	if maxPercent := os.Getenv("SWEEP_MAX_COST_PERCENT"); maxPercent != "" {
+		if profit.MaxCostPercent, err = strconv.ParseFloat(maxPercent, 64); err != nil {
+			return nil, fmt.Errorf("SWEEP_MAX_COST_PERCENT: %w", err)
+		}
+	}
+	var tokensPerETH *big.Float
+	if profit.MaxCostPercent > 0 && !*native {
+		var ok bool
+		if tokensPerETH, ok = new(big.Float).SetString(os.Getenv("TOKEN_PER_ETH")); !ok {
+			return nil, fmt.Errorf("TOKEN_PER_ETH must be set with SWEEP_MAX_COST_PERCENT")
+		}
+	}
+
+	var sweepers []chainSweeper
+	for _, target := range targets {
+		var nonces *util.NonceManager
+		if noncePath := os.Getenv("NONCE_STORE"); noncePath != "" {
+			if *chainsPath != "" {
+				ext := filepath.Ext(noncePath)
+				noncePath = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(noncePath, ext), target.chainID, ext)
+			}
+			store, err := util.OpenFileNonceStore(noncePath)
+			if err != nil {
+				return nil, err
+			}
+			nonces = util.NewNonceManager(target.client, store)
+		}
+
+		chainProfit := profit
+		if tokensPerETH != nil {
+			// every token is priced the same, as stablecoins of one currency are
+			prices := reciever.PriceTable{}
+			for _, token := range target.tokens {
+				prices[token.Address] = reciever.FixedPrice{TokensPerETH: tokensPerETH, Decimals: token.Decimals}
+			}
+			if _, ok := prices[target.tokenAddress]; !ok && target.tokenAddress != (common.Address{}) {
+				decimals, err := util.GetContractDecimals(target.client, target.tokenAddress)
+				if err != nil {
+					return nil, err
+				}
+				prices[target.tokenAddress] = reciever.FixedPrice{TokensPerETH: tokensPerETH, Decimals: decimals}
+			}
+			chainProfit.Prices = prices
+		}
+
+		var feeModel reciever.FeeModel
+		switch target.feeModel {
+		case "", util.FeeModelEIP1559:
+		case util.FeeModelOPStack:
+			feeModel = reciever.OPStackFees{}
+		default:
+			return nil, fmt.Errorf("chain %d: unknown fee model %q", target.chainID, target.feeModel)
+		}
+
+		sweeper, err := reciever.NewSweeper(reciever.Config{
+			Client:        target.client,
+			ChainID:       target.chainID,
+			TokenAddress:  target.tokenAddress,
+			Tokens:        target.tokens,
+			Native:        *native,
+			ProviderKey:   providerWalletPK,
+			Destination:   desAddress,
+			Journal:       journal,
+			Nonces:        nonces,
+			Bump:          bump,
+			Fees:          fees,
+			FeeModel:      feeModel,
+			Profit:        chainProfit,
+			OnStateChange: onStateChange,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %w", target.chainID, err)
+		}
+		sweepers = append(sweepers, chainSweeper{Sweeper: sweeper, chainTarget: target})
+	}
+	return sweepers, nil
+}
+
+func feeStrategy(speed string) (reciever.FeeStrategy, error) {
+	switch speed {
+	case "":
+		return reciever.DefaultFeeStrategy, nil
+	case "slow":
+		return reciever.SlowFees, nil
+	case "standard":
+		return reciever.StandardFees, nil
+	case "fast":
+		return reciever.FastFees, nil
 	}
+	return nil, fmt.Errorf("unknown fee speed %q", speed)
 }
 
 func main() {
+	flag.Parse()
+	if *exportXpub != "" {
+		xpub, err := util.ExtendedPublicKey(middlewareMnemonic(), *exportXpub)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(xpub)
+		return
+	}
+
+	// the registry database also keeps deposits, invoices and queued webhooks
+	var db *sql.DB
+	if *registryPath != "" {
+		var err error
+		if db, err = registry.OpenSQLite(*registryPath); err != nil {
+			panic(err)
+		}
+		defer db.Close()
+	}
+	dispatcher, err := webhooksFromEnv(db)
+	if err != nil {
+		panic(err)
+	}
+	if *replayWebhook != "" {
+		if db == nil || dispatcher == nil {
+			panic("-replay-webhook needs -registry and WEBHOOK_URL")
+		}
+		if *replayWebhook == "failed" {
+			n, err := webhooks.ReplayFailed(dispatcher.Outbox)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("replaying %d failed webhooks\n", n)
+		} else if err := webhooks.Replay(dispatcher.Outbox, *replayWebhook); err != nil {
+			panic(err)
+		}
+		dispatchWebhooks(dispatcher)
+		return
+	}
+	outbox := sqliteOutbox(dispatcher)
+	var onStateChange func(rec *reciever.SweepRecord)
+	if dispatcher != nil && outbox == nil {
+		// a journal outside the outbox's database queues sweep events after saving
+		onStateChange = (&webhooks.Recorder{Outbox: dispatcher.Outbox}).Sweep
+	}
+
+	journal, err := journalFromEnv(db, outbox)
+	if err != nil {
+		panic(err)
+	}
+	var wallets registry.WalletRegistry
+	if db != nil {
+		if wallets, err = registry.NewSQLiteRegistry(db); err != nil {
+			panic(err)
+		}
+		if *httpAddr != "" {
+			// the API sweeps nothing itself, so needs no provider wallet
+			panic(serveAPI(db, wallets, journal, dispatcher))
+		}
+	}
+
+	sweepers, err := sweepersFromEnv(journal, onStateChange)
+	if err != nil {
+		panic(err)
+	}
+
+	if db != nil {
+		if *recoverDust {
+			for _, sweeper := range sweepers {
+				if err := recoverRegistryDust(sweeper.Sweeper, wallets); err != nil {
+					panic(err)
+				}
+			}
+			return
+		}
+		h, err := registryHandler(db, wallets, sweepers, dispatcher)
+		if err != nil {
+			panic(err)
+		}
+		if *runDaemon {
+			if err := runSweepDaemon(h, sweepers); err != nil {
+				panic(err)
+			}
+			return
+		}
+		ctx := context.Background()
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+		if *invoke {
+			payload, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				panic(err)
+			}
+			out, err := handler.Invoke(ctx, h, payload)
+			if out != nil {
+				fmt.Println(string(out))
+			}
+			if err != nil {
+				panic(err)
+			}
+			return
+		}
+		summary, err := h.Handle(ctx, handler.Event{})
+		printSummary(summary)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if dispatcher != nil {
+		// sends what this run queued, and what earlier runs could not deliver
+		defer dispatchWebhooks(dispatcher)
+	}
+
 	// Local testing: Derive necessary middleware wallet
-	var testDerivationPath = "m/44'/60'/0'/0/42"
-	middlewareWallet, privateKey, err := util.DeriveWallet(middlewareWalletMneumonic, testDerivationPath)
+	var testDerivationPath = middlewareBasePath + "/42"
+	middlewareWallet, privateKey, err := util.DeriveWallet(middlewareMnemonic(), testDerivationPath)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("middleware wallet address: ", middlewareWallet.Address.Hex())
 
-	result, error := reciever.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(0), big.NewInt(0))
-	fmt.Printf("%#v\n", result)
-	if error != nil {
-		panic(error)
+	for _, sweeper := range sweepers {
+		// Finish sweeps an earlier run left half done before starting new ones
+		resumed, err := sweeper.Resume(context.Background(), func(address common.Address) (*ecdsa.PrivateKey, error) {
+			if address != middlewareWallet.Address {
+				return nil, fmt.Errorf("unknown middleware wallet %s", address.Hex())
+			}
+			return privateKey, nil
+		})
+		for _, rec := range resumed {
+			fmt.Printf("resumed sweep %s: %s\n", rec.ID, rec.State)
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		results, error := sweeper.SweepWallet(context.Background(), middlewareWallet, privateKey, big.NewInt(0))
+		for _, result := range results {
+			fmt.Printf("%#v\n", result)
+		}
+		if error != nil {
+			panic(error)
+		}
+	}
+}
+
+// registryHandler returns the handler sweeping the registry's wallets, only those paid
+// since the last run with -index
+func registryHandler(db *sql.DB, wallets registry.WalletRegistry, sweepers []chainSweeper, dispatcher *webhooks.Dispatcher) (*handler.Handler, error) {
+	requests, err := handler.NewSQLiteRequests(db)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler.Handler{
+		Wallets:     wallets,
+		KeyFor:      registryKeys(wallets),
+		Webhooks:    dispatcher,
+		Requests:    requests,
+		Concurrency: *concurrency,
+	}
+	for _, sweeper := range sweepers {
+		h.Chains = append(h.Chains, handler.Chain{Sweeper: sweeper.Sweeper, Client: sweeper.client, Confirmations: sweeper.confirmations})
+	}
+	if *index {
+		if *native {
+			return nil, fmt.Errorf("-index finds token transfers, not ETH payments")
+		}
+		depositStore, err := deposits.NewSQLiteStore(db)
+		if err != nil {
+			return nil, err
+		}
+		if outbox := sqliteOutbox(dispatcher); outbox != nil {
+			depositStore.OnSave = outbox.DepositSaved
+		}
+		invoiceStore, err := invoices.NewSQLiteStore(db)
+		if err != nil {
+			return nil, err
+		}
+		if outbox := sqliteOutbox(dispatcher); outbox != nil {
+			invoiceStore.OnSave = outbox.InvoiceSaved
+		}
+		h.Deposits = depositStore
+		h.Invoices = &invoices.Manager{Store: invoiceStore, Deposits: depositStore}
+	}
+	return h, nil
+}
+
+// runSweepDaemon runs the handler's cycles until SIGTERM or SIGINT, serving its health on
+// -health if set
+func runSweepDaemon(h *handler.Handler, sweepers []chainSweeper) error {
+	d := &daemon.Daemon{
+		Handle: func(ctx context.Context, event handler.Event) (*handler.Summary, error) {
+			summary, err := h.Handle(ctx, event)
+			printSummary(summary)
+			return summary, err
+		},
+		Interval:     *interval,
+		CycleTimeout: *timeout,
+	}
+	if *onBlocks {
+		d.Heads = make(map[uint64]daemon.HeadSubscriber)
+		for _, sweeper := range sweepers {
+			d.Heads[sweeper.chainID] = sweeper.client
+		}
+	}
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /health", d.Health())
+		go func() {
+			log.Printf("serving health on %s", *healthAddr)
+			log.Printf("health endpoint: %v", http.ListenAndServe(*healthAddr, mux))
+		}()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return d.Run(ctx)
+}
+
+// printSummary prints what a sweep cycle did
+func printSummary(summary *handler.Summary) {
+	for _, cs := range summary.Chains {
+		if cs.Detected+cs.Confirmed+cs.Orphaned > 0 {
+			fmt.Printf("chain %d: %d deposits detected, %d confirmed, %d orphaned; %d invoices updated, %d sweeps flagged for review\n",
+				cs.ChainID, cs.Detected, cs.Confirmed, cs.Orphaned, cs.Invoices, cs.Flagged)
+		}
+		if cs.Resumed > 0 {
+			fmt.Printf("chain %d: resumed %d sweeps\n", cs.ChainID, cs.Resumed)
+		}
+		for _, w := range cs.Wallets {
+			switch w.Outcome {
+			case handler.OutcomeSwept:
+				fmt.Printf("chain %d wallet %s: swept, txs %v\n", cs.ChainID, w.Address.Hex(), w.Txs)
+			case handler.OutcomeFailed:
+				fmt.Printf("chain %d wallet %s: failed, %s\n", cs.ChainID, w.Address.Hex(), w.Error)
+			default:
+				fmt.Printf("chain %d wallet %s: %s\n", cs.ChainID, w.Address.Hex(), w.Outcome)
+			}
+		}
+		if cs.Error != "" {
+			fmt.Printf("chain %d: %s\n", cs.ChainID, cs.Error)
+		}
+	}
+	if summary.Webhooks > 0 {
+		fmt.Printf("sent %d webhooks\n", summary.Webhooks)
+	}
+	if summary.Incomplete {
+		fmt.Println("deadline reached before every wallet was swept")
+	}
+}
+
+// recoverRegistryDust returns the leftover ETH of every active wallet in the registry to
+// the provider wallet.
+func recoverRegistryDust(sweeper *reciever.Sweeper, wallets registry.WalletRegistry) error {
+	active, err := wallets.Active()
+	if err != nil {
+		return err
+	}
+	batch := batchWallets(active)
+
+	results := sweeper.RecoverDust(context.Background(), batch, reciever.DustOptions{Concurrency: *concurrency})
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			log.Printf("chain %d wallet %s: %v", r.ChainID, r.Address.Hex(), r.Err)
+		case r.Tx != nil:
+			fmt.Printf("chain %d wallet %s: returned %s wei, tx %s\n", r.ChainID, r.Address.Hex(), r.Amount, r.Tx.Hash().Hex())
+		}
+	}
+	return nil
+}
+
+// batchWallets derives registered wallets, skipping those that do not derive
+func batchWallets(wallets []*registry.Wallet) []reciever.BatchWallet {
+	var batch []reciever.BatchWallet
+	for _, w := range wallets {
+		middlewareWallet, privateKey, err := deriveMiddleware(w)
+		if err != nil {
+			log.Printf("wallet %d: %v", w.Index, err)
+			continue
+		}
+		batch = append(batch, reciever.BatchWallet{Account: middlewareWallet, PrivateKey: privateKey})
+	}
+	return batch
+}
+
+// webhooksFromEnv returns the dispatcher of webhooks to WEBHOOK_URL, signed with
+// WEBHOOK_SECRET, queued in db, or in memory without a registry; nil if WEBHOOK_URL is unset.
+func webhooksFromEnv(db *sql.DB) (*webhooks.Dispatcher, error) {
+	url := os.Getenv("WEBHOOK_URL")
+	if url == "" {
+		return nil, nil
+	}
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("WEBHOOK_SECRET must be set with WEBHOOK_URL")
+	}
+	var outbox webhooks.Outbox = webhooks.NewMemoryOutbox()
+	if db != nil {
+		var err error
+		if outbox, err = webhooks.NewSQLiteOutbox(db); err != nil {
+			return nil, err
+		}
+	}
+	return &webhooks.Dispatcher{Outbox: outbox, URL: url, Secret: []byte(secret)}, nil
+}
+
+// sqliteOutbox returns the outbox of dispatcher if it is kept in the registry database,
+// whose stores then queue their events in the transactions writing what raises them
+func sqliteOutbox(dispatcher *webhooks.Dispatcher) *webhooks.SQLiteOutbox {
+	if dispatcher == nil {
+		return nil
+	}
+	outbox, _ := dispatcher.Outbox.(*webhooks.SQLiteOutbox)
+	return outbox
+}
+
+// dispatchWebhooks sends the due webhooks, logging failures; undelivered ones are retried
+// by later runs
+func dispatchWebhooks(dispatcher *webhooks.Dispatcher) {
+	delivered, err := dispatcher.Dispatch(context.Background())
+	if err != nil {
+		log.Printf("sending webhooks: %v", err)
+	}
+	if delivered > 0 {
+		fmt.Printf("sent %d webhooks\n", delivered)
+	}
+}
+
+// registryKeys returns the private key of a registered wallet
+func registryKeys(wallets registry.WalletRegistry) func(address common.Address) (*ecdsa.PrivateKey, error) {
+	return func(address common.Address) (*ecdsa.PrivateKey, error) {
+		w, err := wallets.Get(address)
+		if err != nil {
+			return nil, err
+		}
+		_, privateKey, err := deriveMiddleware(w)
+		return privateKey, err
+	}
+}
+
+// middlewareAllocator returns the allocator of the API's deposit addresses. With
+// MIDDLEWARE_XPUB, the extended public key exported at MIDDLEWARE_XPUB_PATH (default
+// m/44'/60'/0'), addresses are derived without the mnemonic; otherwise they come from
+// MIDDLEWARE_MNEUMONIC.
+func middlewareAllocator(wallets registry.WalletRegistry) (*registry.Allocator, error) {
+	xpub := os.Getenv("MIDDLEWARE_XPUB")
+	if xpub == "" {
+		return registry.NewAllocator(wallets, middlewareMnemonic(), middlewareBasePath)
+	}
+	xpubPath := os.Getenv("MIDDLEWARE_XPUB_PATH")
+	if xpubPath == "" {
+		xpubPath = "m/44'/60'/0'"
+	}
+	wallet, err := util.NewWatchOnlyWallet(xpub, xpubPath)
+	if err != nil {
+		return nil, fmt.Errorf("MIDDLEWARE_XPUB: %w", err)
+	}
+	return registry.NewWatchOnlyAllocator(wallets, wallet, middlewareBasePath)
+}
+
+// serveAPI serves the HTTP API over the registry database until it fails, sending queued
+// webhooks every minute if dispatcher is set. Manual sweeps are queued in the database for
+// the sweeping process, which journals its sweeps there.
+func serveAPI(db *sql.DB, wallets registry.WalletRegistry, journal reciever.Journal, dispatcher *webhooks.Dispatcher) error {
+	targets, err := chainsFromEnv()
+	if err != nil {
+		return err
+	}
+	allocator, err := middlewareAllocator(wallets)
+	if err != nil {
+		return err
+	}
+	depositStore, err := deposits.NewSQLiteStore(db)
+	if err != nil {
+		return err
+	}
+	invoiceStore, err := invoices.NewSQLiteStore(db)
+	if err != nil {
+		return err
+	}
+	if outbox := sqliteOutbox(dispatcher); outbox != nil {
+		// invoices the API settles (see invoices.Manager.Refresh) are notified of too
+		invoiceStore.OnSave = outbox.InvoiceSaved
+	}
+	requests, err := handler.NewSQLiteRequests(db)
+	if err != nil {
+		return err
+	}
+	server := &api.Server{
+		Invoices: &invoices.Manager{Store: invoiceStore, Deposits: depositStore, Wallets: allocator},
+		Deposits: depositStore,
+		Wallets:  wallets,
+		Tokens:   make(map[uint64][]util.Token),
+		Journal:  journal,
+		Requests: requests,
+	}
+	for _, target := range targets {
+		server.Tokens[target.chainID] = target.sweptTokens()
+	}
+	if dispatcher != nil {
+		go func() {
+			for range time.Tick(time.Minute) {
+				dispatchWebhooks(dispatcher)
+			}
+		}()
+	}
+	log.Printf("serving the API on %s", *httpAddr)
+	return http.ListenAndServe(*httpAddr, server.Handler())
+}
+
+// deriveMiddleware derives a registered wallet, checking it matches the registered address
+func deriveMiddleware(w *registry.Wallet) (*accounts.Account, *ecdsa.PrivateKey, error) {
+	wallet, err := middlewareHDWallet()
+	if err != nil {
+		return nil, nil, err
+	}
+	path := fmt.Sprintf("%s/%d", middlewareBasePath, w.Index)
+	account, privateKey, err := wallet.Derive(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if account.Address != w.Address {
+		return nil, nil, fmt.Errorf("%s derives %s, registry has %s", path, account.Address.Hex(), w.Address.Hex())
 	}
+	return account, privateKey, nil
 }
@@ -0,0 +1,163 @@
+package reciever
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// defaultBatchConcurrency is used when BatchOptions.Concurrency is not set
+const defaultBatchConcurrency = 8
+
+// BatchWallet is a middleware wallet to sweep in a batch.
+type BatchWallet struct {
+	Account    *accounts.Account
+	PrivateKey *ecdsa.PrivateKey
+}
+
+type BatchOptions struct {
+	MinBalance       *big.Int // of tokens with no MinSweep
+	GasCostThreshold *big.Int
+	Concurrency      int         // wallets checked or waited on at once
+	Fees             FeeStrategy // prices the batch; defaults to the sweeper's strategy
+}
+
+// BatchResult is what happened to one wallet of a batch.
+type BatchResult struct {
+	Address  common.Address
+	ChainID  uint64
+	Results  []*PaymentResult // one per token swept or deferred
+	Skipped  bool             // every token balance below its minimum, nothing was sent
+	Deferred bool             // every token not worth its gas now, see Results; nothing was sent
+	Err      error
+}
+
+// SweepBatch sweeps every configured token out of many middleware wallets at once:
+//  1. check balances and plan sweeps concurrently, with one fee quote for the batch
+//  2. sign and broadcast the gas funding of every eligible wallet, with consecutive provider nonces
+//  3. wait for the funding receipts concurrently, sending each token sweep as its funding is mined
+//
+// Results are in the order of wallets. A wallet another call is sweeping fails with
+// ErrSweepInProgress.
+func (s *Sweeper) SweepBatch(ctx context.Context, wallets []BatchWallet, opts BatchOptions) []BatchResult {
+	if opts.MinBalance == nil {
+		opts.MinBalance = big.NewInt(1)
+	}
+	if opts.GasCostThreshold == nil {
+		opts.GasCostThreshold = big.NewInt(0)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultBatchConcurrency
+	}
+
+	results := make([]BatchResult, len(wallets))
+	chainID, err := s.ChainID(ctx)
+	for i, w := range wallets {
+		results[i] = BatchResult{Address: w.Account.Address, ChainID: chainID}
+	}
+
+	var fees *Fees
+	if err == nil {
+		fees, err = s.quoteFees(ctx, opts.Fees)
+	}
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	// wallets being swept by another call are left to it
+	locked := make([]bool, len(wallets))
+	for i, w := range wallets {
+		unlock, err := s.lockWallet(w.Account.Address)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		defer unlock()
+		locked[i] = true
+	}
+
+	// 1. check and plan
+	recs := make([][]*SweepRecord, len(wallets))
+	forEachLimit(len(wallets), opts.Concurrency, func(i int) {
+		if !locked[i] {
+			return
+		}
+		w := wallets[i]
+		recs[i], results[i].Results, results[i].Err = s.prepare(ctx, w.Account.Address, w.PrivateKey, s.tokens, opts.MinBalance, opts.GasCostThreshold, opts.Fees, fees)
+		if errors.Is(results[i].Err, ErrInsufficientBalance) {
+			results[i].Skipped = true
+			results[i].Err = nil
+		}
+		results[i].Deferred = len(recs[i]) == 0 && len(results[i].Results) > 0
+	})
+
+	// 2. fund gas, in order so provider nonces are consecutive. Funding signed by an earlier
+	// run goes out first; one whose nonce was taken is signed again in step 3.
+	for i, group := range recs {
+		for _, rec := range group {
+			if rec.State == StatePlanned && rec.FundingRawTx != nil {
+				if _, err := s.broadcast(ctx, rec.FundingRawTx); err != nil && !util.IsNonceTooLow(err) {
+					results[i].Err = err
+					recs[i] = nil
+					break
+				}
+			}
+		}
+	}
+	var fundErr error
+	for i, group := range recs {
+		for _, rec := range group {
+			if rec.State != StatePlanned || rec.FundingRawTx != nil || rec.FundingPath == FundingSkipped || rec.FundedBy != "" {
+				continue // already signed, nothing to fund, or funded by another sweep
+			}
+			if fundErr != nil {
+				// a gap in provider nonces would hold up every later funding
+				results[i].Err = fmt.Errorf("gas funding not sent: %w", fundErr)
+			} else if fundErr = s.signFunding(rec); fundErr != nil {
+				results[i].Err = fundErr
+			} else if _, fundErr = s.broadcast(ctx, rec.FundingRawTx); fundErr != nil {
+				results[i].Err = fundErr
+			}
+			if results[i].Err != nil {
+				recs[i] = nil
+				break
+			}
+		}
+	}
+
+	// 3. wait for funding, then send tokens
+	forEachLimit(len(wallets), opts.Concurrency, func(i int) {
+		if recs[i] == nil {
+			return
+		}
+		results[i].Err = s.advanceAll(ctx, recs[i], wallets[i].PrivateKey, results[i].Results, StateTokenSent)
+	})
+	return results
+}
+
+// forEachLimit calls fn(0) to fn(n-1), at most limit at a time, and waits for them
+func forEachLimit(n int, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,79 @@
+package reciever
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+)
+
+func TestSweepBatch(t *testing.T) {
+	s, chain := newSimSweeper(t)
+
+	var wallets []BatchWallet
+	for i := 0; i < 6; i++ {
+		account, privateKey := simchain.Wallet(t, uint32(10+i))
+		wallets = append(wallets, BatchWallet{Account: account, PrivateKey: privateKey})
+		if i != 2 { // wallet 2 received nothing
+			chain.SendToken(t, chain.Token, account.Address, big.NewInt(int64(10+i)))
+		}
+	}
+
+	results := s.SweepBatch(context.Background(), wallets, BatchOptions{MinBalance: big.NewInt(1), Concurrency: 3})
+	assert.Len(t, results, len(wallets))
+
+	var fundingNonces []uint64
+	for i, r := range results {
+		assert.Equal(t, wallets[i].Account.Address, r.Address)
+		assert.NoError(t, r.Err)
+		if i == 2 {
+			assert.True(t, r.Skipped)
+			continue
+		}
+		assert.False(t, r.Skipped)
+		assert.Len(t, r.Results, 1)
+		assert.NotNil(t, r.Results[0].MiddlewareToDestinationTx)
+		assert.Equal(t, uint64(1), r.Results[0].ProviderToMiddlewareReceipt.Status)
+
+		tx, _, err := chain.Client.TransactionByHash(context.Background(), r.Results[0].ProviderToMiddlewareReceipt.TxHash)
+		assert.NoError(t, err)
+		fundingNonces = append(fundingNonces, tx.Nonce())
+	}
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4}, fundingNonces, "funding uses consecutive provider nonces")
+	assert.Equal(t, int64(10+11+13+14+15), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
+
+// A funding that fails to broadcast stops later fundings, which would be stuck behind the nonce gap
+func TestSweepBatchFundingFailure(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	s.client = &failOnce{Backend: chain.Client}
+
+	var wallets []BatchWallet
+	for i := 0; i < 3; i++ {
+		account, privateKey := simchain.Wallet(t, uint32(20+i))
+		wallets = append(wallets, BatchWallet{Account: account, PrivateKey: privateKey})
+		chain.SendToken(t, chain.Token, account.Address, big.NewInt(5))
+	}
+
+	results := s.SweepBatch(context.Background(), wallets, BatchOptions{})
+	for _, r := range results {
+		assert.Error(t, r.Err)
+		for _, result := range r.Results {
+			assert.Nil(t, result.MiddlewareToDestinationTx)
+		}
+	}
+
+	// the next batch rebroadcasts the signed funding and funds the rest after it
+	results = s.SweepBatch(context.Background(), wallets, BatchOptions{})
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+		assert.NotNil(t, r.Results[0].MiddlewareToDestinationTx)
+	}
+	nonce, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), nonce)
+	assert.Equal(t, int64(15), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
@@ -0,0 +1,234 @@
+package reciever
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// minBumpPercent is the fee increase nodes require to replace a pending transaction
+const minBumpPercent = 10
+
+// BumpPolicy controls replacing sweep transactions that sit unmined in the mempool, e.g.
+// after a base fee spike. A stuck transaction is signed again with the same nonce and both
+// tip and fee cap raised by Percent. The zero value never replaces transactions.
+type BumpPolicy struct {
+	After        time.Duration // replace a transaction not mined this long after it was sent
+	Percent      int64         // fee increase per replacement; at least 10
+	MaxBumps     int           // replacements per transaction; defaults to 3
+	MaxFeeCap    *big.Int      // fee cap is never raised past this, if set
+	PollInterval time.Duration // how often receipts are checked; defaults to 1s
+}
+
+func (p BumpPolicy) enabled() bool {
+	return p.After > 0
+}
+
+func (p BumpPolicy) withDefaults() BumpPolicy {
+	if p.Percent < minBumpPercent {
+		p.Percent = minBumpPercent
+	}
+	if p.MaxBumps <= 0 {
+		p.MaxBumps = 3
+	}
+	if p.PollInterval <= 0 {
+		p.PollInterval = time.Second
+	}
+	return p
+}
+
+// fundedFeeCap is the fee cap the middleware wallet is funded for: with bumping enabled,
+// enough for the token transfer to be replaced MaxBumps times.
+func (p BumpPolicy) fundedFeeCap(gasFeeCap *big.Int) *big.Int {
+	if !p.enabled() {
+		return gasFeeCap
+	}
+	p = p.withDefaults()
+	feeCap := gasFeeCap
+	for i := 0; i < p.MaxBumps; i++ {
+		feeCap = bumpFee(feeCap, p.Percent)
+	}
+	if p.MaxFeeCap != nil && feeCap.Cmp(p.MaxFeeCap) > 0 {
+		feeCap = p.MaxFeeCap
+	}
+	if feeCap.Cmp(gasFeeCap) < 0 {
+		return gasFeeCap
+	}
+	return feeCap
+}
+
+var errCannotBump = errors.New("fee cap limit leaves no room for a replacement")
+
+// bumpedFees returns the fees of a replacement for a transaction with the given tip and
+// fee cap, or errCannotBump if maxFeeCap (nil for none) does not allow one.
+func bumpedFees(gasTipCap *big.Int, gasFeeCap *big.Int, percent int64, maxFeeCap *big.Int) (*big.Int, *big.Int, error) {
+	tip := bumpFee(gasTipCap, percent)
+	feeCap := bumpFee(gasFeeCap, percent)
+	if maxFeeCap != nil && feeCap.Cmp(maxFeeCap) > 0 {
+		return nil, nil, errCannotBump
+	}
+	if tip.Cmp(feeCap) > 0 {
+		tip = feeCap
+	}
+	return tip, feeCap, nil
+}
+
+// bumpFee raises fee by percent, by at least 1 wei
+func bumpFee(fee *big.Int, percent int64) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+percent))
+	bumped.Div(bumped, big.NewInt(100))
+	if bumped.Cmp(fee) <= 0 {
+		bumped.Add(fee, big.NewInt(1))
+	}
+	return bumped
+}
+
+// sweepLeg points at the record fields of one of a sweep's two transactions
+type sweepLeg struct {
+	name     string
+	from     common.Address
+	key      *ecdsa.PrivateKey
+	hash     *common.Hash
+	raw      *[]byte
+	replaced *[]common.Hash
+}
+
+func (s *Sweeper) fundingLeg(rec *SweepRecord) *sweepLeg {
+	return &sweepLeg{"funding", s.providerWalletAddress, s.providerWalletPK, &rec.FundingTx, &rec.FundingRawTx, &rec.FundingReplaced}
+}
+
+func tokenLeg(rec *SweepRecord, privateKey *ecdsa.PrivateKey) *sweepLeg {
+	return &sweepLeg{"token", rec.Middleware, privateKey, &rec.TokenTx, &rec.TokenRawTx, &rec.TokenReplaced}
+}
+
+// broadcastAndWait sends a leg's current transaction and waits for it to be mined
+func (s *Sweeper) broadcastAndWait(ctx context.Context, rec *SweepRecord, leg *sweepLeg) (*types.Receipt, error) {
+	if _, err := s.broadcast(ctx, *leg.raw); err != nil {
+		// a transaction this one replaced may have been mined instead
+		if receipt, rerr := s.legReceipt(ctx, leg); rerr == nil && receipt != nil {
+			return receipt, nil
+		}
+		return nil, err
+	}
+	return s.waitMined(ctx, rec, leg)
+}
+
+// waitMined tracks a leg until its transaction, or one it replaced, is mined. Under the
+// bump policy a transaction pending for too long is replaced, and the replaced hash is
+// recorded against the sweep.
+func (s *Sweeper) waitMined(ctx context.Context, rec *SweepRecord, leg *sweepLeg) (*types.Receipt, error) {
+	policy := s.bump.withDefaults()
+	ticker := time.NewTicker(policy.PollInterval)
+	defer ticker.Stop()
+
+	sentAt := time.Now()
+	bumps := 0
+	for {
+		receipt, err := s.legReceipt(ctx, leg)
+		if err != nil {
+			log.Printf("sweep %s: checking %s receipt: %v", rec.ID, leg.name, err)
+		} else if receipt != nil {
+			return receipt, nil
+		}
+
+		if s.bump.enabled() && bumps < policy.MaxBumps && time.Since(sentAt) >= policy.After {
+			err := s.replace(ctx, rec, leg, policy)
+			if err == nil {
+				bumps++
+				sentAt = time.Now()
+			} else if errors.Is(err, errCannotBump) {
+				bumps = policy.MaxBumps // keep waiting on what is out
+			} else {
+				log.Printf("sweep %s: replacing %s transaction: %v", rec.ID, leg.name, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// legReceipt returns the receipt of whichever of the leg's transactions was mined, or nil
+func (s *Sweeper) legReceipt(ctx context.Context, leg *sweepLeg) (*types.Receipt, error) {
+	hashes := append([]common.Hash{*leg.hash}, *leg.replaced...)
+	for _, hash := range hashes {
+		receipt, err := s.client.TransactionReceipt(ctx, hash)
+		if err == nil {
+			return receipt, nil
+		} else if !errors.Is(err, ethereum.NotFound) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// replace signs the leg's transaction again with the same nonce and higher fees, records
+// it and broadcasts it
+func (s *Sweeper) replace(ctx context.Context, rec *SweepRecord, leg *sweepLeg, policy BumpPolicy) error {
+	old := new(types.Transaction)
+	if err := old.UnmarshalBinary(*leg.raw); err != nil {
+		return err
+	}
+
+	maxFeeCap := policy.MaxFeeCap
+	if leg.from == rec.Middleware {
+		// the middleware wallet can only pay what it was funded with
+		balance, err := s.client.BalanceAt(ctx, rec.Middleware, nil)
+		if err != nil {
+			return err
+		}
+		spendable := new(big.Int).Sub(balance, old.Value())
+		if rec.DataFee != nil {
+			spendable.Sub(spendable, rec.DataFee)
+		}
+		affordable := new(big.Int).Div(spendable, new(big.Int).SetUint64(old.Gas()))
+		if maxFeeCap == nil || affordable.Cmp(maxFeeCap) < 0 {
+			maxFeeCap = affordable
+		}
+	}
+	tip, feeCap, err := bumpedFees(old.GasTipCap(), old.GasFeeCap(), policy.Percent, maxFeeCap)
+	if err != nil {
+		return err
+	}
+
+	chainID, err := s.client.ChainID(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := types.SignTx(util.NewTx(chainID, old.Nonce(), &util.TxInput{
+		Type:       util.TxTypeOf(old),
+		To:         *old.To(),
+		Amount:     old.Value(),
+		GasFeeCap:  feeCap,
+		GasTipCap:  tip,
+		GasUnit:    old.Gas(),
+		Data:       old.Data(),
+		AccessList: old.AccessList(),
+	}), types.LatestSignerForChainID(chainID), leg.key)
+	if err != nil {
+		return err
+	}
+
+	*leg.replaced = append(*leg.replaced, old.Hash())
+	if err := s.recordTx(rec, tx, leg.hash, leg.raw); err != nil {
+		return err
+	}
+	log.Printf("sweep %s: replaced %s transaction %s with %s (fee cap %s)", rec.ID, leg.name, old.Hash().Hex(), tx.Hash().Hex(), feeCap)
+	if _, err := s.broadcast(ctx, *leg.raw); err != nil {
+		return fmt.Errorf("broadcasting replacement: %w", err)
+	}
+	return nil
+}
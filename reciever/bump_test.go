@@ -0,0 +1,69 @@
+package reciever
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+)
+
+func TestBumpedFees(t *testing.T) {
+	tip, feeCap, err := bumpedFees(big.NewInt(100), big.NewInt(1000), 10, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110), tip.Int64())
+	assert.Equal(t, int64(1100), feeCap.Int64())
+
+	// tiny fees still go up
+	tip, _, err = bumpedFees(big.NewInt(1), big.NewInt(5), 10, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), tip.Int64())
+
+	_, _, err = bumpedFees(big.NewInt(100), big.NewInt(1000), 10, big.NewInt(1050))
+	assert.ErrorIs(t, err, errCannotBump)
+
+	policy := BumpPolicy{After: time.Minute, Percent: 10, MaxBumps: 2}
+	assert.Equal(t, int64(1210), policy.fundedFeeCap(big.NewInt(1000)).Int64())
+	policy.MaxFeeCap = big.NewInt(1100)
+	assert.Equal(t, int64(1100), policy.fundedFeeCap(big.NewInt(1000)).Int64())
+	assert.Equal(t, int64(1000), BumpPolicy{}.fundedFeeCap(big.NewInt(1000)).Int64())
+}
+
+// A funding transaction left pending is replaced, and the sweep completes with the replacement
+func TestSweepBumpsStuckFunding(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	s.bump = BumpPolicy{After: 50 * time.Millisecond, Percent: 20, PollInterval: 10 * time.Millisecond}
+	middlewareWallet, privateKey := simchain.Wallet(t, 5)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	chain.Client.SetAutoMine(false)
+	type sweep struct {
+		result *PaymentResult
+		err    error
+	}
+	done := make(chan sweep, 1)
+	go func() {
+		result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+		done <- sweep{result, err}
+	}()
+
+	// mine once the funding has been replaced
+	assert.Eventually(t, func() bool {
+		recs, err := s.journal.Unfinished()
+		return err == nil && len(recs) == 1 && len(recs[0].FundingReplaced) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	chain.Client.SetAutoMine(true)
+	chain.Backend.Commit()
+
+	got := <-done
+	assert.NoError(t, got.err)
+	rec, err := s.journal.Get(got.result.SweepID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rec.FundingReplaced)
+	assert.NotContains(t, rec.FundingReplaced, rec.FundingTx)
+	assert.Equal(t, rec.FundingTx, got.result.ProviderToMiddlewareReceipt.TxHash)
+	assert.Equal(t, uint64(1), got.result.ProviderToMiddlewareReceipt.Status)
+	assert.NotNil(t, got.result.MiddlewareToDestinationTx)
+}
@@ -0,0 +1,137 @@
+package reciever
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+type DustOptions struct {
+	MinAmount   *big.Int    // ETH worth returning, after paying for the transfer; defaults to 1 wei
+	Concurrency int         // wallets checked at once
+	Fees        FeeStrategy // prices the transfers; defaults to the sweeper's strategy
+}
+
+// DustResult is what happened to one wallet's leftover ETH.
+type DustResult struct {
+	Address common.Address
+	ChainID uint64
+	Amount  *big.Int           // ETH returned to the provider wallet
+	Tx      *types.Transaction // nil if nothing was returned
+	Skipped bool               // too little ETH, a sweep of the wallet is unfinished or in progress, or a transaction of it is pending
+	Err     error
+}
+
+// RecoverDust returns the ETH left in middleware wallets by earlier sweeps to the provider
+// wallet. A wallet is drained when its balance exceeds the cost of the 21000 gas transfer,
+// with any data fee of the sweeper's fee model, by at least MinAmount; wallets with an
+// unfinished sweep keep their ETH for it. Results are in the order of wallets.
+//
+// Unlike sweeps, the transfers are not journaled: a transfer is a single transaction of
+// ETH alone, so there is no later step to resume, and its effect is read back from the
+// chain. A wallet with a transaction still pending, such as the transfer of an earlier
+// run, is skipped rather than drained again on its stale balance.
+func (s *Sweeper) RecoverDust(ctx context.Context, wallets []BatchWallet, opts DustOptions) []DustResult {
+	if opts.MinAmount == nil {
+		opts.MinAmount = big.NewInt(1)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultBatchConcurrency
+	}
+
+	results := make([]DustResult, len(wallets))
+	chainID, err := s.ChainID(ctx)
+	var fees *Fees
+	if err == nil {
+		fees, err = s.quoteFees(ctx, opts.Fees)
+	}
+	if err == nil && s.native() {
+		err = errors.New("a native sweeper sweeps ETH rather than leaving dust")
+	}
+	if err != nil {
+		for i, w := range wallets {
+			results[i] = DustResult{Address: w.Account.Address, ChainID: chainID, Amount: big.NewInt(0), Err: err}
+		}
+		return results
+	}
+	transferCost := new(big.Int).Mul(fees.GasFeeCap, big.NewInt(fundingGas))
+
+	forEachLimit(len(wallets), opts.Concurrency, func(i int) {
+		results[i] = s.recoverDust(ctx, wallets[i], fees, transferCost, opts.MinAmount)
+		results[i].ChainID = chainID
+	})
+	return results
+}
+
+func (s *Sweeper) recoverDust(ctx context.Context, w BatchWallet, fees *Fees, transferCost *big.Int, minAmount *big.Int) DustResult {
+	result := DustResult{Address: w.Account.Address, Amount: big.NewInt(0)}
+	unlock, err := s.lockWallet(w.Account.Address)
+	if err != nil {
+		// the sweep in progress needs the ETH
+		result.Skipped = true
+		return result
+	}
+	defer unlock()
+	recs, err := s.unfinishedSweeps(ctx, w.Account.Address, s.tokens)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if len(recs) > 0 {
+		result.Skipped = true
+		return result
+	}
+	pending, err := s.client.PendingNonceAt(ctx, w.Account.Address)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	mined, err := s.client.NonceAt(ctx, w.Account.Address, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if pending > mined {
+		result.Skipped = true
+		return result
+	}
+
+	balance, err := s.client.BalanceAt(ctx, w.Account.Address, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	// e.g. the L1 data fee on OP-stack chains, charged on top of the gas
+	dataFee, err := s.dataFee(ctx, w.Account.Address, s.providerWalletAddress, balance, nil, fundingGas, fees)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	amount := new(big.Int).Sub(balance, transferCost)
+	amount.Sub(amount, dataFee)
+	if amount.Sign() <= 0 || amount.Cmp(minAmount) < 0 {
+		result.Skipped = true
+		return result
+	}
+
+	result.Tx, result.Err = util.SendTx(&util.TxInput{
+		Client:     s.client,
+		Type:       fees.TxType,
+		From:       w.Account.Address,
+		To:         s.providerWalletAddress,
+		Amount:     amount,
+		GasTipCap:  fees.GasTipCap,
+		GasFeeCap:  fees.GasFeeCap,
+		GasUnit:    fundingGas,
+		PrivateKey: w.PrivateKey,
+	})
+	if result.Err == nil {
+		result.Amount = amount
+	}
+	return result
+}
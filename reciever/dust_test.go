@@ -0,0 +1,140 @@
+package reciever
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+)
+
+func TestRecoverDust(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	account, privateKey := simchain.Wallet(t, 8)
+	empty, emptyKey := simchain.Wallet(t, 9)
+	chain.SendToken(t, chain.Token, account.Address, big.NewInt(20))
+
+	// sweeping leaves the unused part of the gas funding behind
+	_, err := s.SweepMiddleware(account, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	_, err = s.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) {
+		return privateKey, nil
+	})
+	assert.NoError(t, err)
+	leftover := chain.Balance(t, account.Address)
+	assert.Positive(t, leftover.Sign())
+
+	provider := chain.Balance(t, s.providerWalletAddress)
+	results := s.RecoverDust(context.Background(), []BatchWallet{
+		{Account: account, PrivateKey: privateKey},
+		{Account: empty, PrivateKey: emptyKey},
+	}, DustOptions{})
+
+	assert.NoError(t, results[0].Err)
+	assert.NotNil(t, results[0].Tx)
+	assert.Positive(t, results[0].Amount.Sign())
+	assert.Equal(t, new(big.Int).Add(provider, results[0].Amount), chain.Balance(t, s.providerWalletAddress))
+	assert.True(t, results[1].Skipped)
+	assert.Nil(t, results[1].Tx)
+}
+
+// A transfer still pending is not sent again by a later run
+func TestRecoverDustPending(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	account, privateKey := simchain.Wallet(t, 36)
+	chain.SendETH(t, account.Address, big.NewInt(1e16))
+	wallets := []BatchWallet{{Account: account, PrivateKey: privateKey}}
+
+	chain.Client.SetAutoMine(false)
+	first := s.RecoverDust(context.Background(), wallets, DustOptions{})
+	assert.NoError(t, first[0].Err)
+	assert.NotNil(t, first[0].Tx)
+
+	again := s.RecoverDust(context.Background(), wallets, DustOptions{})
+	assert.NoError(t, again[0].Err)
+	assert.True(t, again[0].Skipped)
+	assert.Nil(t, again[0].Tx)
+
+	chain.Client.SetAutoMine(true)
+	chain.Backend.Commit()
+	receipt, err := chain.Client.TransactionReceipt(context.Background(), first[0].Tx.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), receipt.Status)
+}
+
+// ETH already in the middleware wallet reduces, or replaces, the gas funding
+func TestSweepReusesLeftover(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	account, privateKey := simchain.Wallet(t, 11)
+	chain.SendToken(t, chain.Token, account.Address, big.NewInt(20))
+	chain.SendETH(t, account.Address, big.NewInt(1_000_000))
+
+	result, err := s.SweepMiddleware(account, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	rec, err := s.journal.Get(result.SweepID)
+	assert.NoError(t, err)
+	needed := new(big.Int).Mul(rec.GasFeeCap, new(big.Int).SetUint64(rec.GasUnit))
+	assert.Equal(t, new(big.Int).Sub(needed, big.NewInt(1_000_000)), rec.FundingAmount)
+	assert.Equal(t, FundingTopUp, result.FundingPath)
+	assert.Equal(t, rec.FundingAmount, result.FundingAmount)
+
+	// plenty of ETH: nothing is funded
+	account, privateKey = simchain.Wallet(t, 12)
+	chain.SendToken(t, chain.Token, account.Address, big.NewInt(20))
+	chain.SendETH(t, account.Address, big.NewInt(1_000_000_000_000_000))
+	nonce, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+
+	result, err = s.SweepMiddleware(account, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Equal(t, FundingSkipped, result.FundingPath)
+	assert.Nil(t, result.ProviderToMiddlewareReceipt)
+	assert.NotNil(t, result.MiddlewareToDestinationTx)
+	after, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+	assert.Equal(t, nonce, after)
+	assert.Equal(t, int64(40), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
+
+// On an OP-stack chain the transfer's L1 data fee stays behind as well as its gas
+func TestRecoverDustDataFee(t *testing.T) {
+	chain := newOPStackChain(t)
+	providerKey, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	s, err := NewSweeper(Config{
+		Client:       chain.Client,
+		TokenAddress: chain.Token,
+		ProviderKey:  providerKey,
+		Destination:  common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+		FeeModel:     OPStackFees{},
+	})
+	assert.NoError(t, err)
+	dusty, dustyKey := simchain.Wallet(t, 28)
+	short, shortKey := simchain.Wallet(t, 29)
+	fees := FixedFees{GasTipCap: big.NewInt(1_000_000_000), GasFeeCap: big.NewInt(100_000_000_000)}
+	transferCost := new(big.Int).Mul(fees.GasFeeCap, big.NewInt(fundingGas))
+	chain.SendETH(t, dusty.Address, big.NewInt(1e16))
+	// enough for the gas, not for the data fee of ~100 bytes at 1 gwei each
+	chain.SendETH(t, short.Address, new(big.Int).Add(transferCost, big.NewInt(1_000_000_000)))
+
+	results := s.RecoverDust(context.Background(), []BatchWallet{
+		{Account: dusty, PrivateKey: dustyKey},
+		{Account: short, PrivateKey: shortKey},
+	}, DustOptions{Fees: fees})
+
+	assert.NoError(t, results[0].Err)
+	if assert.NotNil(t, results[0].Tx) {
+		left := new(big.Int).Sub(big.NewInt(1e16), results[0].Amount)
+		dataFee := new(big.Int).Sub(left, transferCost)
+		assert.Positive(t, dataFee.Sign())
+		assert.Zero(t, new(big.Int).Rem(dataFee, big.NewInt(1_000_000_000)).Sign())
+	}
+	assert.NoError(t, results[1].Err)
+	assert.True(t, results[1].Skipped)
+	assert.Nil(t, results[1].Tx)
+}
@@ -0,0 +1,92 @@
+package reciever
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// FeeModel prices what a chain charges a transaction on top of its execution gas, such
+// as the L1 data fee of a rollup. A nil FeeModel charges nothing more.
+type FeeModel interface {
+	// DataFee returns the fee of the unsigned transaction tx beyond gas times gas price.
+	DataFee(ctx context.Context, client util.Backend, tx *types.Transaction) (*big.Int, error)
+}
+
+// GasPriceOracleAddress is the OP-stack predeploy quoting L1 data fees.
+var GasPriceOracleAddress = common.HexToAddress("0x420000000000000000000000000000000000000F")
+
+var gasPriceOracleABI = mustParseABI(`[{"name":"getL1Fee","type":"function","stateMutability":"view",
+	"inputs":[{"name":"_data","type":"bytes"}],"outputs":[{"name":"","type":"uint256"}]}]`)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// OPStackFees charges the L1 data fee the GasPriceOracle of an OP-stack chain quotes for
+// the serialized transaction.
+type OPStackFees struct {
+	Oracle common.Address // defaults to GasPriceOracleAddress
+}
+
+func (m OPStackFees) DataFee(ctx context.Context, client util.Backend, tx *types.Transaction) (*big.Int, error) {
+	oracle := m.Oracle
+	if oracle == (common.Address{}) {
+		oracle = GasPriceOracleAddress
+	}
+	serialized, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data, err := gasPriceOracleABI.Pack("getL1Fee", serialized)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &oracle, Data: data}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getL1Fee: %w", err)
+	}
+	values, err := gasPriceOracleABI.Unpack("getL1Fee", out)
+	if err != nil {
+		return nil, fmt.Errorf("getL1Fee: %w", err)
+	}
+	return values[0].(*big.Int), nil
+}
+
+// dataFee quotes the fee model's charge for a transaction from the middleware wallet, or
+// zero without a fee model
+func (s *Sweeper) dataFee(ctx context.Context, middleware common.Address, to common.Address, value *big.Int, data []byte, gasUnit uint64, fees *Fees) (*big.Int, error) {
+	if s.feeModel == nil {
+		return big.NewInt(0), nil
+	}
+	chainID, err := s.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := s.client.PendingNonceAt(ctx, middleware)
+	if err != nil {
+		return nil, err
+	}
+	tx := util.NewTx(new(big.Int).SetUint64(chainID), nonce, &util.TxInput{
+		Type:      fees.TxType,
+		To:        to,
+		Amount:    value,
+		GasFeeCap: fees.GasFeeCap,
+		GasTipCap: fees.GasTipCap,
+		GasUnit:   gasUnit,
+		Data:      data,
+	})
+	return s.feeModel.DataFee(ctx, s.client, tx)
+}
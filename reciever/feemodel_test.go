@@ -0,0 +1,75 @@
+package reciever
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+// gasPriceOracleStandIn quotes 1 gwei per byte of the transaction passed to getL1Fee:
+//
+//	PUSH1 0x24 CALLDATALOAD       // length of the bytes argument
+//	PUSH4 1e9 MUL PUSH1 0 MSTORE  // times 1 gwei, into memory
+//	PUSH1 32 PUSH1 0 RETURN
+var gasPriceOracleStandIn = common.FromHex("602435633b9aca000260005260206000f3")
+
+func newOPStackChain(t *testing.T) *simchain.Chain {
+	return simchain.NewWithAlloc(t, types.GenesisAlloc{
+		GasPriceOracleAddress: {Code: gasPriceOracleStandIn, Balance: big.NewInt(0)},
+	})
+}
+
+func TestOPStackFees(t *testing.T) {
+	chain := newOPStackChain(t)
+	to := common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   simchain.ChainID,
+		To:        &to,
+		Value:     big.NewInt(0),
+		GasFeeCap: big.NewInt(2_000_000_000),
+		GasTipCap: big.NewInt(1_000_000_000),
+		Gas:       65000,
+		Data:      util.BuildTokenTxDataField(to, big.NewInt(20)),
+	})
+	serialized, err := tx.MarshalBinary()
+	assert.NoError(t, err)
+
+	fee, err := OPStackFees{}.DataFee(context.Background(), chain.Client, tx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(serialized))*1_000_000_000, fee.Int64())
+
+	// no oracle deployed there
+	_, err = OPStackFees{Oracle: common.HexToAddress("0x01")}.DataFee(context.Background(), chain.Client, tx)
+	assert.Error(t, err)
+}
+
+// On an OP-stack chain the funding covers the token transfer's L1 data fee as well as its gas
+func TestSweepMiddlewareDataFee(t *testing.T) {
+	chain := newOPStackChain(t)
+	providerKey := chain.FundedKey(t, big.NewInt(1e18))
+	s, err := NewSweeper(Config{
+		Client:       chain.Client,
+		TokenAddress: chain.Token,
+		ProviderKey:  providerKey,
+		Destination:  common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+		FeeModel:     OPStackFees{},
+	})
+	assert.NoError(t, err)
+	middlewareWallet, privateKey := simchain.Wallet(t, 17)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Positive(t, result.DataFee.Sign())
+	assert.Zero(t, new(big.Int).Rem(result.DataFee, big.NewInt(1_000_000_000)).Sign())
+	gasFee := new(big.Int).Mul(result.GasFeeCap, new(big.Int).SetUint64(result.GasUnit))
+	assert.Equal(t, new(big.Int).Add(gasFee, result.DataFee), result.FundingAmount)
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
@@ -0,0 +1,185 @@
+package reciever
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// Fees are the fees a sweep's transactions are signed with. On chains without a base fee
+// (before London) they are legacy transactions paying GasFeeCap as their gas price, with
+// GasTipCap the same and BaseFee nil.
+type Fees struct {
+	TxType    util.TxType
+	BaseFee   *big.Int // base fee the fees were priced against
+	GasTipCap *big.Int
+	GasFeeCap *big.Int
+}
+
+// FeeSource is the part of a Backend fee strategies read from.
+type FeeSource interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error)
+}
+
+// FeeStrategy decides the fees of a sweep. The same fees are used for both of its
+// transactions, so the middleware wallet is funded for exactly what it pays.
+type FeeStrategy interface {
+	Fees(ctx context.Context, client FeeSource) (*Fees, error)
+}
+
+// DefaultFeeStrategy is used by sweepers configured without one.
+var DefaultFeeStrategy FeeStrategy = BaseFeeMultiple{Multiplier: 2}
+
+// BaseFeeMultiple pays the node's suggested tip, with a fee cap of Multiplier times the
+// latest base fee plus the tip. A multiplier of 2 keeps the transaction valid through six
+// consecutive full blocks, each raising the base fee by 12.5%. Without a base fee it
+// pays the node's suggested gas price.
+type BaseFeeMultiple struct {
+	Multiplier int64
+}
+
+func (b BaseFeeMultiple) Fees(ctx context.Context, client FeeSource) (*Fees, error) {
+	if b.Multiplier < 1 {
+		return nil, fmt.Errorf("base fee multiplier %d is below 1", b.Multiplier)
+	}
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header.BaseFee == nil {
+		return gasPriceFees(ctx, client)
+	}
+	gasTipCap, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return feesFor(header.BaseFee, b.Multiplier, gasTipCap), nil
+}
+
+// FeeHistory prices the tip at a percentile of the tips paid in recent blocks, as
+// reported by eth_feeHistory, with a fee cap of twice the next block's base fee plus the tip.
+// Without a base fee it pays the node's suggested gas price.
+type FeeHistory struct {
+	Percentile float64 // of the tips paid in each block, 0 to 100
+	Blocks     uint64  // recent blocks to look at; defaults to 20
+}
+
+// Fee history presets, from cheap and possibly slow to expensive and likely in the next block.
+var (
+	SlowFees     = FeeHistory{Percentile: 10}
+	StandardFees = FeeHistory{Percentile: 50}
+	FastFees     = FeeHistory{Percentile: 90}
+)
+
+func (f FeeHistory) Fees(ctx context.Context, client FeeSource) (*Fees, error) {
+	if f.Percentile < 0 || f.Percentile > 100 {
+		return nil, fmt.Errorf("fee history percentile %v is out of range", f.Percentile)
+	}
+	blocks := f.Blocks
+	if blocks == 0 {
+		blocks = 20
+	}
+	history, err := client.FeeHistory(ctx, blocks, nil, []float64{f.Percentile})
+	if err != nil {
+		return nil, err
+	}
+	if len(history.BaseFee) == 0 {
+		return nil, fmt.Errorf("fee history has no base fees")
+	}
+	// the last base fee is that of the block after the newest one
+	nextBaseFee := history.BaseFee[len(history.BaseFee)-1]
+	if nextBaseFee.Sign() == 0 {
+		return gasPriceFees(ctx, client) // reported as zero before London
+	}
+
+	// blocks without transactions report a zero tip, which says nothing about the market
+	var tips []*big.Int
+	for i, reward := range history.Reward {
+		if len(reward) > 0 && i < len(history.GasUsedRatio) && history.GasUsedRatio[i] > 0 {
+			tips = append(tips, reward[0])
+		}
+	}
+	var gasTipCap *big.Int
+	if len(tips) == 0 {
+		if gasTipCap, err = client.SuggestGasTipCap(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		sort.Slice(tips, func(a, b int) bool { return tips[a].Cmp(tips[b]) < 0 })
+		gasTipCap = tips[len(tips)/2]
+	}
+	return feesFor(nextBaseFee, 2, gasTipCap), nil
+}
+
+// FixedFees pays the given tip and fee cap whatever the network conditions. Without a
+// base fee the fee cap is the gas price.
+type FixedFees struct {
+	GasTipCap *big.Int
+	GasFeeCap *big.Int
+}
+
+func (f FixedFees) Fees(ctx context.Context, client FeeSource) (*Fees, error) {
+	if f.GasTipCap == nil || f.GasFeeCap == nil {
+		return nil, fmt.Errorf("fixed fees are not set")
+	}
+	if f.GasTipCap.Cmp(f.GasFeeCap) > 0 {
+		return nil, fmt.Errorf("tip %s is above fee cap %s", f.GasTipCap, f.GasFeeCap)
+	}
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header.BaseFee == nil {
+		return &Fees{TxType: util.LegacyTx, GasTipCap: f.GasFeeCap, GasFeeCap: f.GasFeeCap}, nil
+	}
+	return &Fees{BaseFee: header.BaseFee, GasTipCap: f.GasTipCap, GasFeeCap: f.GasFeeCap}, nil
+}
+
+// CappedFees limits the fees of another strategy. A nil cap is no limit.
+type CappedFees struct {
+	Strategy     FeeStrategy
+	MaxGasTipCap *big.Int
+	MaxGasFeeCap *big.Int
+}
+
+func (c CappedFees) Fees(ctx context.Context, client FeeSource) (*Fees, error) {
+	fees, err := c.Strategy.Fees(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxGasFeeCap != nil && fees.GasFeeCap.Cmp(c.MaxGasFeeCap) > 0 {
+		fees.GasFeeCap = c.MaxGasFeeCap
+	}
+	if c.MaxGasTipCap != nil && fees.GasTipCap.Cmp(c.MaxGasTipCap) > 0 {
+		fees.GasTipCap = c.MaxGasTipCap
+	}
+	if fees.GasTipCap.Cmp(fees.GasFeeCap) > 0 || fees.TxType != util.DynamicFeeTx {
+		fees.GasTipCap = fees.GasFeeCap
+	}
+	return fees, nil
+}
+
+// gasPriceFees pays the node's suggested gas price in a legacy transaction
+func gasPriceFees(ctx context.Context, client FeeSource) (*Fees, error) {
+	gasPrice, err := client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Fees{TxType: util.LegacyTx, GasTipCap: gasPrice, GasFeeCap: gasPrice}, nil
+}
+
+// feesFor pays gasTipCap with a fee cap of multiplier times baseFee plus the tip
+func feesFor(baseFee *big.Int, multiplier int64, gasTipCap *big.Int) *Fees {
+	gasFeeCap := new(big.Int).Mul(baseFee, big.NewInt(multiplier))
+	gasFeeCap.Add(gasFeeCap, gasTipCap)
+	return &Fees{BaseFee: baseFee, GasTipCap: gasTipCap, GasFeeCap: gasFeeCap}
+}
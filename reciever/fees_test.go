@@ -0,0 +1,168 @@
+package reciever
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+// feeNode is a FeeSource with canned answers
+type feeNode struct {
+	baseFee  *big.Int
+	tip      *big.Int
+	gasPrice *big.Int
+	history  *ethereum.FeeHistory
+}
+
+func (n *feeNode) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{BaseFee: n.baseFee}, nil
+}
+
+func (n *feeNode) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return n.tip, nil
+}
+
+func (n *feeNode) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return n.gasPrice, nil
+}
+
+func (n *feeNode) FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error) {
+	return n.history, nil
+}
+
+func TestFeeStrategies(t *testing.T) {
+	node := &feeNode{
+		baseFee: big.NewInt(100),
+		tip:     big.NewInt(3),
+		history: &ethereum.FeeHistory{
+			Reward:       [][]*big.Int{{big.NewInt(5)}, {big.NewInt(0)}, {big.NewInt(9)}, {big.NewInt(7)}},
+			BaseFee:      []*big.Int{big.NewInt(90), big.NewInt(95), big.NewInt(100), big.NewInt(105), big.NewInt(110)},
+			GasUsedRatio: []float64{0.5, 0, 0.7, 0.9},
+		},
+	}
+	ctx := context.Background()
+
+	fees, err := BaseFeeMultiple{Multiplier: 2}.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), fees.GasTipCap.Int64())
+	assert.Equal(t, int64(203), fees.GasFeeCap.Int64())
+
+	// median of the tips of non-empty blocks, priced against the next base fee
+	fees, err = StandardFees.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110), fees.BaseFee.Int64())
+	assert.Equal(t, int64(7), fees.GasTipCap.Int64())
+	assert.Equal(t, int64(227), fees.GasFeeCap.Int64())
+
+	// no busy blocks: fall back to the node's suggestion
+	node.history.GasUsedRatio = []float64{0, 0, 0, 0}
+	fees, err = StandardFees.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), fees.GasTipCap.Int64())
+
+	fees, err = FixedFees{GasTipCap: big.NewInt(2), GasFeeCap: big.NewInt(500)}.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), fees.GasTipCap.Int64())
+	assert.Equal(t, int64(500), fees.GasFeeCap.Int64())
+	_, err = FixedFees{GasTipCap: big.NewInt(600), GasFeeCap: big.NewInt(500)}.Fees(ctx, node)
+	assert.Error(t, err)
+
+	fees, err = CappedFees{Strategy: BaseFeeMultiple{Multiplier: 2}, MaxGasFeeCap: big.NewInt(150)}.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(150), fees.GasFeeCap.Int64())
+	assert.Equal(t, int64(3), fees.GasTipCap.Int64())
+}
+
+// Chains without a base fee get legacy transactions at a gas price
+func TestFeeStrategiesLegacy(t *testing.T) {
+	node := &feeNode{
+		tip:      big.NewInt(3),
+		gasPrice: big.NewInt(40),
+		history: &ethereum.FeeHistory{
+			Reward:       [][]*big.Int{{big.NewInt(5)}},
+			BaseFee:      []*big.Int{big.NewInt(0), big.NewInt(0)},
+			GasUsedRatio: []float64{0.5},
+		},
+	}
+	ctx := context.Background()
+
+	for _, strategy := range []FeeStrategy{DefaultFeeStrategy, StandardFees} {
+		fees, err := strategy.Fees(ctx, node)
+		assert.NoError(t, err)
+		assert.Equal(t, util.LegacyTx, fees.TxType)
+		assert.Nil(t, fees.BaseFee)
+		assert.Equal(t, int64(40), fees.GasFeeCap.Int64())
+		assert.Equal(t, int64(40), fees.GasTipCap.Int64())
+	}
+
+	fees, err := FixedFees{GasTipCap: big.NewInt(2), GasFeeCap: big.NewInt(500)}.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, util.LegacyTx, fees.TxType)
+	assert.Equal(t, int64(500), fees.GasTipCap.Int64())
+
+	fees, err = CappedFees{Strategy: DefaultFeeStrategy, MaxGasFeeCap: big.NewInt(30)}.Fees(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), fees.GasFeeCap.Int64())
+	assert.Equal(t, int64(30), fees.GasTipCap.Int64())
+
+	// the profit policy prices gas at the gas price
+	deferral, err := ProfitPolicy{MaxCost: big.NewInt(40 * 86000)}.check(ctx, common.HexToAddress("0x01"), big.NewInt(1), fees, 65000, big.NewInt(0), true)
+	assert.NoError(t, err)
+	assert.Nil(t, deferral)
+}
+
+// A sweep priced for legacy transactions sends both of them as legacy transactions
+func TestSweepMiddlewareLegacy(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 18)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+	gasPrice, err := chain.Client.SuggestGasPrice(context.Background())
+	assert.NoError(t, err)
+	gasPrice.Mul(gasPrice, big.NewInt(2))
+
+	result, err := s.SweepMiddlewareWithFees(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0), legacyFees{gasPrice})
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(types.LegacyTxType), result.MiddlewareToDestinationTx.Type())
+	assert.Equal(t, gasPrice, result.MiddlewareToDestinationTx.GasPrice())
+	funding, _, err := chain.Client.TransactionByHash(context.Background(), result.ProviderToMiddlewareReceipt.TxHash)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(types.LegacyTxType), funding.Type())
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
+
+// legacyFees prices legacy transactions, as the strategies do on chains without a base fee
+type legacyFees struct {
+	gasPrice *big.Int
+}
+
+func (l legacyFees) Fees(ctx context.Context, client FeeSource) (*Fees, error) {
+	return &Fees{TxType: util.LegacyTx, GasTipCap: l.gasPrice, GasFeeCap: l.gasPrice}, nil
+}
+
+// The chosen strategy prices the sweep and its fees are reported in the result
+func TestSweepMiddlewareWithFees(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 6)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	header, err := chain.Client.HeaderByNumber(context.Background(), nil)
+	assert.NoError(t, err)
+	tip, err := chain.Client.SuggestGasTipCap(context.Background())
+	assert.NoError(t, err)
+	feeCap := new(big.Int).Add(new(big.Int).Mul(header.BaseFee, big.NewInt(3)), tip)
+
+	result, err := s.SweepMiddlewareWithFees(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0), FixedFees{GasTipCap: tip, GasFeeCap: feeCap})
+	assert.NoError(t, err)
+	assert.Equal(t, feeCap, result.GasFeeCap)
+	assert.Equal(t, tip, result.GasTipCap)
+	assert.Equal(t, feeCap, result.MiddlewareToDestinationTx.GasFeeCap())
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
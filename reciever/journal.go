@@ -0,0 +1,228 @@
+package reciever
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// SweepState is the step a sweep has reached. A sweep moves
+// planned -> gas-funded -> token-sent -> confirmed, or ends in failed.
+type SweepState string
+
+const (
+	StatePlanned   SweepState = "planned"    // amount and fees decided, gas not funded yet
+	StateGasFunded SweepState = "gas-funded" // provider to middleware transaction mined
+	StateTokenSent SweepState = "token-sent" // middleware to destination transaction broadcast
+	StateConfirmed SweepState = "confirmed"  // middleware to destination transaction mined
+	StateFailed    SweepState = "failed"     // a transaction reverted
+)
+
+// Done reports whether the sweep needs no more work.
+func (st SweepState) Done() bool {
+	return st == StateConfirmed || st == StateFailed
+}
+
+// SweepRecord is the persisted state of one sweep. Signed transactions are stored before
+// they are broadcast, so a restarted process rebroadcasts the same transaction (same
+// nonce) instead of signing a new one.
+type SweepRecord struct {
+	ID          string
+	ChainID     uint64
+	State       SweepState
+	Middleware  common.Address
+	Token       common.Address // zero for native ETH sweeps
+	Destination common.Address
+	Amount      *big.Int // token amount to sweep
+
+	TxType        util.TxType // of both transactions
+	BaseFee       *big.Int    // nil for legacy transactions
+	GasTipCap     *big.Int
+	GasFeeCap     *big.Int
+	GasUnit       uint64
+	DataFee       *big.Int // of the token transfer beyond its gas, e.g. an L1 data fee; nil before fee models
+	FundingAmount *big.Int // ETH sent from provider to middleware
+	FundingPath   FundingPath
+	FundedBy      string // ID of the sweep of the same wallet whose funding pays for this one, if any
+	Flag          string // why the sweep needs review, e.g. a deposit it swept was reorged out; empty if none
+
+	FundingTx       common.Hash
+	FundingRawTx    []byte
+	FundingReplaced []common.Hash // earlier funding transactions replaced for higher fees
+	TokenTx         common.Hash
+	TokenRawTx      []byte
+	TokenReplaced   []common.Hash // earlier token transactions replaced for higher fees
+	Block           uint64        // the token transaction was mined in, once confirmed
+
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// FundingPath is how a middleware wallet gets the ETH for its token transfer.
+type FundingPath string
+
+const (
+	FundingFull    FundingPath = "full"    // the provider sends all of it
+	FundingTopUp   FundingPath = "top-up"  // the provider sends what the wallet's own ETH falls short of
+	FundingSkipped FundingPath = "skipped" // the wallet's own ETH is enough (always for native sweeps), nothing is sent
+)
+
+// Journal persists sweep records.
+type Journal interface {
+	// Save inserts or replaces the record with the same ID.
+	Save(rec *SweepRecord) error
+	Get(id string) (*SweepRecord, error)
+	// Unfinished returns records that are neither confirmed nor failed, oldest first.
+	Unfinished() ([]*SweepRecord, error)
+	// ByMiddleware returns the records of sweeps out of a middleware wallet, oldest first.
+	ByMiddleware(middleware common.Address) ([]*SweepRecord, error)
+}
+
+var ErrSweepNotFound = errors.New("sweep not found")
+
+// MemoryJournal keeps records in memory. It does not survive a restart.
+type MemoryJournal struct {
+	mu      sync.Mutex
+	records map[string]*SweepRecord
+}
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{records: make(map[string]*SweepRecord)}
+}
+
+func (j *MemoryJournal) Save(rec *SweepRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.records[rec.ID] = copyRecord(rec)
+	return nil
+}
+
+func (j *MemoryJournal) Get(id string) (*SweepRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec, ok := j.records[id]
+	if !ok {
+		return nil, ErrSweepNotFound
+	}
+	return copyRecord(rec), nil
+}
+
+func (j *MemoryJournal) Unfinished() ([]*SweepRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return findRecords(j.records, func(rec *SweepRecord) bool { return !rec.State.Done() }), nil
+}
+
+func (j *MemoryJournal) ByMiddleware(middleware common.Address) ([]*SweepRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return findRecords(j.records, func(rec *SweepRecord) bool { return rec.Middleware == middleware }), nil
+}
+
+// FileJournal keeps records in a JSON file, rewritten atomically on every save.
+type FileJournal struct {
+	path string
+	mem  *MemoryJournal
+}
+
+// OpenFileJournal loads the journal at path, creating it on first save if it does not exist.
+func OpenFileJournal(path string) (*FileJournal, error) {
+	j := &FileJournal{path: path, mem: NewMemoryJournal()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &j.mem.records); err != nil {
+		return nil, fmt.Errorf("reading sweep journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+func (j *FileJournal) Save(rec *SweepRecord) error {
+	j.mem.mu.Lock()
+	defer j.mem.mu.Unlock()
+	prev, existed := j.mem.records[rec.ID]
+	j.mem.records[rec.ID] = copyRecord(rec)
+	if err := j.write(); err != nil {
+		if existed {
+			j.mem.records[rec.ID] = prev
+		} else {
+			delete(j.mem.records, rec.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (j *FileJournal) Get(id string) (*SweepRecord, error) {
+	return j.mem.Get(id)
+}
+
+func (j *FileJournal) Unfinished() ([]*SweepRecord, error) {
+	return j.mem.Unfinished()
+}
+
+func (j *FileJournal) ByMiddleware(middleware common.Address) ([]*SweepRecord, error) {
+	return j.mem.ByMiddleware(middleware)
+}
+
+// write replaces the journal file with the current records. Callers hold the lock.
+func (j *FileJournal) write() error {
+	data, err := json.MarshalIndent(j.mem.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// findRecords returns copies of the records matching fn, oldest first
+func findRecords(records map[string]*SweepRecord, fn func(rec *SweepRecord) bool) []*SweepRecord {
+	var recs []*SweepRecord
+	for _, rec := range records {
+		if fn(rec) {
+			recs = append(recs, copyRecord(rec))
+		}
+	}
+	sort.Slice(recs, func(a, b int) bool {
+		return recs[a].CreatedAt.Before(recs[b].CreatedAt)
+	})
+	return recs
+}
+
+// copyRecord copies a record so callers cannot modify what a journal holds.
+// Big ints and byte slices are never mutated in place, so they are shared.
+func copyRecord(rec *SweepRecord) *SweepRecord {
+	c := *rec
+	c.FundingReplaced = append([]common.Hash(nil), rec.FundingReplaced...)
+	c.TokenReplaced = append([]common.Hash(nil), rec.TokenReplaced...)
+	return &c
+}
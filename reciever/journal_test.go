@@ -0,0 +1,225 @@
+package reciever
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+// failOnce fails the first SendTransaction, as if the process died before broadcasting
+type failOnce struct {
+	util.Backend
+	failed bool
+}
+
+func (b *failOnce) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if !b.failed {
+		b.failed = true
+		return errors.New("connection reset")
+	}
+	return b.Backend.SendTransaction(ctx, tx)
+}
+
+// restart builds a new sweeper over the same journal file, as a restarted process would
+func restart(t *testing.T, s *Sweeper, client util.Backend, path string) *Sweeper {
+	journal, err := OpenFileJournal(path)
+	assert.NoError(t, err)
+	restarted, err := NewSweeper(Config{
+		Client:       client,
+		TokenAddress: s.tokenAddress,
+		ProviderKey:  s.providerWalletPK,
+		Destination:  s.desAddress,
+		Journal:      journal,
+	})
+	assert.NoError(t, err)
+	return restarted
+}
+
+func TestFileJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	journal, err := OpenFileJournal(path)
+	assert.NoError(t, err)
+
+	rec := &SweepRecord{ID: "a", State: StatePlanned, Amount: big.NewInt(20), FundingTx: common.HexToHash("0x01")}
+	assert.NoError(t, journal.Save(rec))
+	assert.NoError(t, journal.Save(&SweepRecord{ID: "b", State: StateConfirmed}))
+
+	reopened, err := OpenFileJournal(path)
+	assert.NoError(t, err)
+	got, err := reopened.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, rec.FundingTx, got.FundingTx)
+	assert.Equal(t, int64(20), got.Amount.Int64())
+
+	recs, err := reopened.Unfinished()
+	assert.NoError(t, err)
+	assert.Len(t, recs, 1)
+
+	_, err = reopened.Get("c")
+	assert.ErrorIs(t, err, ErrSweepNotFound)
+}
+
+func TestSweepJournalStates(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 2)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	rec, err := s.journal.Get(result.SweepID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateTokenSent, rec.State)
+	assert.Equal(t, result.MiddlewareToDestinationTx.Hash(), rec.TokenTx)
+
+	recs, err := s.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) {
+		return privateKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, recs, 1)
+	rec, err = s.journal.Get(result.SweepID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateConfirmed, rec.State)
+	receipt, err := chain.Client.TransactionReceipt(context.Background(), rec.TokenTx)
+	assert.NoError(t, err)
+	assert.Equal(t, receipt.BlockNumber.Uint64(), rec.Block)
+}
+
+// A process that dies after the gas funding is mined resumes with the token transfer
+func TestResumeAfterGasFunded(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	path := filepath.Join(t.TempDir(), "journal.json")
+	s = restart(t, s, chain.Client, path)
+	middlewareWallet, privateKey := simchain.Wallet(t, 3)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	fees, err := s.quoteFees(context.Background(), nil)
+	assert.NoError(t, err)
+	recs, results, err := s.plan(context.Background(), middlewareWallet.Address, s.tokens, big.NewInt(20), big.NewInt(0), fees)
+	assert.NoError(t, err)
+	assert.NoError(t, s.advance(context.Background(), recs[0], privateKey, results[0], StateGasFunded))
+
+	s = restart(t, s, chain.Client, path)
+	recs, err = s.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) {
+		return privateKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, recs, 1)
+	assert.Equal(t, StateConfirmed, recs[0].State)
+
+	nonce, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), nonce, "middleware should be funded once")
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
+
+// A process that dies after signing the gas funding, before broadcasting it, sends the same transaction
+func TestResumeBeforeBroadcast(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	path := filepath.Join(t.TempDir(), "journal.json")
+	s = restart(t, s, &failOnce{Backend: chain.Client}, path)
+	middlewareWallet, privateKey := simchain.Wallet(t, 4)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	first, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.Error(t, err)
+	rec, err := s.journal.Get(first.SweepID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatePlanned, rec.State)
+	assert.NotEmpty(t, rec.FundingRawTx)
+
+	s = restart(t, s, chain.Client, path)
+	second, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Equal(t, first.SweepID, second.SweepID)
+	assert.Equal(t, rec.FundingTx, second.ProviderToMiddlewareReceipt.TxHash)
+	assert.NotNil(t, second.MiddlewareToDestinationTx)
+}
+
+// Sweepers of different chains share a journal without resuming each other's sweeps
+func TestJournalKeyedByChain(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 16)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	fees, err := s.quoteFees(context.Background(), nil)
+	assert.NoError(t, err)
+	recs, results, err := s.plan(context.Background(), middlewareWallet.Address, s.tokens, big.NewInt(20), big.NewInt(0), fees)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1337), recs[0].ChainID)
+	assert.Equal(t, uint64(1337), results[0].ChainID)
+	assert.True(t, strings.HasPrefix(recs[0].ID, "1337-"))
+
+	other, err := NewSweeper(Config{
+		Client:       chain.Client,
+		ChainID:      10,
+		TokenAddress: s.tokenAddress,
+		ProviderKey:  s.providerWalletPK,
+		Destination:  s.desAddress,
+		Journal:      s.journal,
+	})
+	assert.NoError(t, err)
+	resumed, err := other.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) {
+		return privateKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, resumed)
+	unfinished, err := other.unfinishedSweeps(context.Background(), middlewareWallet.Address, other.tokens)
+	assert.NoError(t, err)
+	assert.Empty(t, unfinished)
+
+	resumed, err = s.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) {
+		return privateKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, resumed, 1)
+	assert.Equal(t, StateConfirmed, resumed[0].State)
+
+	// a record without a chain is no sweeper's, and is not journaled
+	orphan := copyRecord(recs[0])
+	orphan.ID, orphan.ChainID, orphan.State = "no-chain", 0, StatePlanned
+	assert.NoError(t, s.journal.Save(orphan))
+	resumed, err = s.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) {
+		return privateKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, resumed)
+	assert.Error(t, s.transition(orphan, StateGasFunded, ""))
+}
+
+func TestFlagSweeps(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 23)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+	detected := time.Now()
+
+	results, err := s.SweepWallet(context.Background(), middlewareWallet, privateKey, big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	flagged, err := s.FlagSweeps(context.Background(), middlewareWallet.Address, chain.Token, time.Now(), "reorged")
+	assert.NoError(t, err)
+	assert.Empty(t, flagged, "planned before the time")
+	flagged, err = s.FlagSweeps(context.Background(), middlewareWallet.Address, common.HexToAddress("0x01"), detected, "reorged")
+	assert.NoError(t, err)
+	assert.Empty(t, flagged, "another token")
+
+	flagged, err = s.FlagSweeps(context.Background(), middlewareWallet.Address, chain.Token, detected, "deposit reorged out")
+	assert.NoError(t, err)
+	if assert.Len(t, flagged, 1) {
+		rec, err := s.journal.Get(flagged[0].ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "deposit reorged out", rec.Flag)
+	}
+}
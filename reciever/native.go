@@ -0,0 +1,42 @@
+package reciever
+
+import (
+	"context"
+	"log"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// native reports whether the sweeper sweeps the chain's native asset rather than a token.
+// Native sweeps are recorded with a zero token address.
+func (s *Sweeper) native() bool {
+	return s.tokenAddress == (common.Address{})
+}
+
+// planNative estimates the gas of sending the middleware wallet's ETH to destination, which
+// costs more than a plain transfer if it is a contract such as a Safe, and returns what is
+// left of balance after paying for it: the amount to sweep
+func (s *Sweeper) planNative(ctx context.Context, middleware common.Address, destination common.Address, balance *big.Int, fees *Fees, result *PaymentResult) (*big.Int, error) {
+	var err error
+	result.GasUnit, err = s.client.EstimateGas(ctx, ethereum.CallMsg{From: middleware, To: &destination, Value: big.NewInt(0)})
+	if err != nil {
+		log.Printf("EstimateGas failed, using default value %d: %v", fundingGas, err)
+		result.GasUnit = fundingGas
+	}
+
+	// the data fee of sending the whole balance, which serializes no shorter than the amount
+	if result.DataFee, err = s.dataFee(ctx, middleware, destination, balance, nil, result.GasUnit, fees); err != nil {
+		return nil, err
+	}
+
+	// amount = balance - GasUnit * GasFeeCap - DataFee, keeping room for replacing the transfer if it gets stuck
+	gasFee := new(big.Int).Mul(s.bump.fundedFeeCap(result.GasFeeCap), new(big.Int).SetUint64(result.GasUnit))
+	amount := new(big.Int).Sub(balance, gasFee)
+	amount.Sub(amount, result.DataFee)
+	if amount.Sign() <= 0 {
+		return nil, ErrInsufficientBalance
+	}
+	return amount, nil
+}
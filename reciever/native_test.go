@@ -0,0 +1,79 @@
+package reciever
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+// An ETH payment is swept in one transaction, paying its own gas
+func TestSweepNative(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	s, err := NewSweeper(Config{
+		Client:      chain.Client,
+		Native:      true,
+		ProviderKey: s.providerWalletPK,
+		Destination: s.desAddress,
+	})
+	assert.NoError(t, err)
+	middlewareWallet, privateKey := simchain.Wallet(t, 13)
+	paid := big.NewInt(1_000_000_000_000_000)
+	chain.SendETH(t, middlewareWallet.Address, paid)
+
+	result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(1), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Equal(t, FundingSkipped, result.FundingPath)
+	assert.Nil(t, result.ProviderToMiddlewareReceipt)
+
+	// the exact remainder after gas at the fee cap
+	tx := result.MiddlewareToDestinationTx
+	gasFee := new(big.Int).Mul(result.GasFeeCap, new(big.Int).SetUint64(result.GasUnit))
+	assert.Equal(t, new(big.Int).Sub(paid, gasFee), tx.Value())
+	assert.Equal(t, s.desAddress, *tx.To())
+	assert.Empty(t, tx.Data())
+	assert.Equal(t, tx.Value(), chain.Balance(t, s.desAddress))
+
+	nonce, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), nonce, "nothing should be funded")
+
+	// what is left does not pay for another transfer
+	_, err = s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(1), big.NewInt(0))
+	assert.ErrorIs(t, err, ErrInsufficientBalance)
+}
+
+// ETH swept to a contract pays for the gas its receive costs, beyond a plain transfer's
+func TestSweepNativeToContract(t *testing.T) {
+	// a receive storing a word, as a Safe's does more
+	safe := common.HexToAddress("0x5afe")
+	chain := simchain.NewWithAlloc(t, types.GenesisAlloc{safe: {Code: common.FromHex("0x600160005500"), Balance: big.NewInt(0)}})
+	providerKey, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	s, err := NewSweeper(Config{
+		Client:      chain.Client,
+		Native:      true,
+		Tokens:      []util.Token{{Destination: safe}},
+		ProviderKey: providerKey,
+		Destination: common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+	})
+	assert.NoError(t, err)
+	middlewareWallet, privateKey := simchain.Wallet(t, 35)
+	chain.SendETH(t, middlewareWallet.Address, big.NewInt(1_000_000_000_000_000))
+
+	result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(1), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Greater(t, result.GasUnit, uint64(fundingGas))
+	receipt, err := bind.WaitMined(context.Background(), chain.Client, result.MiddlewareToDestinationTx)
+	assert.NoError(t, err)
+	assert.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	assert.Equal(t, result.MiddlewareToDestinationTx.Value(), chain.Balance(t, safe))
+}
@@ -0,0 +1,117 @@
+package reciever
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// fundingGas is the gas of the provider to middleware ETH transfer
+const fundingGas = 21000
+
+// PriceSource converts ETH amounts into token amounts.
+type PriceSource interface {
+	// ETHToToken returns what wei is worth in the token's smallest unit.
+	ETHToToken(ctx context.Context, token common.Address, wei *big.Int) (*big.Int, error)
+}
+
+// FixedPrice prices every token at a fixed number of whole tokens per ETH, e.g. 3000 for
+// a USD stablecoin.
+type FixedPrice struct {
+	TokensPerETH *big.Float
+	Decimals     uint8 // of the token
+}
+
+func (p FixedPrice) ETHToToken(ctx context.Context, token common.Address, wei *big.Int) (*big.Int, error) {
+	if p.TokensPerETH == nil {
+		return nil, fmt.Errorf("token price is not set")
+	}
+	// wei * tokensPerETH * 10^decimals / 10^18
+	scale := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(p.Decimals)), nil))
+	value := new(big.Float).SetInt(wei)
+	value.Mul(value, p.TokensPerETH).Mul(value, scale).Quo(value, big.NewFloat(1e18))
+	amount, _ := value.Int(nil)
+	return amount, nil
+}
+
+// PriceTable prices each token with its own source.
+type PriceTable map[common.Address]PriceSource
+
+func (t PriceTable) ETHToToken(ctx context.Context, token common.Address, wei *big.Int) (*big.Int, error) {
+	prices, ok := t[token]
+	if !ok {
+		return nil, fmt.Errorf("no price for token %s", token.Hex())
+	}
+	return prices.ETHToToken(ctx, token, wei)
+}
+
+// ProfitPolicy defers sweeps that cost more gas than they are worth. The cost is that of
+// both transactions, funding (unless skipped) and token transfer, at the base fee plus
+// tip they are expected to pay, and the token transfer's data fee. The zero value sweeps
+// regardless of cost.
+type ProfitPolicy struct {
+	MaxCost        *big.Int    // in wei; nil for no ceiling
+	MaxCostPercent float64     // of the swept token amount; 0 for no limit
+	Prices         PriceSource // required with MaxCostPercent, except for native sweeps
+}
+
+// Deferral explains why a sweep was not worth sending now.
+type Deferral struct {
+	Reason      string
+	Cost        *big.Int // expected gas cost of the sweep in wei
+	CostInToken *big.Int // Cost in the token's smallest unit, if it was priced
+	Amount      *big.Int // token amount that would have been swept
+}
+
+// check returns a deferral if a sweep of amount with these fees, token transfer gas and
+// data fee, and a funding transaction if funded, is not worth it, or nil to go ahead
+func (p ProfitPolicy) check(ctx context.Context, token common.Address, amount *big.Int, fees *Fees, gasUnit uint64, dataFee *big.Int, funded bool) (*Deferral, error) {
+	gasPrice := fees.GasFeeCap // a legacy transaction's gas price
+	if fees.BaseFee != nil {
+		gasPrice = new(big.Int).Add(fees.BaseFee, fees.GasTipCap)
+		if gasPrice.Cmp(fees.GasFeeCap) > 0 {
+			gasPrice = fees.GasFeeCap
+		}
+	}
+	gas := gasUnit
+	if funded {
+		gas += fundingGas
+	}
+	cost := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gas))
+	cost.Add(cost, dataFee)
+	deferral := &Deferral{Cost: cost, Amount: amount}
+
+	if p.MaxCost != nil && cost.Cmp(p.MaxCost) > 0 {
+		deferral.Reason = fmt.Sprintf("gas cost %s wei is above the ceiling of %s wei", cost, p.MaxCost)
+		return deferral, nil
+	}
+	if p.MaxCostPercent > 0 {
+		costInToken := cost // a native sweep pays gas in what it sweeps
+		if token != (common.Address{}) {
+			if p.Prices == nil {
+				return nil, fmt.Errorf("price source is not set")
+			}
+			var err error
+			if costInToken, err = p.Prices.ETHToToken(ctx, token, cost); err != nil {
+				return nil, fmt.Errorf("pricing gas cost: %w", err)
+			}
+		}
+		deferral.CostInToken = costInToken
+
+		if amount.Sign() == 0 {
+			deferral.Reason = "nothing to sweep"
+			return deferral, nil
+		}
+		// costInToken / amount * 100 > MaxCostPercent
+		share := new(big.Float).Quo(new(big.Float).SetInt(costInToken), new(big.Float).SetInt(amount))
+		share.Mul(share, big.NewFloat(100))
+		if share.Cmp(big.NewFloat(p.MaxCostPercent)) > 0 {
+			percent, _ := share.Float64()
+			deferral.Reason = fmt.Sprintf("gas cost is %.2f%% of the swept amount, above %.2f%%", percent, p.MaxCostPercent)
+			return deferral, nil
+		}
+	}
+	return nil, nil
+}
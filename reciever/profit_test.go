@@ -0,0 +1,79 @@
+package reciever
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+)
+
+func TestProfitPolicy(t *testing.T) {
+	ctx := context.Background()
+	token := common.HexToAddress("0x01")
+	gwei := big.NewInt(1_000_000_000)
+	// 10 gwei base fee, 1 gwei tip: 86000 gas cost 946000 gwei
+	fees := &Fees{BaseFee: new(big.Int).Mul(gwei, big.NewInt(10)), GasTipCap: gwei, GasFeeCap: new(big.Int).Mul(gwei, big.NewInt(21))}
+	prices := FixedPrice{TokensPerETH: big.NewFloat(2000), Decimals: 6}
+
+	costInToken, err := prices.ETHToToken(ctx, token, new(big.Int).Mul(gwei, big.NewInt(946000)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1_892_000), costInToken.Int64()) // 1.892 tokens
+
+	deferral, err := ProfitPolicy{}.check(ctx, token, big.NewInt(1), fees, 65000, big.NewInt(0), true)
+	assert.NoError(t, err)
+	assert.Nil(t, deferral)
+
+	policy := ProfitPolicy{MaxCostPercent: 1, Prices: prices}
+	deferral, err = policy.check(ctx, token, big.NewInt(100_000_000), fees, 65000, big.NewInt(0), true) // 100 tokens
+	assert.NoError(t, err)
+	assert.NotNil(t, deferral)
+	assert.Equal(t, int64(1_892_000), deferral.CostInToken.Int64())
+
+	deferral, err = policy.check(ctx, token, big.NewInt(500_000_000), fees, 65000, big.NewInt(0), true) // 500 tokens
+	assert.NoError(t, err)
+	assert.Nil(t, deferral)
+
+	deferral, err = ProfitPolicy{MaxCost: new(big.Int).Mul(gwei, big.NewInt(900000))}.check(ctx, token, big.NewInt(1), fees, 65000, big.NewInt(0), true)
+	assert.NoError(t, err)
+	assert.NotNil(t, deferral)
+	assert.Equal(t, new(big.Int).Mul(gwei, big.NewInt(946000)), deferral.Cost)
+
+	// without the funding transaction it costs 715000 gwei
+	deferral, err = ProfitPolicy{MaxCost: new(big.Int).Mul(gwei, big.NewInt(900000))}.check(ctx, token, big.NewInt(1), fees, 65000, big.NewInt(0), false)
+	assert.NoError(t, err)
+	assert.Nil(t, deferral)
+
+	_, err = ProfitPolicy{MaxCostPercent: 1}.check(ctx, token, big.NewInt(1), fees, 65000, big.NewInt(0), true)
+	assert.Error(t, err)
+}
+
+// A sweep not worth its gas is deferred without sending anything
+func TestSweepMiddlewareDeferred(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 7)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	s.profit = ProfitPolicy{MaxCostPercent: 5, Prices: FixedPrice{TokensPerETH: big.NewFloat(3000), Decimals: 6}}
+	result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.NotNil(t, result.Deferred)
+	assert.Equal(t, int64(20), result.Deferred.Amount.Int64())
+	assert.Nil(t, result.ProviderToMiddlewareReceipt)
+
+	// a gas price above the threshold is deferred too
+	s.profit = ProfitPolicy{}
+	result, err = s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(1))
+	assert.NoError(t, err)
+	assert.NotNil(t, result.Deferred)
+
+	nonce, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), nonce, "nothing should be funded")
+	recs, err := s.journal.Unfinished()
+	assert.NoError(t, err)
+	assert.Empty(t, recs)
+}
@@ -3,170 +3,810 @@ package reciever
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
-	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/joho/godotenv"
 
 	"allen-liaoo/payment-reciever/util"
 )
 
-var client *ethclient.Client
+// Config holds everything a Sweeper needs. Nothing is read from the environment, so
+// several differently configured sweepers can live in the same process.
+type Config struct {
+	Client       util.Backend
+	ChainID      uint64             // chain of Client, tagging sweeps and results; asked of the node if unset
+	TokenAddress common.Address     // token contract swept out of middleware wallets; unset with Native
+	Tokens       []util.Token       // more tokens to sweep, see SweepWallet; TokenAddress may then be unset
+	Native       bool               // sweep ETH instead of a token, with no funding transaction
+	ProviderKey  *ecdsa.PrivateKey  // funds gas for middleware wallets
+	Destination  common.Address     // where swept tokens are sent
+	Journal      Journal            // sweep state; defaults to an in-memory journal
+	Nonces       *util.NonceManager // provider wallet nonces; defaults to one kept in memory
+	Bump         BumpPolicy         // replacing stuck transactions; off by default
+	Fees         FeeStrategy        // fees of sweeps not given a strategy; defaults to DefaultFeeStrategy
+	FeeModel     FeeModel           // charges beyond execution gas, e.g. OPStackFees; none by default
+	Profit       ProfitPolicy       // defers sweeps not worth their gas; sweeps regardless by default
+	// OnStateChange is called with a copy of each sweep once it is journaled in a new
+	// state, such as to notify of funded and finished sweeps. Sweeps of several wallets
+	// advance at once, so it must be safe for concurrent use. A crash after the save
+	// skips the call; SQLiteJournal.OnSave runs in the save's transaction instead.
+	OnStateChange func(rec *SweepRecord)
+}
+
+// Sweeper moves tokens from middleware wallets to a destination wallet, funding gas
+// from a provider wallet.
+type Sweeper struct {
+	client                util.Backend
+	chainMu               sync.Mutex
+	chainID               uint64         // 0 until asked of the node
+	tokenAddress          common.Address // first of tokens, swept by SweepMiddleware
+	tokens                []util.Token
+	providerWalletAddress common.Address
+	providerWalletPK      *ecdsa.PrivateKey
+	desAddress            common.Address
+	journal               Journal
+	nonces                *util.NonceManager
+	bump                  BumpPolicy
+	fees                  FeeStrategy
+	feeModel              FeeModel
+	profit                ProfitPolicy
+	onStateChange         func(rec *SweepRecord)
 
-var usdcAddress common.Address
-var providerWalletAddress common.Address
-var providerWalletPK *ecdsa.PrivateKey
-var middlewareWalletMneumonic string
-var desAddress common.Address
+	sweepingMu sync.Mutex
+	sweeping   map[common.Address]bool // middleware wallets being swept
+}
 
-func init() {
-	godotenv.Load("../.env")
-	var rpcUrl = os.Getenv("RPC_URL")
-	var infuraKey = os.Getenv("INFURA_KEY")
-	if rpcUrl == "" || infuraKey == "" {
-		panic("RPC_URL or INFURA_KEY environment variable is not set")
+// ErrSweepInProgress is returned for a middleware wallet the sweeper is already sweeping.
+var ErrSweepInProgress = errors.New("a sweep of the wallet is already in progress")
+
+// lockWallet claims a middleware wallet for a sweep, returning the function releasing it,
+// so two sweeps never plan or advance the same wallet's sweeps at once
+func (s *Sweeper) lockWallet(middleware common.Address) (func(), error) {
+	s.sweepingMu.Lock()
+	defer s.sweepingMu.Unlock()
+	if s.sweeping[middleware] {
+		return nil, fmt.Errorf("%w: %s", ErrSweepInProgress, middleware.Hex())
 	}
+	s.sweeping[middleware] = true
+	return func() {
+		s.sweepingMu.Lock()
+		defer s.sweepingMu.Unlock()
+		delete(s.sweeping, middleware)
+	}, nil
+}
 
-	// init client
-	var err error
-	client, err = ethclient.Dial(rpcUrl + infuraKey)
-	if err != nil {
-		panic(err)
+func NewSweeper(cfg Config) (*Sweeper, error) {
+	if cfg.Client == nil {
+		return nil, fmt.Errorf("client is not set")
+	}
+	if cfg.ProviderKey == nil {
+		return nil, fmt.Errorf("provider key is not set")
+	}
+	if cfg.Native && cfg.TokenAddress != (common.Address{}) {
+		return nil, fmt.Errorf("token address is set for a native sweeper")
+	}
+	var tokens []util.Token
+	if cfg.Native || cfg.TokenAddress != (common.Address{}) {
+		tokens = append(tokens, util.Token{Address: cfg.TokenAddress})
+	}
+	for _, token := range cfg.Tokens {
+		if token.Address == (common.Address{}) && !cfg.Native {
+			return nil, fmt.Errorf("token address required, the zero address is only swept by a native sweeper")
+		}
+		if token.Address != cfg.TokenAddress {
+			tokens = append(tokens, token)
+		} else {
+			tokens[0] = token
+		}
+	}
+	if cfg.Native && len(tokens) > 1 {
+		return nil, fmt.Errorf("tokens are set for a native sweeper")
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token address is not set")
+	}
+	if cfg.Destination == (common.Address{}) {
+		return nil, fmt.Errorf("destination address is not set")
+	}
+	if cfg.Journal == nil {
+		cfg.Journal = NewMemoryJournal()
+	}
+	if cfg.Fees == nil {
+		cfg.Fees = DefaultFeeStrategy
+	}
+	if cfg.Nonces == nil {
+		cfg.Nonces = util.NewNonceManager(cfg.Client, nil)
+	}
+	return &Sweeper{
+		client:                cfg.Client,
+		chainID:               cfg.ChainID,
+		tokenAddress:          tokens[0].Address,
+		tokens:                tokens,
+		providerWalletAddress: crypto.PubkeyToAddress(cfg.ProviderKey.PublicKey),
+		providerWalletPK:      cfg.ProviderKey,
+		desAddress:            cfg.Destination,
+		journal:               cfg.Journal,
+		nonces:                cfg.Nonces,
+		bump:                  cfg.Bump,
+		fees:                  cfg.Fees,
+		feeModel:              cfg.FeeModel,
+		profit:                cfg.Profit,
+		onStateChange:         cfg.OnStateChange,
+		sweeping:              make(map[common.Address]bool),
+	}, nil
+}
+
+// ProviderAddress returns the address of the wallet funding gas.
+func (s *Sweeper) ProviderAddress() common.Address {
+	return s.providerWalletAddress
+}
+
+// Tokens returns the tokens the sweeper sweeps, the zero address for a native sweeper.
+func (s *Sweeper) Tokens() []util.Token {
+	return append([]util.Token(nil), s.tokens...)
+}
+
+// ChainID returns the ID of the chain the sweeper works on, asking the node the first
+// time if the config did not set it.
+func (s *Sweeper) ChainID(ctx context.Context) (uint64, error) {
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	if s.chainID == 0 {
+		id, err := s.client.ChainID(ctx)
+		if err != nil {
+			return 0, err
+		}
+		s.chainID = id.Uint64()
 	}
+	return s.chainID, nil
+}
+
+// owns reports whether a journaled sweep is one of this sweeper's, on chainID
+func (s *Sweeper) owns(rec *SweepRecord, chainID uint64) bool {
+	return rec.ChainID == chainID && s.sweeps(rec.Token)
+}
 
-	var usdcAddr = os.Getenv("USDC_ADDRESS")
-	var providerWalletAddr = os.Getenv("PROVIDER_WALLET_ADDRESS")
-	var providerWalletPrivateKey = os.Getenv("PROVIDER_WALLET_PK")
-	middlewareWalletMneumonic = os.Getenv("MIDDLEWARE_MNEUMONIC")
-	if usdcAddr == "" || providerWalletAddr == "" || providerWalletPrivateKey == "" || middlewareWalletMneumonic == "" {
-		panic("USDC_ADDRESS or PROVIDER_WALLET_ADDRESS or PROVIDER_WALLET_PK or MIDDLEWARE_MNEUMONIC environment variable is not set")
+// sweeps reports whether token is one of the sweeper's
+func (s *Sweeper) sweeps(token common.Address) bool {
+	for _, t := range s.tokens {
+		if t.Address == token {
+			return true
+		}
 	}
-	usdcAddress = common.HexToAddress(usdcAddr)
-	providerWalletAddress = common.HexToAddress(providerWalletAddr)
-	providerWalletPK, err = crypto.HexToECDSA(providerWalletPrivateKey)
-	if err != nil {
-		panic(err)
+	return false
+}
+
+// destinationOf returns where a token is swept to
+func (s *Sweeper) destinationOf(token util.Token) common.Address {
+	if token.Destination != (common.Address{}) {
+		return token.Destination
 	}
-	desAddress = providerWalletAddress
+	return s.desAddress
 }
 
+var ErrInsufficientBalance = errors.New("middleware wallet does not have enough balance to sweep")
+
 type PaymentResult struct {
+	SweepID                     string
+	ChainID                     uint64
 	ProviderToMiddlewareReceipt *types.Receipt
 	MiddlewareToDestinationTx   *types.Transaction
 	BaseFee                     *big.Int
 	GasTipCap                   *big.Int
 	GasFeeCap                   *big.Int
 	GasUnit                     uint64
+	DataFee                     *big.Int    // of the token transfer beyond its gas, e.g. an L1 data fee
+	FundingPath                 FundingPath // how the middleware wallet got its gas
+	FundingAmount               *big.Int    // ETH sent by the provider wallet
+	Deferred                    *Deferral   // set when the sweep was not worth its gas; nothing was sent
 }
 
 // Check if a middleware wallet has enough balance to sweep, then sweep and return the transaction receipt
-// from providerWallet to middleware, and the hex of the transaction from middleware to destination wallet
-func SweepMiddleware(middlewareWallet *accounts.Account, privateKey *ecdsa.PrivateKey, minBalance *big.Int, gasCostThreshold *big.Int) (*PaymentResult, error) {
+// from providerWallet to middleware, and the hex of the transaction from middleware to destination wallet.
+// Every step is recorded in the journal; a sweep of this wallet left unfinished by an earlier run is
+// continued instead of funding the wallet again. Only the first configured token is swept; SweepWallet
+// sweeps them all.
+func (s *Sweeper) SweepMiddleware(middlewareWallet *accounts.Account, privateKey *ecdsa.PrivateKey, minBalance *big.Int, gasCostThreshold *big.Int) (*PaymentResult, error) {
+	return s.SweepMiddlewareWithFees(middlewareWallet, privateKey, minBalance, gasCostThreshold, nil)
+}
+
+// SweepMiddlewareWithFees is SweepMiddleware pricing the sweep with the given strategy
+// instead of the sweeper's. A continued sweep keeps the fees it was planned with.
+func (s *Sweeper) SweepMiddlewareWithFees(middlewareWallet *accounts.Account, privateKey *ecdsa.PrivateKey, minBalance *big.Int, gasCostThreshold *big.Int, strategy FeeStrategy) (*PaymentResult, error) {
+	ctx := context.Background()
+	unlock, err := s.lockWallet(middlewareWallet.Address)
+	if err != nil {
+		return &PaymentResult{}, err
+	}
+	defer unlock()
+	recs, results, err := s.prepare(ctx, middlewareWallet.Address, privateKey, s.tokens[:1], minBalance, gasCostThreshold, strategy, nil)
+	if err != nil {
+		return &PaymentResult{}, err
+	}
+	err = s.advanceAll(ctx, recs, privateKey, results, StateTokenSent)
+	return results[0], err
+}
+
+// SweepWallet sweeps every configured token the middleware wallet holds at least the
+// token's MinSweep of (1 if unset), funding gas for all the transfers with a single
+// transaction. It returns a result per token swept or deferred, in the order of the
+// configured tokens, and ErrInsufficientBalance if there is nothing to sweep, or
+// ErrSweepInProgress if the wallet is being swept already.
+func (s *Sweeper) SweepWallet(ctx context.Context, middlewareWallet *accounts.Account, privateKey *ecdsa.PrivateKey, gasCostThreshold *big.Int) ([]*PaymentResult, error) {
+	unlock, err := s.lockWallet(middlewareWallet.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	recs, results, err := s.prepare(ctx, middlewareWallet.Address, privateKey, s.tokens, big.NewInt(1), gasCostThreshold, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = s.advanceAll(ctx, recs, privateKey, results, StateTokenSent)
+	return results, err
+}
+
+// prepare returns the sweeps to advance for a middleware wallet, with a result for each:
+// its unfinished sweeps of tokens if there are any, otherwise newly planned ones. fees may
+// be nil to price them with strategy. Deferred tokens have a result but no sweep.
+func (s *Sweeper) prepare(ctx context.Context, middleware common.Address, privateKey *ecdsa.PrivateKey, tokens []util.Token, minBalance *big.Int, gasCostThreshold *big.Int, strategy FeeStrategy, fees *Fees) ([]*SweepRecord, []*PaymentResult, error) {
+	unfinished, err := s.unfinishedSweeps(ctx, middleware, tokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pending []*SweepRecord
+	for _, rec := range unfinished {
+		if rec.State != StateTokenSent {
+			pending = append(pending, rec)
+		}
+	}
+	if len(pending) > 0 {
+		results := make([]*PaymentResult, len(pending))
+		for i, rec := range pending {
+			results[i] = &PaymentResult{SweepID: rec.ID}
+		}
+		return pending, results, nil
+	}
+	// the previous sweeps' token transfers are out, settle them before planning more
+	if err := s.advanceAll(ctx, unfinished, privateKey, nil, StateConfirmed); err != nil {
+		return nil, nil, err
+	}
+
+	if fees == nil {
+		if fees, err = s.quoteFees(ctx, strategy); err != nil {
+			return nil, nil, err
+		}
+	}
+	return s.plan(ctx, middleware, tokens, minBalance, gasCostThreshold, fees)
+}
+
+// advanceAll advances the sweeps of one wallet in order, so the sweep funding the others
+// goes first. results may be nil, or hold the result of each sweep.
+func (s *Sweeper) advanceAll(ctx context.Context, recs []*SweepRecord, privateKey *ecdsa.PrivateKey, results []*PaymentResult, until SweepState) error {
+	byID := make(map[string]*PaymentResult)
+	for _, result := range results {
+		byID[result.SweepID] = result
+	}
+	for _, rec := range recs {
+		result := byID[rec.ID]
+		if result == nil {
+			result = &PaymentResult{}
+		}
+		if err := s.advance(ctx, rec, privateKey, result, until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteFees prices sweeps with strategy, or the sweeper's strategy if it is nil
+func (s *Sweeper) quoteFees(ctx context.Context, strategy FeeStrategy) (*Fees, error) {
+	if strategy == nil {
+		strategy = s.fees
+	}
+	return strategy.Fees(ctx, s.client)
+}
+
+// plan checks the middleware balance of each token and estimates gas, and records planned
+// sweeps of those worth sweeping. The first sweep's funding transaction pays for the gas
+// of all of them; the others are recorded as funded by it. A token sweep costing more than
+// gasCostThreshold per gas (0 for no limit) or more than the profit policy allows is
+// deferred: its result has Deferred set and it gets no record.
+func (s *Sweeper) plan(ctx context.Context, middleware common.Address, tokens []util.Token, minBalance *big.Int, gasCostThreshold *big.Int, fees *Fees) ([]*SweepRecord, []*PaymentResult, error) {
+	chainID, err := s.ChainID(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	// ETH already in the wallet (left over from earlier sweeps, or sent by the customer)
+	// pays for part or all of the gas
+	middlewareETH, err := s.client.BalanceAt(ctx, middleware, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var recs []*SweepRecord
+	var results, planned []*PaymentResult
+	gasFee := new(big.Int) // of the planned token transfers
+	for _, token := range tokens {
+		result := &PaymentResult{ChainID: chainID}
+		rec, err := s.planToken(ctx, middleware, token, middlewareETH, minBalance, gasCostThreshold, fees, result)
+		if errors.Is(err, ErrInsufficientBalance) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		results = append(results, result)
+		if rec == nil {
+			continue // deferred
+		}
+		recs = append(recs, rec)
+		planned = append(planned, result)
+		if !s.native() {
+			// leave room for replacing the token transfer if it gets stuck
+			gasFee.Add(gasFee, new(big.Int).Mul(s.bump.fundedFeeCap(rec.GasFeeCap), new(big.Int).SetUint64(rec.GasUnit)))
+			gasFee.Add(gasFee, rec.DataFee)
+		}
+	}
+	if len(results) == 0 {
+		return nil, nil, ErrInsufficientBalance
+	}
 
-	result := &PaymentResult{
-		ProviderToMiddlewareReceipt: nil,
-		MiddlewareToDestinationTx:   nil,
-		BaseFee:                     nil,
-		GasTipCap:                   nil,
-		GasFeeCap:                   nil,
-		GasUnit:                     0,
+	// MiddlewareGasFee = sum of GasFeeCap * GasUnit + DataFee (amount we send to middleware), less
+	// what the wallet holds
+	fundingAmount := new(big.Int).Sub(gasFee, middlewareETH)
+	fundingPath := FundingTopUp
+	switch {
+	case fundingAmount.Sign() <= 0:
+		fundingAmount.SetInt64(0)
+		fundingPath = FundingSkipped
+	case fundingAmount.Cmp(gasFee) == 0:
+		fundingPath = FundingFull
 	}
 
+	now := time.Now()
+	for i, rec := range recs {
+		rec.ID = fmt.Sprintf("%d-%s-%d", chainID, middleware.Hex(), now.UnixNano()+int64(i))
+		rec.ChainID = chainID
+		rec.CreatedAt = now
+		rec.UpdatedAt = now
+		rec.FundingAmount = big.NewInt(0)
+		rec.FundingPath = fundingPath
+		if i == 0 {
+			rec.FundingAmount = fundingAmount
+		} else if fundingPath != FundingSkipped {
+			rec.FundedBy = recs[0].ID
+		}
+	}
+	for i, rec := range recs {
+		if err := s.save(rec); err != nil {
+			return nil, nil, err
+		}
+		planned[i].SweepID = rec.ID
+	}
+	return recs, results, nil
+}
+
+// planToken checks the middleware balance of a token and estimates the gas of sweeping
+// it. It returns the sweep, not yet recorded or funded, or nil if it is deferred.
+func (s *Sweeper) planToken(ctx context.Context, middleware common.Address, token util.Token, middlewareETH *big.Int, minBalance *big.Int, gasCostThreshold *big.Int, fees *Fees, result *PaymentResult) (*SweepRecord, error) {
 	// Check Balance
-	balance, err := util.GetTokenBalance(client, usdcAddress, middlewareWallet.Address)
+	var balance *big.Int
+	var err error
+	if s.native() {
+		balance = middlewareETH
+	} else {
+		balance, err = util.GetTokenBalance(s.client, token.Address, middleware)
+	}
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
 	// Check if middleware wallet has expected balance to sweep
+	if token.MinSweep != nil && token.MinSweep.Cmp(minBalance) > 0 {
+		minBalance = token.MinSweep
+	}
 	if balance.Cmp(minBalance) < 0 {
-		return result, fmt.Errorf("middleware wallet does not have enough balance to sweep")
+		return nil, ErrInsufficientBalance
+	}
+
+	result.BaseFee = fees.BaseFee
+	result.GasTipCap = fees.GasTipCap
+	result.GasFeeCap = fees.GasFeeCap
+	result.DataFee = big.NewInt(0)
+	destination := s.destinationOf(token)
+
+	amount := balance
+	funded := false
+	if s.native() {
+		// the wallet pays its own gas out of the swept ETH
+		if amount, err = s.planNative(ctx, middleware, destination, balance, fees, result); err != nil {
+			return nil, err
+		}
+	} else {
+		// From the fees of the fee strategy, GasUnit = EstimateGas
+		data := util.BuildTokenTxDataField(destination, balance) // data field for contract tokens transfer
+		msg := ethereum.CallMsg{                                 // test transaction
+			From:  middleware,
+			To:    &token.Address,
+			Value: big.NewInt(0), // value
+			Data:  data,
+		}
+		result.GasUnit, err = s.client.EstimateGas(ctx, msg)
+		if err != nil {
+			log.Printf("EstimateGas failed, using default value 65000: %v", err)
+			result.GasUnit = 65000
+		}
+		if result.DataFee, err = s.dataFee(ctx, middleware, token.Address, big.NewInt(0), data, result.GasUnit, fees); err != nil {
+			return nil, err
+		}
+		gasFee := new(big.Int).Mul(s.bump.fundedFeeCap(result.GasFeeCap), new(big.Int).SetUint64(result.GasUnit))
+		gasFee.Add(gasFee, result.DataFee)
+		funded = gasFee.Cmp(middlewareETH) > 0
+	}
+
+	if gasCostThreshold.Sign() > 0 && result.GasFeeCap.Cmp(gasCostThreshold) > 0 {
+		result.Deferred = &Deferral{
+			Reason: fmt.Sprintf("gas fee cap %s is above the threshold of %s", result.GasFeeCap, gasCostThreshold),
+			Amount: amount,
+		}
+		return nil, nil
+	}
+	if result.Deferred, err = s.profit.check(ctx, token.Address, amount, fees, result.GasUnit, result.DataFee, funded); err != nil || result.Deferred != nil {
+		return nil, err
 	}
 
-	// Estimate gas fee, which means getting
-	// 1. BaseFee from the latest block header
-	// 2. PriorityFee/GasTipCap = SuggestGasTipCap
-	// 3. GasFeeCap = BaseFee + GasTipCap
-	// 4. GasUnit = EstimateGas
-	// 5. MiddlewareGasFee = GasFeeCap * GasUnit (amount we send to middleware)
-	header, err := client.HeaderByNumber(context.Background(), nil)
+	return &SweepRecord{
+		State:       StatePlanned,
+		Middleware:  middleware,
+		Token:       token.Address,
+		Destination: destination,
+		Amount:      amount,
+		TxType:      fees.TxType,
+		BaseFee:     result.BaseFee,
+		GasTipCap:   result.GasTipCap,
+		GasFeeCap:   result.GasFeeCap,
+		GasUnit:     result.GasUnit,
+		DataFee:     result.DataFee,
+	}, nil
+}
+
+// Resume drives every unfinished sweep of the sweeper's chain and tokens in the journal to
+// confirmed or failed, picking up where an earlier run stopped rather than funding wallets
+// again, and returns them. Run it on startup, before planning new sweeps. keyFor returns
+// the private key of a middleware wallet.
+func (s *Sweeper) Resume(ctx context.Context, keyFor func(middleware common.Address) (*ecdsa.PrivateKey, error)) ([]*SweepRecord, error) {
+	chainID, err := s.ChainID(ctx)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
-	result.BaseFee = header.BaseFee
+	recs, err := s.journal.Unfinished()
+	if err != nil {
+		return nil, err
+	}
+	// sweeps funding others first
+	sort.SliceStable(recs, func(a, b int) bool { return recs[a].FundedBy == "" && recs[b].FundedBy != "" })
 
-	result.GasTipCap, err = client.SuggestGasTipCap(context.Background())
+	var resumed []*SweepRecord
+	var errs []error
+	for _, rec := range recs {
+		if !s.owns(rec, chainID) {
+			continue
+		}
+		unlock, err := s.lockWallet(rec.Middleware)
+		if err != nil {
+			continue // the sweep in progress finishes it
+		}
+		resumed = append(resumed, rec)
+		privateKey, err := keyFor(rec.Middleware)
+		if err == nil {
+			err = s.advance(ctx, rec, privateKey, &PaymentResult{}, StateConfirmed)
+		} else {
+			err = fmt.Errorf("sweep %s: %w", rec.ID, err)
+		}
+		unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Every journaled funding is out again, so provider nonces the node still does not
+	// know belong to transactions that were never sent, and would block new ones.
+	start, end, err := s.nonces.Gap(ctx, s.providerWalletAddress)
 	if err != nil {
-		return result, err
+		errs = append(errs, err)
+	} else if start < end {
+		log.Printf("provider nonces %d to %d were never sent, resyncing", start, end-1)
+		errs = append(errs, s.nonces.Reset(ctx, s.providerWalletAddress))
 	}
+	return resumed, errors.Join(errs...)
+}
 
-	result.GasFeeCap = new(big.Int).Add(result.BaseFee, result.GasTipCap)
+// unfinishedSweeps returns the journal's unfinished sweeps of tokens from a middleware
+// wallet on the sweeper's chain, those funding others first
+func (s *Sweeper) unfinishedSweeps(ctx context.Context, middleware common.Address, tokens []util.Token) ([]*SweepRecord, error) {
+	chainID, err := s.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := s.journal.Unfinished()
+	if err != nil {
+		return nil, err
+	}
+	var found []*SweepRecord
+	for _, rec := range recs {
+		if rec.Middleware != middleware || !s.owns(rec, chainID) {
+			continue
+		}
+		for _, token := range tokens {
+			if rec.Token == token.Address {
+				found = append(found, rec)
+			}
+		}
+	}
+	sort.SliceStable(found, func(a, b int) bool { return found[a].FundedBy == "" && found[b].FundedBy != "" })
+	return found, nil
+}
 
-	data := util.BuildTokenTxDataField(desAddress, balance) // data field for contract tokens transfer
-	msg := ethereum.CallMsg{                                // test transaction
-		From:  middlewareWallet.Address,
-		To:    &usdcAddress,
-		Value: big.NewInt(0), // value
-		Data:  data,
+// Sweeps returns the journaled sweeps of the sweeper's chain and tokens out of a
+// middleware wallet, oldest first.
+func (s *Sweeper) Sweeps(ctx context.Context, middleware common.Address) ([]*SweepRecord, error) {
+	chainID, err := s.ChainID(ctx)
+	if err != nil {
+		return nil, err
 	}
+	recs, err := s.journal.ByMiddleware(middleware)
+	if err != nil {
+		return nil, err
+	}
+	var found []*SweepRecord
+	for _, rec := range recs {
+		if s.owns(rec, chainID) {
+			found = append(found, rec)
+		}
+	}
+	return found, nil
+}
 
-	result.GasUnit, err = client.EstimateGas(context.Background(), msg)
+// FlagSweeps marks the sweeps of a token out of a middleware wallet on the sweeper's chain,
+// planned since a time, as needing review for reason, and returns them. It is meant for
+// sweeps that may have moved a deposit a reorg took back, which nothing on chain undoes.
+func (s *Sweeper) FlagSweeps(ctx context.Context, middleware common.Address, token common.Address, since time.Time, reason string) ([]*SweepRecord, error) {
+	recs, err := s.Sweeps(ctx, middleware)
 	if err != nil {
-		log.Printf("EstimateGas failed, using default value 65000: %v", err)
-		result.GasUnit = 65000
+		return nil, err
 	}
+	var flagged []*SweepRecord
+	for _, rec := range recs {
+		if rec.Token != token || rec.CreatedAt.Before(since) {
+			continue
+		}
+		rec.Flag = reason
+		rec.UpdatedAt = time.Now()
+		if err := s.save(rec); err != nil {
+			return flagged, err
+		}
+		flagged = append(flagged, rec)
+	}
+	return flagged, nil
+}
 
-	middlewareGasFee := new(big.Int).Mul(result.GasFeeCap, big.NewInt(int64(result.GasUnit)))
+// advance moves a sweep through its states until it reaches until, or is done.
+// Errors talking to the node leave the record where it is, to be retried;
+// a reverted transaction marks it failed.
+func (s *Sweeper) advance(ctx context.Context, rec *SweepRecord, privateKey *ecdsa.PrivateKey, result *PaymentResult, until SweepState) error {
+	result.ChainID = rec.ChainID
+	result.BaseFee = rec.BaseFee
+	result.GasTipCap = rec.GasTipCap
+	result.GasFeeCap = rec.GasFeeCap
+	result.GasUnit = rec.GasUnit
+	result.DataFee = rec.DataFee
+	result.FundingPath = rec.FundingPath
+	result.FundingAmount = rec.FundingAmount
 
-	if gasCostThreshold.Cmp(result.GasFeeCap) > 0 {
-		return result, fmt.Errorf("gas fee cap is too high")
+	for rec.State != until && !rec.State.Done() {
+		var err error
+		switch rec.State {
+		case StatePlanned:
+			err = s.fundGas(ctx, rec, result)
+		case StateGasFunded:
+			err = s.sendToken(ctx, rec, privateKey, result)
+		case StateTokenSent:
+			err = s.confirmToken(ctx, rec, privateKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if rec.State == StateFailed {
+		return fmt.Errorf("sweep %s failed: %s", rec.ID, rec.Error)
 	}
+	return nil
+}
 
-	// sweep transaction
-	// 1. Transfer ETH gas fee from provider wallet to middleware wallet
-	tx1, err := util.SendTx(&util.TxInput{
-		Client:     client,
-		From:       providerWalletAddress,
-		To:         middlewareWallet.Address,
-		Amount:     middlewareGasFee,
-		GasTipCap:  result.GasTipCap,
-		GasFeeCap:  result.GasFeeCap,
+// 1. Transfer ETH gas fee from provider wallet to middleware wallet
+func (s *Sweeper) fundGas(ctx context.Context, rec *SweepRecord, result *PaymentResult) error {
+	if rec.FundedBy != "" {
+		return s.awaitFunding(ctx, rec)
+	}
+	if rec.FundingPath == FundingSkipped {
+		// the middleware wallet can already pay
+		return s.transition(rec, StateGasFunded, "")
+	}
+	if rec.FundingRawTx == nil {
+		if err := s.signFunding(rec); err != nil {
+			return err
+		}
+	}
+
+	receipt, err := s.broadcastAndWait(ctx, rec, s.fundingLeg(rec))
+	if util.IsNonceTooLow(err) {
+		// another transaction took the nonce, so this one can never be mined: sign it again
+		if err := s.nonces.Resync(ctx, s.providerWalletAddress); err != nil {
+			return err
+		}
+		if err := s.signFunding(rec); err != nil {
+			return err
+		}
+		receipt, err = s.broadcastAndWait(ctx, rec, s.fundingLeg(rec))
+	}
+	if err != nil {
+		return err
+	}
+	result.ProviderToMiddlewareReceipt = receipt
+	if receipt.Status != 1 {
+		return s.transition(rec, StateFailed, "provider to middleware transaction failed")
+	}
+	return s.transition(rec, StateGasFunded, "")
+}
+
+// awaitFunding moves a sweep funded by another sweep of the same wallet on once that
+// sweep's funding is mined
+func (s *Sweeper) awaitFunding(ctx context.Context, rec *SweepRecord) error {
+	funder, err := s.journal.Get(rec.FundedBy)
+	if err != nil {
+		return err
+	}
+	if funder.State == StatePlanned {
+		return fmt.Errorf("sweep %s: funding by sweep %s is not mined yet", rec.ID, funder.ID)
+	}
+	receipt, err := s.legReceipt(ctx, s.fundingLeg(funder))
+	if err != nil {
+		return err
+	}
+	if receipt == nil || receipt.Status != 1 {
+		return s.transition(rec, StateFailed, fmt.Sprintf("funding by sweep %s failed", funder.ID))
+	}
+	return s.transition(rec, StateGasFunded, "")
+}
+
+// signFunding signs the provider to middleware transaction and records it
+func (s *Sweeper) signFunding(rec *SweepRecord) error {
+	tx, err := util.SignTx(&util.TxInput{
+		Client:     s.client,
+		Type:       rec.TxType,
+		From:       s.providerWalletAddress,
+		To:         rec.Middleware,
+		Amount:     rec.FundingAmount,
+		GasTipCap:  rec.GasTipCap,
+		GasFeeCap:  rec.GasFeeCap,
 		GasUnit:    21000,
-		PrivateKey: providerWalletPK,
+		PrivateKey: s.providerWalletPK,
+		Nonces:     s.nonces,
 	})
 	if err != nil {
-		return result, err
+		return err
 	}
+	return s.recordTx(rec, tx, &rec.FundingTx, &rec.FundingRawTx)
+}
 
-	result.ProviderToMiddlewareReceipt, err = bind.WaitMined(context.Background(), client, tx1)
+// 2. Transfer tokens (or, for native sweeps, ETH) from middleware wallet to destination wallet
+func (s *Sweeper) sendToken(ctx context.Context, rec *SweepRecord, privateKey *ecdsa.PrivateKey, result *PaymentResult) error {
+	if rec.TokenRawTx == nil {
+		input := &util.TxInput{
+			Client:     s.client,
+			Type:       rec.TxType,
+			From:       rec.Middleware,
+			To:         rec.Token,
+			Amount:     big.NewInt(0),
+			GasTipCap:  rec.GasTipCap,
+			GasFeeCap:  rec.GasFeeCap,
+			GasUnit:    rec.GasUnit,
+			Data:       util.BuildTokenTxDataField(rec.Destination, rec.Amount),
+			PrivateKey: privateKey,
+		}
+		if rec.Token == (common.Address{}) {
+			input.To = rec.Destination
+			input.Amount = rec.Amount
+			input.Data = nil
+		}
+		tx, err := util.SignTx(input)
+		if err != nil {
+			return err
+		}
+		if err := s.recordTx(rec, tx, &rec.TokenTx, &rec.TokenRawTx); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.broadcast(ctx, rec.TokenRawTx)
 	if err != nil {
-		return result, err
-	} else if result.ProviderToMiddlewareReceipt.Status != 1 {
-		return result, fmt.Errorf("provider to middleware transaction failed")
+		return err
 	}
+	result.MiddlewareToDestinationTx = tx
+	return s.transition(rec, StateTokenSent, "")
+}
 
-	// 2. Transfer USDC from middleware wallet to destination wallet
-	result.MiddlewareToDestinationTx, err = util.SendTokenTx(usdcAddress, &util.TxInput{
-		Client:     client,
-		From:       middlewareWallet.Address,
-		To:         desAddress,
-		Amount:     balance,
-		GasTipCap:  result.GasTipCap,
-		GasFeeCap:  result.GasFeeCap,
-		GasUnit:    result.GasUnit,
-		PrivateKey: privateKey,
-	})
+// 3. Wait for the token transfer to be mined
+func (s *Sweeper) confirmToken(ctx context.Context, rec *SweepRecord, privateKey *ecdsa.PrivateKey) error {
+	receipt, err := s.broadcastAndWait(ctx, rec, tokenLeg(rec, privateKey))
 	if err != nil {
-		return result, err
+		return err
+	}
+	if receipt.Status != 1 {
+		return s.transition(rec, StateFailed, "middleware to destination transaction failed")
+	}
+	rec.Block = receipt.BlockNumber.Uint64()
+	return s.transition(rec, StateConfirmed, "")
+}
+
+// recordTx stores a signed transaction in the record before it is broadcast
+func (s *Sweeper) recordTx(rec *SweepRecord, tx *types.Transaction, hash *common.Hash, raw *[]byte) error {
+	data, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	*hash = tx.Hash()
+	*raw = data
+	rec.UpdatedAt = time.Now()
+	return s.save(rec)
+}
+
+// save journals a record, which must name its chain for the sweepers of other chains to
+// leave it alone
+func (s *Sweeper) save(rec *SweepRecord) error {
+	if rec.ChainID == 0 {
+		return fmt.Errorf("sweep %s has no chain ID", rec.ID)
+	}
+	return s.journal.Save(rec)
+}
+
+func (s *Sweeper) transition(rec *SweepRecord, state SweepState, reason string) error {
+	rec.State = state
+	rec.Error = reason
+	rec.UpdatedAt = time.Now()
+	if err := s.save(rec); err != nil {
+		return err
+	}
+	if s.onStateChange != nil {
+		s.onStateChange(copyRecord(rec))
+	}
+	return nil
+}
+
+// broadcast sends a signed transaction. A transaction that is already in the pool or
+// already mined (sent before a restart) is not an error.
+func (s *Sweeper) broadcast(ctx context.Context, raw []byte) (*types.Transaction, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	err := s.client.SendTransaction(ctx, tx)
+	if err == nil || strings.Contains(err.Error(), "already known") {
+		return tx, nil
+	}
+	if _, rerr := s.client.TransactionReceipt(ctx, tx.Hash()); rerr == nil {
+		return tx, nil
 	}
-	return result, nil
+	return nil, err
 }
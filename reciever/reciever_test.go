@@ -1,19 +1,210 @@
 package reciever
 
 import (
+	"allen-liaoo/payment-reciever/testing/simchain"
 	"allen-liaoo/payment-reciever/util"
 	"context"
 	"fmt"
 	"math/big"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
 )
 
+// sweeperFromEnv builds a sweeper against the chain configured in ../.env, skipping the
+// test when it is not configured. It also returns the middleware wallet mnemonic.
+func sweeperFromEnv(t *testing.T) (*Sweeper, string) {
+	godotenv.Load("../.env")
+	var rpcUrl = os.Getenv("RPC_URL")
+	var infuraKey = os.Getenv("INFURA_KEY")
+	var usdcAddr = os.Getenv("USDC_ADDRESS")
+	var providerWalletPrivateKey = os.Getenv("PROVIDER_WALLET_PK")
+	var mnemonic = os.Getenv("MIDDLEWARE_MNEUMONIC")
+	if rpcUrl == "" || usdcAddr == "" || providerWalletPrivateKey == "" || mnemonic == "" {
+		t.Skip("RPC_URL, USDC_ADDRESS, PROVIDER_WALLET_PK or MIDDLEWARE_MNEUMONIC environment variable is not set")
+	}
+
+	client, err := ethclient.Dial(rpcUrl + infuraKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerWalletPK, err := crypto.HexToECDSA(providerWalletPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSweeper(Config{
+		Client:       client,
+		TokenAddress: common.HexToAddress(usdcAddr),
+		ProviderKey:  providerWalletPK,
+		Destination:  crypto.PubkeyToAddress(providerWalletPK.PublicKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, mnemonic
+}
+
+// unit test: NewSweeper rejects incomplete configs
+func TestNewSweeper(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	client, err := ethclient.Dial("http://127.0.0.1:8545")
+	assert.NoError(t, err)
+	token := common.HexToAddress("0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238")
+	des := common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+
+	_, err = NewSweeper(Config{TokenAddress: token, ProviderKey: key, Destination: des})
+	assert.Error(t, err)
+	_, err = NewSweeper(Config{Client: client, TokenAddress: token, Destination: des})
+	assert.Error(t, err)
+	_, err = NewSweeper(Config{Client: client, ProviderKey: key, Destination: des})
+	assert.Error(t, err)
+	_, err = NewSweeper(Config{Client: client, TokenAddress: token, ProviderKey: key})
+	assert.Error(t, err)
+	_, err = NewSweeper(Config{Client: client, TokenAddress: token, Native: true, ProviderKey: key, Destination: des})
+	assert.Error(t, err)
+	_, err = NewSweeper(Config{Client: client, Native: true, ProviderKey: key, Destination: des})
+	assert.NoError(t, err)
+	_, err = NewSweeper(Config{Client: client, Tokens: []util.Token{{}}, ProviderKey: key, Destination: des})
+	assert.Error(t, err, "a token without an address")
+	_, err = NewSweeper(Config{Client: client, TokenAddress: token, Tokens: []util.Token{{Address: token}, {}}, ProviderKey: key, Destination: des})
+	assert.Error(t, err, "a token without an address")
+
+	s, err := NewSweeper(Config{Client: client, TokenAddress: token, ProviderKey: key, Destination: des})
+	assert.NoError(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey), s.ProviderAddress())
+}
+
+// newSimSweeper builds a sweeper on a simulated chain, sweeping its token to a fresh destination
+func newSimSweeper(t *testing.T) (*Sweeper, *simchain.Chain) {
+	chain := simchain.New(t)
+	s, err := NewSweeper(Config{
+		Client:       chain.Client,
+		TokenAddress: chain.Token,
+		ProviderKey:  chain.FundedKey(t, big.NewInt(1e18)),
+		Destination:  common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+	})
+	assert.NoError(t, err)
+	return s, chain
+}
+
+func TestSweepMiddlewareSimulated(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 1)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	result, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), result.ProviderToMiddlewareReceipt.Status)
+	assert.Equal(t, FundingFull, result.FundingPath)
+	assert.NotNil(t, result.MiddlewareToDestinationTx)
+
+	receipt, err := bind.WaitMined(context.Background(), chain.Client, result.MiddlewareToDestinationTx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), receipt.Status)
+	assert.Equal(t, int64(0), chain.TokenBalance(t, chain.Token, middlewareWallet.Address).Int64())
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+
+	// not enough balance left for a second sweep
+	_, err = s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(20), big.NewInt(0))
+	assert.Error(t, err)
+}
+
+// One funding transaction pays gas for every registered token of a wallet
+func TestSweepWallet(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	second := chain.DeployToken(t, big.NewInt(1_000_000), "Tether", 6, "USDT")
+	treasury := common.HexToAddress("0x4B20993Bc481177ec7E8f571ceCaE8A9e22C02db")
+	third := chain.DeployToken(t, big.NewInt(1_000_000), "Dai", 18, "DAI")
+	s, err := NewSweeper(Config{
+		Client:       chain.Client,
+		TokenAddress: chain.Token,
+		Tokens: []util.Token{
+			{Address: second, Symbol: "USDT", Decimals: 6, Destination: treasury},
+			{Address: third, Symbol: "DAI", Decimals: 18, MinSweep: big.NewInt(100)},
+		},
+		ProviderKey: s.providerWalletPK,
+		Destination: s.desAddress,
+	})
+	assert.NoError(t, err)
+
+	middlewareWallet, privateKey := simchain.Wallet(t, 14)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+	chain.SendToken(t, second, middlewareWallet.Address, big.NewInt(30))
+	chain.SendToken(t, third, middlewareWallet.Address, big.NewInt(50)) // below its MinSweep
+
+	results, err := s.SweepWallet(context.Background(), middlewareWallet, privateKey, big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, FundingFull, results[0].FundingPath)
+	assert.NotNil(t, results[0].ProviderToMiddlewareReceipt)
+	rec, err := s.journal.Get(results[1].SweepID)
+	assert.NoError(t, err)
+	assert.Equal(t, results[0].SweepID, rec.FundedBy)
+
+	nonce, err := chain.Client.PendingNonceAt(context.Background(), s.providerWalletAddress)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), nonce, "a single funding transaction")
+	for _, result := range results {
+		receipt, err := bind.WaitMined(context.Background(), chain.Client, result.MiddlewareToDestinationTx)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), receipt.Status)
+	}
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+	assert.Equal(t, int64(30), chain.TokenBalance(t, second, treasury).Int64())
+	assert.Equal(t, int64(50), chain.TokenBalance(t, third, middlewareWallet.Address).Int64())
+}
+
+// Concurrent sweeps share the provider wallet without racing for its nonce
+func TestSweepMiddlewareConcurrent(t *testing.T) {
+	s, chain := newSimSweeper(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		middlewareWallet, privateKey := simchain.Wallet(t, uint32(30+i))
+		chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(5))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(5), big.NewInt(0))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
+
+// A wallet is swept by one call at a time
+func TestSweepWalletInProgress(t *testing.T) {
+	s, chain := newSimSweeper(t)
+	middlewareWallet, privateKey := simchain.Wallet(t, 34)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+
+	unlock, err := s.lockWallet(middlewareWallet.Address)
+	assert.NoError(t, err)
+	_, err = s.SweepWallet(context.Background(), middlewareWallet, privateKey, big.NewInt(0))
+	assert.ErrorIs(t, err, ErrSweepInProgress)
+	_, err = s.SweepMiddleware(middlewareWallet, privateKey, big.NewInt(1), big.NewInt(0))
+	assert.ErrorIs(t, err, ErrSweepInProgress)
+	results := s.SweepBatch(context.Background(), []BatchWallet{{Account: middlewareWallet, PrivateKey: privateKey}}, BatchOptions{})
+	assert.ErrorIs(t, results[0].Err, ErrSweepInProgress)
+	assert.Zero(t, chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+
+	unlock()
+	_, err = s.SweepWallet(context.Background(), middlewareWallet, privateKey, big.NewInt(0))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), chain.TokenBalance(t, chain.Token, s.desAddress).Int64())
+}
+
 // Performance testing
 // Simulates a number of transactions of the form:
 // 1. Provider sends USDC to middleware
@@ -21,18 +212,20 @@ import (
 // 3. Check if middleware funds are swept to destination
 // 4. Print gas usage for each transaction
 func TestHandleMiddleware(t *testing.T) {
+	s, mnemonic := sweeperFromEnv(t)
+
 	// Define test parameters
 	numWallets := 3
 	startWalletPath := 50
 	USDCAmount := big.NewInt(20)
 
 	fmt.Println("Starting middleware wallet test")
-	fmt.Println("Provider wallet:", providerWalletAddress.Hex())
+	fmt.Println("Provider wallet:", s.providerWalletAddress.Hex())
 
 	// Validate provider has enough USDC for tests
-	providerBalance, err := util.GetTokenBalance(client, usdcAddress, providerWalletAddress)
+	providerBalance, err := util.GetTokenBalance(s.client, s.tokenAddress, s.providerWalletAddress)
 	assert.NoError(t, err)
-	decimals, err := util.GetContractDecimals(client, usdcAddress)
+	decimals, err := util.GetContractDecimals(s.client, s.tokenAddress)
 	assert.NoError(t, err)
 	fmt.Printf("Provider USDC balance: %s (%s)\n",
 		providerBalance.String(),
@@ -48,7 +241,7 @@ func TestHandleMiddleware(t *testing.T) {
 		t.Run(fmt.Sprintf("Middleware%d", i), func(t *testing.T) {
 			// Derive a middleware wallet with a unique derivation path
 			derivationPath := fmt.Sprintf("m/44'/60'/0'/0/%d", startWalletPath+i)
-			middlewareWallet, privateKey, err := util.DeriveWallet(middlewareWalletMneumonic, derivationPath)
+			middlewareWallet, privateKey, err := util.DeriveWallet(mnemonic, derivationPath)
 			assert.NoError(t, err)
 
 			fmt.Printf("\nTest %d: Using middleware wallet: %s\n", i+1, middlewareWallet.Address.Hex())
@@ -56,11 +249,11 @@ func TestHandleMiddleware(t *testing.T) {
 			fmt.Printf("\tPrivate key: %x \n", crypto.FromECDSA(privateKey))
 
 			// Fund the middleware wallet
-			err = sendUSDCToMiddleware(middlewareWallet.Address, USDCAmount)
+			err = sendUSDCToMiddleware(s, middlewareWallet.Address, USDCAmount)
 			assert.NoError(t, err)
 
 			// Verify middleware received the funds
-			balance, err := util.GetTokenBalance(client, usdcAddress, middlewareWallet.Address)
+			balance, err := util.GetTokenBalance(s.client, s.tokenAddress, middlewareWallet.Address)
 			balance = util.ToSmallestUnit(balance, decimals)
 			assert.NoError(t, err)
 			fmt.Printf("Middleware received %s USDC\n",
@@ -69,7 +262,7 @@ func TestHandleMiddleware(t *testing.T) {
 
 			// Now handle the middleware wallet (sweep funds)
 			startTime := time.Now()
-			result, err := SweepMiddleware(middlewareWallet, privateKey, USDCAmount, big.NewInt(0))
+			result, err := s.SweepMiddleware(middlewareWallet, privateKey, USDCAmount, big.NewInt(0))
 			elapsedTime := time.Since(startTime)
 
 			assert.NoError(t, err)
@@ -81,13 +274,13 @@ func TestHandleMiddleware(t *testing.T) {
 
 			// Wait for the sweep transaction to be mined
 			fmt.Println("\tWaiting for sweep transaction to be confirmed...")
-			sweepReceipt, err := bind.WaitMined(context.Background(), client, result.MiddlewareToDestinationTx)
+			sweepReceipt, err := bind.WaitMined(context.Background(), s.client, result.MiddlewareToDestinationTx)
 			assert.NoError(t, err)
 			fmt.Printf("\tSweep transaction confirmed in block %d\n", sweepReceipt.BlockNumber.Uint64())
 			assert.Equal(t, uint64(1), sweepReceipt.Status, "2nd Transaction should be successful")
 
 			// Verify middleware wallet balance is now 0
-			balanceAfter, err := util.GetTokenBalance(client, usdcAddress, middlewareWallet.Address)
+			balanceAfter, err := util.GetTokenBalance(s.client, s.tokenAddress, middlewareWallet.Address)
 			assert.NoError(t, err)
 			assert.Equal(t, 0, balanceAfter.Cmp(big.NewInt(0)), "Middleware wallet should be empty after sweep")
 
@@ -97,7 +290,7 @@ func TestHandleMiddleware(t *testing.T) {
 				sweepReceipt.GasUsed, result.GasUnit, sweepEfficiency)
 
 			// Check leftover ETH balance at middleware wallet
-			ethBalance, err := client.BalanceAt(context.Background(), middlewareWallet.Address, nil)
+			ethBalance, err := s.client.BalanceAt(context.Background(), middlewareWallet.Address, nil)
 			assert.NoError(t, err)
 			ethBalanceF, _ := ethBalance.Float64()
 			middlewareGasFee, _ := new(big.Int).Mul(result.GasFeeCap, big.NewInt(int64(result.GasUnit))).Float64()
@@ -109,13 +302,13 @@ func TestHandleMiddleware(t *testing.T) {
 }
 
 // Helper function to send USDC from provider to middleware
-func sendUSDCToMiddleware(middlewareAddr common.Address, amount *big.Int) error {
-	header, err := client.HeaderByNumber(context.Background(), nil)
+func sendUSDCToMiddleware(s *Sweeper, middlewareAddr common.Address, amount *big.Int) error {
+	header, err := s.client.HeaderByNumber(context.Background(), nil)
 	if err != nil {
 		return err
 	}
 
-	gasTipCap, err := client.SuggestGasTipCap(context.Background())
+	gasTipCap, err := s.client.SuggestGasTipCap(context.Background())
 	if err != nil {
 		return err
 	}
@@ -125,15 +318,15 @@ func sendUSDCToMiddleware(middlewareAddr common.Address, amount *big.Int) error
 	fmt.Printf("Sending %s USDC to middleware\n",
 		util.ToSmallestUnit(amount, 6))
 
-	tx, err := util.SendTokenTx(usdcAddress, &util.TxInput{
-		Client:     client,
-		From:       providerWalletAddress,
+	tx, err := util.SendTokenTx(s.tokenAddress, &util.TxInput{
+		Client:     s.client,
+		From:       s.providerWalletAddress,
 		To:         middlewareAddr,
 		Amount:     amount,
 		GasTipCap:  gasTipCap,
 		GasFeeCap:  gasFeeCap,
 		GasUnit:    65000,
-		PrivateKey: providerWalletPK,
+		PrivateKey: s.providerWalletPK,
 	})
 
 	if err != nil {
@@ -142,7 +335,7 @@ func sendUSDCToMiddleware(middlewareAddr common.Address, amount *big.Int) error
 
 	fmt.Printf("\tFund transfer initiated, tx: %s\n", tx.Hash().Hex())
 	// Wait for the transaction to be mined
-	receipt, err := bind.WaitMined(context.Background(), client, tx)
+	receipt, err := bind.WaitMined(context.Background(), s.client, tx)
 	if err != nil {
 		return fmt.Errorf("error waiting for transaction to be mined: %w", err)
 	}
@@ -0,0 +1,137 @@
+package reciever
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const sweepsSchema = `
+CREATE TABLE IF NOT EXISTS sweeps (
+	id         TEXT PRIMARY KEY,
+	middleware TEXT NOT NULL,
+	state      TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	record     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sweeps_middleware ON sweeps (middleware, created_at);
+CREATE INDEX IF NOT EXISTS sweeps_state ON sweeps (state, created_at)`
+
+// SQLiteJournal keeps records in a SQLite database, a row per sweep. A save writes only
+// its own row, so processes sharing the database see each other's records, unlike
+// FileJournal, which rewrites every record it loaded.
+type SQLiteJournal struct {
+	db *sql.DB
+	// OnSave, if set, is called with each record in the transaction saving it, so what it
+	// writes, such as the record's webhook (see webhooks.SQLiteOutbox.SweepSaved), is
+	// committed with the record or not at all.
+	OnSave func(tx *sql.Tx, rec *SweepRecord) error
+}
+
+// NewSQLiteJournal creates the sweeps table in db if it does not exist.
+func NewSQLiteJournal(db *sql.DB) (*SQLiteJournal, error) {
+	if _, err := db.Exec(sweepsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteJournal{db: db}, nil
+}
+
+func (j *SQLiteJournal) Save(rec *SweepRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO sweeps (id, middleware, state, created_at, record) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET middleware = excluded.middleware, state = excluded.state,
+			created_at = excluded.created_at, record = excluded.record`,
+		rec.ID, rec.Middleware.Hex(), rec.State, rec.CreatedAt.UnixNano(), string(data)); err != nil {
+		return err
+	}
+	if j.OnSave != nil {
+		if err := j.OnSave(tx, rec); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (j *SQLiteJournal) Get(id string) (*SweepRecord, error) {
+	var data string
+	err := j.db.QueryRow(`SELECT record FROM sweeps WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSweepNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeRecord(data)
+}
+
+func (j *SQLiteJournal) Unfinished() ([]*SweepRecord, error) {
+	return j.query(`SELECT record FROM sweeps WHERE state NOT IN (?, ?) ORDER BY created_at`, StateConfirmed, StateFailed)
+}
+
+func (j *SQLiteJournal) ByMiddleware(middleware common.Address) ([]*SweepRecord, error) {
+	return j.query(`SELECT record FROM sweeps WHERE middleware = ? ORDER BY created_at`, middleware.Hex())
+}
+
+func (j *SQLiteJournal) query(query string, args ...any) ([]*SweepRecord, error) {
+	rows, err := j.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []*SweepRecord
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		rec, err := decodeRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func decodeRecord(data string) (*SweepRecord, error) {
+	var rec SweepRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// CopyUnfinished saves the unfinished sweeps of from that to does not hold into to, such
+// as when moving from a journal file to a database, so they are resumed from to. It
+// returns how many it copied.
+func CopyUnfinished(from Journal, to Journal) (int, error) {
+	recs, err := from.Unfinished()
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, rec := range recs {
+		// to's record, if any, is the later one
+		if _, err := to.Get(rec.ID); !errors.Is(err, ErrSweepNotFound) {
+			if err != nil {
+				return copied, err
+			}
+			continue
+		}
+		if err := to.Save(rec); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
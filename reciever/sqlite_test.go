@@ -0,0 +1,78 @@
+package reciever
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/testdb"
+)
+
+func TestSQLiteJournal(t *testing.T) {
+	db := testdb.Open(t)
+	journal, err := NewSQLiteJournal(db)
+	assert.NoError(t, err)
+	// another process on the same database
+	other, err := NewSQLiteJournal(db)
+	assert.NoError(t, err)
+
+	middleware := common.HexToAddress("0x01")
+	rec := &SweepRecord{ID: "a", State: StatePlanned, Middleware: middleware, Amount: big.NewInt(20),
+		FundingTx: common.HexToHash("0x02"), CreatedAt: time.Unix(1700000000, 0)}
+	assert.NoError(t, journal.Save(rec))
+	assert.NoError(t, other.Save(&SweepRecord{ID: "b", State: StateConfirmed, Middleware: middleware, CreatedAt: time.Unix(1700000001, 0)}))
+
+	got, err := other.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), got.Amount.Int64())
+	assert.Equal(t, rec.FundingTx, got.FundingTx)
+	recs, err := journal.ByMiddleware(middleware)
+	assert.NoError(t, err)
+	if assert.Len(t, recs, 2) {
+		assert.Equal(t, "a", recs[0].ID)
+		assert.Equal(t, "b", recs[1].ID)
+	}
+	recs, err = journal.Unfinished()
+	assert.NoError(t, err)
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "a", recs[0].ID)
+	}
+
+	rec.State = StateGasFunded
+	assert.NoError(t, journal.Save(rec))
+	got, err = other.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, StateGasFunded, got.State)
+	_, err = other.Get("c")
+	assert.ErrorIs(t, err, ErrSweepNotFound)
+}
+
+// Unfinished sweeps of a journal file move over, without replacing later states
+func TestCopyUnfinished(t *testing.T) {
+	journal, err := NewSQLiteJournal(testdb.Open(t))
+	assert.NoError(t, err)
+	middleware := common.HexToAddress("0x01")
+	assert.NoError(t, journal.Save(&SweepRecord{ID: "a", ChainID: 1, State: StateGasFunded, Middleware: middleware}))
+
+	file, err := OpenFileJournal(filepath.Join(t.TempDir(), "journal.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Save(&SweepRecord{ID: "a", ChainID: 1, State: StatePlanned, Middleware: middleware}))
+	assert.NoError(t, file.Save(&SweepRecord{ID: "b", ChainID: 1, State: StateTokenSent, Middleware: middleware}))
+	assert.NoError(t, file.Save(&SweepRecord{ID: "c", ChainID: 1, State: StateConfirmed, Middleware: middleware}))
+	copied, err := CopyUnfinished(file, journal)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, copied)
+
+	got, err := journal.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, StateGasFunded, got.State)
+	got, err = journal.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, StateTokenSent, got.State)
+	_, err = journal.Get("c")
+	assert.ErrorIs(t, err, ErrSweepNotFound)
+}
@@ -0,0 +1,114 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// maxAllocateAttempts bounds retries when another process takes the same index first
+const maxAllocateAttempts = 20
+
+// Allocator hands out deposit addresses: middleware wallets derived at basePath/<index>,
+// each index used once. Reservation relies on the registry rejecting a second wallet
+// with the same index, so allocators in different processes can share a registry.
+// A registry must only be used with a single base path.
+type Allocator struct {
+	registry  WalletRegistry
+	addressAt func(path string) (common.Address, error)
+	basePath  string
+
+	mu sync.Mutex
+}
+
+// NewAllocator derives addresses from the middleware mnemonic.
+func NewAllocator(registry WalletRegistry, mnemonic string, basePath string) (*Allocator, error) {
+	if _, err := accounts.ParseDerivationPath(basePath); err != nil {
+		return nil, fmt.Errorf("invalid base path %q: %w", basePath, err)
+	}
+	wallet, err := util.NewHDWallet(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	addressAt := func(path string) (common.Address, error) {
+		account, _, err := wallet.Derive(path)
+		if err != nil {
+			return common.Address{}, err
+		}
+		return account.Address, nil
+	}
+	return &Allocator{registry: registry, addressAt: addressAt, basePath: basePath}, nil
+}
+
+// NewWatchOnlyAllocator derives addresses from an extended public key, for services that
+// hand out addresses but must not hold private keys. basePath must lie below the wallet's
+// path with no hardened components in between; the sweeper derives the private keys for
+// the same paths from the mnemonic.
+func NewWatchOnlyAllocator(registry WalletRegistry, wallet *util.WatchOnlyWallet, basePath string) (*Allocator, error) {
+	if _, err := accounts.ParseDerivationPath(basePath); err != nil {
+		return nil, fmt.Errorf("invalid base path %q: %w", basePath, err)
+	}
+	if _, err := wallet.Address(basePath); err != nil {
+		return nil, err
+	}
+	return &Allocator{registry: registry, addressAt: wallet.Address, basePath: basePath}, nil
+}
+
+// Allocate reserves the next unused index, derives its address and records it as an
+// active wallet owned by customer and invoice.
+func (a *Allocator) Allocate(customer string, invoice string) (*Wallet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for attempt := 0; attempt < maxAllocateAttempts; attempt++ {
+		index, err := a.registry.NextIndex()
+		if err != nil {
+			return nil, err
+		}
+		if index > math.MaxInt32 {
+			return nil, fmt.Errorf("no unhardened index left under %s", a.basePath)
+		}
+		address, err := a.Address(index)
+		if err != nil {
+			return nil, err
+		}
+
+		w := &Wallet{Index: index, Address: address, Customer: customer, Invoice: invoice, Status: StatusActive}
+		err = a.registry.Add(w)
+		if errors.Is(err, ErrWalletExists) {
+			continue // taken by another process in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("could not reserve an index after %d attempts", maxAllocateAttempts)
+}
+
+// Path returns the derivation path of index.
+func (a *Allocator) Path(index uint32) string {
+	return fmt.Sprintf("%s/%d", a.basePath, index)
+}
+
+// Address derives the address at index, e.g. to audit a registered wallet.
+func (a *Allocator) Address(index uint32) (common.Address, error) {
+	return a.addressAt(a.Path(index))
+}
+
+// Verify checks that a registered wallet's address is the one derived from its index.
+func (a *Allocator) Verify(w *Wallet) error {
+	address, err := a.Address(w.Index)
+	if err != nil {
+		return err
+	}
+	if address != w.Address {
+		return fmt.Errorf("%s derives %s, registry has %s", a.Path(w.Index), address.Hex(), w.Address.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+func TestAllocatorAddress(t *testing.T) {
+	a, err := NewAllocator(NewMemoryRegistry(), simchain.Mnemonic, simchain.BasePath)
+	assert.NoError(t, err)
+
+	// hardhat's first account
+	address, err := a.Address(0)
+	assert.NoError(t, err)
+	assert.Equal(t, common.HexToAddress("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"), address)
+
+	_, err = NewAllocator(NewMemoryRegistry(), simchain.Mnemonic, "not a path")
+	assert.Error(t, err)
+}
+
+// An allocator holding only the xpub hands out the addresses the mnemonic derives
+func TestWatchOnlyAllocator(t *testing.T) {
+	xpub, err := util.ExtendedPublicKey(simchain.Mnemonic, "m/44'/60'/0'")
+	assert.NoError(t, err)
+	wallet, err := util.NewWatchOnlyWallet(xpub, "m/44'/60'/0'")
+	assert.NoError(t, err)
+
+	reg := NewMemoryRegistry()
+	watchOnly, err := NewWatchOnlyAllocator(reg, wallet, simchain.BasePath)
+	assert.NoError(t, err)
+	sweeper, err := NewAllocator(reg, simchain.Mnemonic, simchain.BasePath)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		w, err := watchOnly.Allocate("cus_1", "")
+		assert.NoError(t, err)
+		assert.NoError(t, sweeper.Verify(w))
+	}
+
+	_, err = NewWatchOnlyAllocator(reg, wallet, "m/44'/60'/0'/0'")
+	assert.Error(t, err, "hardened base path cannot be derived from an xpub")
+}
+
+// Two allocators (as in two processes) sharing a registry never hand out the same address
+func TestAllocateConcurrently(t *testing.T) {
+	for name, reg := range registries(t) {
+		t.Run(name, func(t *testing.T) {
+			a1, err := NewAllocator(reg, simchain.Mnemonic, simchain.BasePath)
+			assert.NoError(t, err)
+			a2, err := NewAllocator(reg, simchain.Mnemonic, simchain.BasePath)
+			assert.NoError(t, err)
+
+			const n = 10
+			wallets := make(chan *Wallet, 2*n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				for _, a := range []*Allocator{a1, a2} {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						w, err := a.Allocate("cus_1", "")
+						assert.NoError(t, err)
+						wallets <- w
+					}()
+				}
+			}
+			wg.Wait()
+			close(wallets)
+
+			seen := make(map[common.Address]bool)
+			for w := range wallets {
+				if w == nil {
+					continue
+				}
+				assert.False(t, seen[w.Address], "address %s handed out twice", w.Address.Hex())
+				seen[w.Address] = true
+				assert.NoError(t, a1.Verify(w))
+			}
+			assert.Len(t, seen, 2*n)
+
+			next, err := reg.NextIndex()
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(2*n), next)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Package registry keeps track of the middleware wallets derived for customers.
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type Status string
+
+const (
+	StatusActive  Status = "active"  // handed out, checked for payments
+	StatusRetired Status = "retired" // no longer checked
+)
+
+// Wallet is a middleware wallet derived at Index under the middleware base path.
+type Wallet struct {
+	Index    uint32
+	Address  common.Address
+	Customer string // owning customer, if any
+	Invoice  string // owning invoice, if any
+	Status   Status
+	// LastSweptBlock is the block of the wallet's latest confirmed token sweep. A block
+	// number names no block without its chain, so it is only recorded when a single chain
+	// is swept, and stays 0 otherwise.
+	LastSweptBlock uint64
+}
+
+// WalletRegistry stores middleware wallets.
+type WalletRegistry interface {
+	// Add stores a new wallet. Derivation index and address must both be unused.
+	Add(w *Wallet) error
+	Get(address common.Address) (*Wallet, error)
+	// Active returns active wallets ordered by derivation index.
+	Active() ([]*Wallet, error)
+	SetStatus(address common.Address, status Status) error
+	SetLastSweptBlock(address common.Address, block uint64) error
+	// NextIndex returns one past the highest derivation index ever registered, retired
+	// wallets included, or 0 for an empty registry.
+	NextIndex() (uint32, error)
+}
+
+var (
+	ErrWalletNotFound = errors.New("wallet not found")
+	ErrWalletExists   = errors.New("wallet index or address already registered")
+)
+
+// MemoryRegistry keeps wallets in a map of the process, so an index is only reserved
+// once among allocators of that process.
+type MemoryRegistry struct {
+	mu      sync.Mutex
+	wallets map[common.Address]*Wallet
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{wallets: make(map[common.Address]*Wallet)}
+}
+
+func (r *MemoryRegistry) Add(w *Wallet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.wallets {
+		if existing.Index == w.Index || existing.Address == w.Address {
+			return ErrWalletExists
+		}
+	}
+	c := *w
+	r.wallets[w.Address] = &c
+	return nil
+}
+
+func (r *MemoryRegistry) Get(address common.Address) (*Wallet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.wallets[address]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	c := *w
+	return &c, nil
+}
+
+func (r *MemoryRegistry) Active() ([]*Wallet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var wallets []*Wallet
+	for _, w := range r.wallets {
+		if w.Status == StatusActive {
+			c := *w
+			wallets = append(wallets, &c)
+		}
+	}
+	sort.Slice(wallets, func(a, b int) bool {
+		return wallets[a].Index < wallets[b].Index
+	})
+	return wallets, nil
+}
+
+func (r *MemoryRegistry) SetStatus(address common.Address, status Status) error {
+	return r.update(address, func(w *Wallet) { w.Status = status })
+}
+
+func (r *MemoryRegistry) SetLastSweptBlock(address common.Address, block uint64) error {
+	return r.update(address, func(w *Wallet) { w.LastSweptBlock = block })
+}
+
+func (r *MemoryRegistry) NextIndex() (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var next uint32
+	for _, w := range r.wallets {
+		if w.Index >= next {
+			next = w.Index + 1
+		}
+	}
+	return next, nil
+}
+
+func (r *MemoryRegistry) update(address common.Address, fn func(w *Wallet)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.wallets[address]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	fn(w)
+	return nil
+}
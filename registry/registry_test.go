@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// registries returns every WalletRegistry implementation, empty
+func registries(t *testing.T) map[string]WalletRegistry {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "wallets.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	sqlite, err := NewSQLiteRegistry(db)
+	assert.NoError(t, err)
+
+	return map[string]WalletRegistry{
+		"memory": NewMemoryRegistry(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestWalletRegistry(t *testing.T) {
+	a := common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+	b := common.HexToAddress("0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238")
+	c := common.HexToAddress("0x8464135c8F25Da09e49BC8782676a84730C318bC")
+
+	for name, reg := range registries(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, reg.Add(&Wallet{Index: 2, Address: b, Customer: "cus_1", Invoice: "inv_1", Status: StatusActive}))
+			assert.NoError(t, reg.Add(&Wallet{Index: 1, Address: a, Status: StatusActive}))
+			assert.NoError(t, reg.Add(&Wallet{Index: 3, Address: c, Status: StatusRetired}))
+
+			assert.ErrorIs(t, reg.Add(&Wallet{Index: 1, Address: common.HexToAddress("0x01"), Status: StatusActive}), ErrWalletExists)
+			assert.ErrorIs(t, reg.Add(&Wallet{Index: 9, Address: a, Status: StatusActive}), ErrWalletExists)
+
+			active, err := reg.Active()
+			assert.NoError(t, err)
+			if assert.Len(t, active, 2) {
+				assert.Equal(t, a, active[0].Address)
+				assert.Equal(t, b, active[1].Address)
+				assert.Equal(t, "inv_1", active[1].Invoice)
+			}
+
+			assert.NoError(t, reg.SetLastSweptBlock(b, 42))
+			assert.NoError(t, reg.SetStatus(a, StatusRetired))
+			w, err := reg.Get(b)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(42), w.LastSweptBlock)
+			assert.Equal(t, "cus_1", w.Customer)
+
+			active, err = reg.Active()
+			assert.NoError(t, err)
+			assert.Len(t, active, 1)
+
+			_, err = reg.Get(common.HexToAddress("0x02"))
+			assert.ErrorIs(t, err, ErrWalletNotFound)
+			assert.ErrorIs(t, reg.SetStatus(common.HexToAddress("0x02"), StatusActive), ErrWalletNotFound)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	_ "modernc.org/sqlite"
+)
+
+const walletsSchema = `
+CREATE TABLE IF NOT EXISTS wallets (
+	address          TEXT PRIMARY KEY,
+	derivation_index INTEGER NOT NULL UNIQUE,
+	customer         TEXT NOT NULL DEFAULT '',
+	invoice          TEXT NOT NULL DEFAULT '',
+	status           TEXT NOT NULL,
+	last_swept_block INTEGER NOT NULL DEFAULT 0
+)`
+
+// SQLiteRegistry stores wallets in a SQLite database.
+type SQLiteRegistry struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (creating if needed) the SQLite database at path.
+func OpenSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewSQLiteRegistry creates the wallets table in db if it does not exist.
+func NewSQLiteRegistry(db *sql.DB) (*SQLiteRegistry, error) {
+	if _, err := db.Exec(walletsSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteRegistry{db: db}, nil
+}
+
+func (r *SQLiteRegistry) Add(w *Wallet) error {
+	_, err := r.db.Exec(`INSERT INTO wallets (address, derivation_index, customer, invoice, status, last_swept_block)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		w.Address.Hex(), w.Index, w.Customer, w.Invoice, string(w.Status), w.LastSweptBlock)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrWalletExists
+	}
+	return err
+}
+
+func (r *SQLiteRegistry) Get(address common.Address) (*Wallet, error) {
+	row := r.db.QueryRow(`SELECT address, derivation_index, customer, invoice, status, last_swept_block
+		FROM wallets WHERE address = ?`, address.Hex())
+	w, err := scanWallet(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	return w, err
+}
+
+func (r *SQLiteRegistry) Active() ([]*Wallet, error) {
+	rows, err := r.db.Query(`SELECT address, derivation_index, customer, invoice, status, last_swept_block
+		FROM wallets WHERE status = ? ORDER BY derivation_index`, string(StatusActive))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wallets []*Wallet
+	for rows.Next() {
+		w, err := scanWallet(rows)
+		if err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, w)
+	}
+	return wallets, rows.Err()
+}
+
+func (r *SQLiteRegistry) SetStatus(address common.Address, status Status) error {
+	return r.update(`UPDATE wallets SET status = ? WHERE address = ?`, string(status), address.Hex())
+}
+
+func (r *SQLiteRegistry) SetLastSweptBlock(address common.Address, block uint64) error {
+	return r.update(`UPDATE wallets SET last_swept_block = ? WHERE address = ?`, block, address.Hex())
+}
+
+func (r *SQLiteRegistry) NextIndex() (uint32, error) {
+	var next uint32
+	err := r.db.QueryRow(`SELECT COALESCE(MAX(derivation_index) + 1, 0) FROM wallets`).Scan(&next)
+	return next, err
+}
+
+func (r *SQLiteRegistry) update(query string, args ...any) error {
+	res, err := r.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWalletNotFound
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWallet(row scanner) (*Wallet, error) {
+	var w Wallet
+	var address, status string
+	if err := row.Scan(&address, &w.Index, &w.Customer, &w.Invoice, &status, &w.LastSweptBlock); err != nil {
+		return nil, err
+	}
+	w.Address = common.HexToAddress(address)
+	w.Status = Status(status)
+	return &w, nil
+}
@@ -0,0 +1,180 @@
+// Package simchain runs an in-process chain for tests: go-ethereum's simulated backend,
+// wrapped so that every transaction is mined as soon as it is sent (like a hardhat node
+// with automine), with a funded account and an ERC-20 token deployed by that account.
+package simchain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+// ChainID of the simulated backend.
+var ChainID = big.NewInt(1337)
+
+// TokenDecimals of the token deployed by New.
+const TokenDecimals = 6
+
+type Chain struct {
+	Backend *simulated.Backend
+	Client  *Client
+
+	FunderKey *ecdsa.PrivateKey // holds plenty of ETH and the whole token supply
+	Funder    common.Address
+	Token     common.Address
+}
+
+// Client is the simulated backend client, mining a block after every sent transaction
+// unless auto-mining is turned off.
+type Client struct {
+	simulated.Client
+	backend *simulated.Backend
+
+	mu     sync.Mutex
+	manual bool
+}
+
+// SetAutoMine turns mining after every sent transaction on or off. While it is off, sent
+// transactions stay pending until Backend.Commit is called, as on a congested chain.
+func (c *Client) SetAutoMine(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manual = !on
+}
+
+func (c *Client) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Client.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+	if !c.manual {
+		c.backend.Commit()
+	}
+	return nil
+}
+
+var _ util.Backend = (*Client)(nil)
+
+// New starts a simulated chain, closed when the test ends.
+func New(t testing.TB) *Chain {
+	t.Helper()
+	return NewWithAlloc(t, nil)
+}
+
+// NewWithAlloc starts a simulated chain with more accounts in its genesis, such as
+// stand-ins for the predeployed contracts of a rollup.
+func NewWithAlloc(t testing.TB, alloc types.GenesisAlloc) *Chain {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	funder := crypto.PubkeyToAddress(key.PublicKey)
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+	genesis := types.GenesisAlloc{
+		funder: {Balance: new(big.Int).Mul(ether, big.NewInt(1000))},
+	}
+	for address, account := range alloc {
+		genesis[address] = account
+	}
+	backend := simulated.NewBackend(genesis)
+	t.Cleanup(func() { backend.Close() })
+
+	c := &Chain{
+		Backend:   backend,
+		Client:    &Client{Client: backend.Client(), backend: backend},
+		FunderKey: key,
+		Funder:    funder,
+	}
+	c.Token = c.DeployToken(t, big.NewInt(1_000_000_000_000), "USD Coin", TokenDecimals, "USDC")
+	return c
+}
+
+// DeployToken deploys another token owned by the funder.
+func (c *Chain) DeployToken(t testing.TB, supply *big.Int, name string, decimals uint8, symbol string) common.Address {
+	t.Helper()
+	parsed, err := abi.JSON(strings.NewReader(tokenABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, _, _, err := bind.DeployContract(c.transactor(t), parsed, common.FromHex(tokenBin), c.Client, supply, name, decimals, symbol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+// SendETH sends wei from the funder to an address.
+func (c *Chain) SendETH(t testing.TB, to common.Address, wei *big.Int) {
+	t.Helper()
+	c.send(t, &util.TxInput{To: to, Amount: wei, GasUnit: 21000})
+}
+
+// SendToken sends token units from the funder to an address.
+func (c *Chain) SendToken(t testing.TB, token common.Address, to common.Address, amount *big.Int) {
+	t.Helper()
+	c.send(t, &util.TxInput{To: token, Amount: big.NewInt(0), GasUnit: 100000, Data: util.BuildTokenTxDataField(to, amount)})
+}
+
+// Balance returns the ETH balance of an address.
+func (c *Chain) Balance(t testing.TB, account common.Address) *big.Int {
+	t.Helper()
+	balance, err := c.Client.BalanceAt(context.Background(), account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// TokenBalance returns the token balance of an address.
+func (c *Chain) TokenBalance(t testing.TB, token common.Address, account common.Address) *big.Int {
+	t.Helper()
+	balance, err := util.GetTokenBalance(c.Client, token, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func (c *Chain) send(t testing.TB, input *util.TxInput) {
+	t.Helper()
+	header, err := c.Client.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := c.Client.SuggestGasTipCap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.Client = c.Client
+	input.From = c.Funder
+	input.PrivateKey = c.FunderKey
+	input.GasTipCap = tip
+	input.GasFeeCap = new(big.Int).Add(new(big.Int).Mul(header.BaseFee, big.NewInt(2)), input.GasTipCap)
+	if _, err := util.SendTx(input); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *Chain) transactor(t testing.TB) *bind.TransactOpts {
+	t.Helper()
+	auth, err := bind.NewKeyedTransactorWithChainID(c.FunderKey, ChainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
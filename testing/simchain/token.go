@@ -0,0 +1,50 @@
+package simchain
+
+// tokenABI and tokenBin are the ethereum.org sample token, the same contract go-ethereum's
+// binding tests compile. Its constructor is
+// (uint256 initialSupply, string tokenName, uint8 decimalUnits, string tokenSymbol)
+// and it mints the whole supply to the deployer.
+const tokenABI = `[{"constant":true,"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"type":"function"},{"constant":false,"inputs":[{"name":"_from","type":"address"},{"name":"_to","type":"address"},{"name":"_value","type":"uint256"}],"name":"transferFrom","outputs":[{"name":"success","type":"bool"}],"type":"function"},{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"type":"function"},{"constant":true,"inputs":[{"name":"","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"type":"function"},{"constant":true,"inputs":[],"name":"symbol","outputs":[{"name":"","type":"string"}],"type":"function"},{"constant":false,"inputs":[{"name":"_to","type":"address"},{"name":"_value","type":"uint256"}],"name":"transfer","outputs":[],"type":"function"},{"constant":false,"inputs":[{"name":"_spender","type":"address"},{"name":"_value","type":"uint256"},{"name":"_extraData","type":"bytes"}],"name":"approveAndCall","outputs":[{"name":"success","type":"bool"}],"type":"function"},{"constant":true,"inputs":[{"name":"","type":"address"},{"name":"","type":"address"}],"name":"spentAllowance","outputs":[{"name":"","type":"uint256"}],"type":"function"},{"constant":true,"inputs":[{"name":"","type":"address"},{"name":"","type":"address"}],"name":"allowance","outputs":[{"name":"","type":"uint256"}],"type":"function"},{"inputs":[{"name":"initialSupply","type":"uint256"},{"name":"tokenName","type":"string"},{"name":"decimalUnits","type":"uint8"},{"name":"tokenSymbol","type":"string"}],"type":"constructor"},{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"}]`
+
+const tokenBin = "" +
+	"60606040526040516107fd3803806107fd83398101604052805160805160a05160c051929391820192909101600160a06002" +
+	"0a0333166000908152600360209081526040822086905581548551838052601f600260001961010060018616150201909316" +
+	"9290920482018390047f290decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e5639081019391929091" +
+	"8801908390106100e857805160ff19168380011785555b506101189291505b8082111561017157600081556001016100b456" +
+	"5b50506002805460ff19168317905550505050610658806101a56000396000f35b828001600101855582156100ac57918201" +
+	"5b828111156100ac5782518260005055916020019190600101906100fa565b50508060016000509080519060200190828054" +
+	"600181600116156101000203166002900490600052602060002090601f016020900481019282601f1061017557805160ff19" +
+	"168380011785555b506100c89291506100b4565b5090565b82800160010185558215610165579182015b8281111561016557" +
+	"825182600050559160200191906001019061018756606060405236156100775760e060020a600035046306fdde0381146100" +
+	"7f57806323b872dd146100dc578063313ce5671461010e57806370a082311461011a57806395d89b4114610132578063a905" +
+	"9cbb1461018e578063cae9ca51146101bd578063dc3080f21461031c578063dd62ed3e14610341575b610365610002565b61" +
+	"036760008054602060026001831615610100026000190190921691909104601f810182900490910260809081016040526060" +
+	"828152929190828280156104eb5780601f106104c0576101008083540402835291602001916104eb565b6103d56004356024" +
+	"35604435600160a060020a038316600090815260036020526040812054829010156104f357610002565b6103e760025460ff" +
+	"1681565b6103d560043560036020526000908152604090205481565b61036760018054602060028284161561010002600019" +
+	"0190921691909104601f810182900490910260809081016040526060828152929190828280156104eb5780601f106104c057" +
+	"6101008083540402835291602001916104eb565b610365600435602435600160a060020a0333166000908152600360205260" +
+	"40902054819010156103f157610002565b60806020604435600481810135601f810184900490930284016040526060838152" +
+	"6103d59482359460248035956064949391019190819083828082843750949650505050505050600060008360046000506000" +
+	"33600160a060020a03168152602001908152602001600020600050600087600160a060020a03168152602001908152602001" +
+	"6000206000508190555084905080600160a060020a0316638f4ffcb1338630876040518560e060020a028152600401808560" +
+	"0160a060020a0316815260200184815260200183600160a060020a0316815260200180602001828103825283818151815260" +
+	"2001915080519060200190808383829060006004602084601f0104600f02600301f150905090810190601f1680156102f257" +
+	"80820380516001836020036101000a031916815260200191505b50955050505050506000604051808303816000876161da5a" +
+	"03f11561000257505050509392505050565b6005602090815260043560009081526040808220909252602435815220546103" +
+	"d59081565b60046020818152903560009081526040808220909252602435815220546103d59081565b005b60405180806020" +
+	"018281038252838181518152602001915080519060200190808383829060006004602084601f0104600f02600301f1509050" +
+	"90810190601f1680156103c75780820380516001836020036101000a031916815260200191505b5092505050604051809103" +
+	"90f35b60408051918252519081900360200190f35b6060908152602090f35b600160a060020a038216600090815260409020" +
+	"54808201101561041357610002565b806003600050600033600160a060020a03168152602001908152602001600020600082" +
+	"828250540392505081905550806003600050600084600160a060020a03168152602001908152602001600020600082828250" +
+	"54019250508190555081600160a060020a031633600160a060020a03167fddf252ad1be2c89b69c2b068fc378daa952ba7f1" +
+	"63c4a11628f55a4df523b3ef836040518082815260200191505060405180910390a35050565b820191906000526020600020" +
+	"905b8154815290600101906020018083116104ce57829003601f168201915b505050505081565b600160a060020a03831681" +
+	"526040812054808301101561051257610002565b600160a060020a0380851680835260046020908152604080852033949094" +
+	"168086529382528085205492855260058252808520938552929052908220548301111561055c57610002565b816003600050" +
+	"600086600160a060020a03168152602001908152602001600020600082828250540392505081905550816003600050600085" +
+	"600160a060020a03168152602001908152602001600020600082828250540192505081905550816005600050600086600160" +
+	"a060020a03168152602001908152602001600020600050600033600160a060020a0316815260200190815260200160002060" +
+	"008282825054019250508190555082600160a060020a031633600160a060020a03167fddf252ad1be2c89b69c2b068fc378d" +
+	"aa952ba7f163c4a11628f55a4df523b3ef846040518082815260200191505060405180910390a3939250505056"
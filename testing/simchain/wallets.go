@@ -0,0 +1,51 @@
+package simchain
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"allen-liaoo/payment-reciever/util"
+)
+
+const (
+	// Mnemonic is hardhat's default mnemonic, which tests derive middleware wallets from.
+	Mnemonic = "test test test test test test test test test test test junk"
+	// BasePath is the path the middleware wallets of Mnemonic are derived below.
+	BasePath = "m/44'/60'/0'/0"
+)
+
+// the seed of Mnemonic, computed once for every test of the binary
+var hdWallet = sync.OnceValues(func() (*util.HDWallet, error) {
+	return util.NewHDWallet(Mnemonic)
+})
+
+// Wallet derives the middleware wallet at BasePath/index from Mnemonic.
+func Wallet(t testing.TB, index uint32) (*accounts.Account, *ecdsa.PrivateKey) {
+	t.Helper()
+	wallet, err := hdWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, privateKey, err := wallet.Derive(fmt.Sprintf("%s/%d", BasePath, index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account, privateKey
+}
+
+// FundedKey returns a new key holding wei sent by the funder, such as a provider wallet's.
+func (c *Chain) FundedKey(t testing.TB, wei *big.Int) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SendETH(t, crypto.PubkeyToAddress(key.PublicKey), wei)
+	return key
+}
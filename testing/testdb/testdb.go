@@ -0,0 +1,23 @@
+// Package testdb opens the SQLite databases of tests.
+package testdb
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"allen-liaoo/payment-reciever/registry"
+)
+
+// Open opens an empty database in the test's temporary directory, as registry.OpenSQLite
+// opens the registry database that the stores of a deployment share, and closes it when
+// the test ends.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := registry.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
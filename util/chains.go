@@ -0,0 +1,109 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// FeeModel is how a chain charges for transactions.
+type FeeModel string
+
+const (
+	FeeModelEIP1559 FeeModel = "eip1559"  // base fee plus tip, the default
+	FeeModelOPStack FeeModel = "op-stack" // eip1559 plus the L1 data fee quoted by the GasPriceOracle predeploy
+)
+
+// Chain is a network middleware wallets are swept on. The same derived middleware
+// addresses are used on every chain.
+type Chain struct {
+	ID            uint64   `json:"chainId"`
+	Name          string   `json:"name"`
+	RPCURLs       []string `json:"rpcUrls"` // tried in order until one answers
+	NativeSymbol  string   `json:"nativeSymbol"`
+	Confirmations uint64   `json:"confirmations"` // blocks on top of a deposit before it is final
+	FeeModel      FeeModel `json:"feeModel"`      // defaults to FeeModelEIP1559
+	Tokens        []Token  `json:"tokens"`        // their chainId may be left out
+}
+
+// LoadChains reads a JSON array of chains, e.g.
+//
+//	[{"chainId": 11155111, "name": "sepolia", "rpcUrls": ["https://rpc.sepolia.org"], "nativeSymbol": "ETH",
+//	  "confirmations": 12, "tokens": [{"address": "0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238", "symbol": "USDC", "decimals": 6}]}]
+func LoadChains(path string) ([]Chain, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var chains []Chain
+	if err := json.Unmarshal(data, &chains); err != nil {
+		return nil, fmt.Errorf("reading chains %s: %w", path, err)
+	}
+	if err := checkChains(chains); err != nil {
+		return nil, fmt.Errorf("chains %s: %w", path, err)
+	}
+	return chains, nil
+}
+
+// checkChains fills in defaults and rejects incomplete or repeated chains
+func checkChains(chains []Chain) error {
+	seen := make(map[uint64]bool)
+	for i := range chains {
+		c := &chains[i]
+		if c.ID == 0 {
+			return fmt.Errorf("chain %q has no chain ID", c.Name)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("chain %d is listed twice", c.ID)
+		}
+		seen[c.ID] = true
+		if len(c.RPCURLs) == 0 {
+			return fmt.Errorf("chain %d has no RPC URL", c.ID)
+		}
+		switch c.FeeModel {
+		case "":
+			c.FeeModel = FeeModelEIP1559
+		case FeeModelEIP1559, FeeModelOPStack:
+		default:
+			return fmt.Errorf("chain %d has unknown fee model %q", c.ID, c.FeeModel)
+		}
+		for j := range c.Tokens {
+			if c.Tokens[j].ChainID == 0 {
+				c.Tokens[j].ChainID = c.ID
+			} else if c.Tokens[j].ChainID != c.ID {
+				return fmt.Errorf("token %s of chain %d is for chain %d", c.Tokens[j].Address.Hex(), c.ID, c.Tokens[j].ChainID)
+			}
+		}
+		if _, err := NewTokenRegistry(c.Tokens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialChain connects to the first of a chain's RPC URLs that answers with the chain's ID.
+func DialChain(ctx context.Context, chain Chain) (*ethclient.Client, error) {
+	var errs []error
+	for _, url := range chain.RPCURLs {
+		client, err := ethclient.DialContext(ctx, url)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		id, err := client.ChainID(ctx)
+		if err == nil && id.Uint64() != chain.ID {
+			err = fmt.Errorf("%s is chain %s, not %d", url, id, chain.ID)
+		}
+		if err != nil {
+			client.Close()
+			errs = append(errs, err)
+			continue
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("chain %d: %w", chain.ID, errors.Join(errs...))
+}
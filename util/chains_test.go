@@ -0,0 +1,43 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadChains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chains.json")
+	data := `[
+		{"chainId": 1, "name": "mainnet", "rpcUrls": ["https://eth.example"], "nativeSymbol": "ETH", "confirmations": 12,
+		 "tokens": [{"address": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", "symbol": "USDC", "decimals": 6}]},
+		{"chainId": 8453, "name": "base", "rpcUrls": ["https://base.example"], "nativeSymbol": "ETH", "feeModel": "eip1559"}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chains, err := LoadChains(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 2 || chains[0].FeeModel != FeeModelEIP1559 || chains[0].Confirmations != 12 {
+		t.Errorf("LoadChains = %v; want mainnet with the default fee model and base", chains)
+	}
+	if chains[0].Tokens[0].ChainID != 1 {
+		t.Errorf("token chain ID = %d; want 1 from its chain", chains[0].Tokens[0].ChainID)
+	}
+
+	for _, bad := range []string{
+		`[{"chainId": 1, "rpcUrls": ["https://eth.example"]}, {"chainId": 1, "rpcUrls": ["https://eth.example"]}]`,
+		`[{"chainId": 1}]`,
+		`[{"chainId": 1, "rpcUrls": ["https://eth.example"], "feeModel": "carrier-pigeon"}]`,
+		`[{"chainId": 1, "rpcUrls": ["https://eth.example"], "tokens": [{"chainId": 10, "address": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"}]}]`,
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadChains(path); err == nil {
+			t.Errorf("LoadChains accepted %s", bad)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NonceReader is the part of a Backend the nonce manager needs.
+type NonceReader interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+// NonceStore persists the next nonce of each sender.
+type NonceStore interface {
+	// Load returns the stored next nonce, and false if none is stored.
+	Load(from common.Address) (uint64, bool, error)
+	Store(from common.Address, next uint64) error
+}
+
+// NonceManager hands out nonces per sender locally, so concurrent transactions from one
+// wallet get distinct nonces without asking the node for each. A nonce is considered used
+// once handed out; with a persistent store, a restarted process continues after the
+// nonces of transactions that were in flight when it stopped.
+type NonceManager struct {
+	client NonceReader
+	store  NonceStore
+
+	mu   sync.Mutex
+	next map[common.Address]uint64
+}
+
+// NewNonceManager keeps nonces in store, or only in memory if store is nil.
+func NewNonceManager(client NonceReader, store NonceStore) *NonceManager {
+	if store == nil {
+		store = NewMemoryNonceStore()
+	}
+	return &NonceManager{client: client, store: store, next: make(map[common.Address]uint64)}
+}
+
+// Next hands out the next nonce of from. The first call for a sender starts from the
+// higher of the stored nonce and the node's pending nonce.
+func (m *NonceManager) Next(ctx context.Context, from common.Address) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next, ok := m.next[from]
+	if !ok {
+		pending, err := m.client.PendingNonceAt(ctx, from)
+		if err != nil {
+			return 0, err
+		}
+		stored, _, err := m.store.Load(from)
+		if err != nil {
+			return 0, err
+		}
+		next = max(pending, stored)
+	}
+	if err := m.store.Store(from, next+1); err != nil {
+		return 0, err
+	}
+	m.next[from] = next + 1
+	return next, nil
+}
+
+// Resync moves the next nonce of from up to the node's pending nonce, never back: other
+// goroutines may hold nonces handed out but not broadcast yet, which the node does not
+// count. Use it when the node rejected a nonce as used.
+func (m *NonceManager) Resync(ctx context.Context, from common.Address) error {
+	return m.sync(ctx, from, false)
+}
+
+// Reset sets the next nonce of from to the node's pending nonce, handing out again the
+// nonces of transactions that were never sent (see Gap). Only use it when no handed out
+// nonce is still to be broadcast, e.g. before a run sends anything.
+func (m *NonceManager) Reset(ctx context.Context, from common.Address) error {
+	return m.sync(ctx, from, true)
+}
+
+func (m *NonceManager) sync(ctx context.Context, from common.Address, rewind bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending, err := m.client.PendingNonceAt(ctx, from)
+	if err != nil {
+		return err
+	}
+	next, ok := m.next[from]
+	if !ok {
+		if next, _, err = m.store.Load(from); err != nil {
+			return err
+		}
+	}
+	if next > pending && !rewind {
+		return nil
+	}
+	if err := m.store.Store(from, pending); err != nil {
+		return err
+	}
+	m.next[from] = pending
+	return nil
+}
+
+// Gap returns the nonces handed out for from that the node does not know about, as the
+// range [start, end). It is empty when every handed out nonce is pending or mined.
+// Transactions in the gap were dropped or never sent, and hold up every later one.
+func (m *NonceManager) Gap(ctx context.Context, from common.Address) (start uint64, end uint64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending, err := m.client.PendingNonceAt(ctx, from)
+	if err != nil {
+		return 0, 0, err
+	}
+	next, ok := m.next[from]
+	if !ok {
+		if next, _, err = m.store.Load(from); err != nil {
+			return 0, 0, err
+		}
+	}
+	if next <= pending {
+		return pending, pending, nil
+	}
+	return pending, next, nil
+}
+
+// IsNonceTooLow reports whether a node rejected a transaction because its nonce was used.
+func IsNonceTooLow(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "nonce too low")
+}
+
+// MemoryNonceStore keeps nonces in memory.
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[common.Address]uint64
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[common.Address]uint64)}
+}
+
+func (s *MemoryNonceStore) Load(from common.Address) (uint64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, ok := s.nonces[from]
+	return next, ok, nil
+}
+
+func (s *MemoryNonceStore) Store(from common.Address, next uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonces[from] = next
+	return nil
+}
+
+// FileNonceStore keeps nonces in a JSON file, rewritten on every store.
+type FileNonceStore struct {
+	path string
+	mem  *MemoryNonceStore
+}
+
+func OpenFileNonceStore(path string) (*FileNonceStore, error) {
+	s := &FileNonceStore{path: path, mem: NewMemoryNonceStore()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.mem.nonces); err != nil {
+		return nil, fmt.Errorf("reading nonce store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileNonceStore) Load(from common.Address) (uint64, bool, error) {
+	return s.mem.Load(from)
+}
+
+func (s *FileNonceStore) Store(from common.Address, next uint64) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.nonces[from] = next
+	data, err := json.Marshal(s.mem.nonces)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,179 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// pendingNonces is a NonceReader returning a fixed pending nonce
+type pendingNonces struct {
+	mu      sync.Mutex
+	pending uint64
+}
+
+func (p *pendingNonces) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending, nil
+}
+
+func (p *pendingNonces) set(pending uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = pending
+}
+
+var nonceSender = common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0")
+
+// unit test: concurrent callers get distinct, consecutive nonces
+func TestNonceManagerConcurrent(t *testing.T) {
+	m := NewNonceManager(&pendingNonces{pending: 5}, nil)
+
+	var mu sync.Mutex
+	var nonces []uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := m.Next(context.Background(), nonceSender)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			nonces = append(nonces, n)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(nonces, func(a, b int) bool { return nonces[a] < nonces[b] })
+	for i, n := range nonces {
+		if n != uint64(5+i) {
+			t.Fatalf("nonces = %v; want 5 to 24", nonces)
+		}
+	}
+}
+
+// unit test: a restarted manager does not reuse nonces of in-flight transactions
+func TestNonceManagerPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonces.json")
+	node := &pendingNonces{pending: 3}
+
+	store, err := OpenFileNonceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewNonceManager(node, store)
+	for want := uint64(3); want < 6; want++ {
+		if n, _ := m.Next(context.Background(), nonceSender); n != want {
+			t.Errorf("Next() = %d; want %d", n, want)
+		}
+	}
+
+	// nonces 3 to 5 are in flight, but the node has not seen them yet
+	store, err = OpenFileNonceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = NewNonceManager(node, store)
+	if n, _ := m.Next(context.Background(), nonceSender); n != 6 {
+		t.Errorf("Next() after restart = %d; want 6", n)
+	}
+
+	// the node is ahead (the wallet was used elsewhere)
+	node.set(10)
+	m = NewNonceManager(node, store)
+	if n, _ := m.Next(context.Background(), nonceSender); n != 10 {
+		t.Errorf("Next() behind the node = %d; want 10", n)
+	}
+}
+
+// unit test: Gap reports handed out nonces the node does not know, Reset drops them
+func TestNonceManagerGap(t *testing.T) {
+	node := &pendingNonces{pending: 0}
+	m := NewNonceManager(node, nil)
+	for i := 0; i < 3; i++ {
+		m.Next(context.Background(), nonceSender)
+	}
+
+	node.set(1) // nonce 0 was sent, 1 and 2 were not
+	start, end, err := m.Gap(context.Background(), nonceSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1 || end != 3 {
+		t.Errorf("Gap() = [%d, %d); want [1, 3)", start, end)
+	}
+
+	if err := m.Reset(context.Background(), nonceSender); err != nil {
+		t.Fatal(err)
+	}
+	if start, end, _ := m.Gap(context.Background(), nonceSender); start != end {
+		t.Errorf("Gap() after Reset = [%d, %d); want empty", start, end)
+	}
+	if n, _ := m.Next(context.Background(), nonceSender); n != 1 {
+		t.Errorf("Next() after Reset = %d; want 1", n)
+	}
+}
+
+// unit test: Resync skips nonces used elsewhere, but never hands out again those still
+// held by callers that have not broadcast yet
+func TestNonceManagerResync(t *testing.T) {
+	node := &pendingNonces{pending: 0}
+	m := NewNonceManager(node, nil)
+	for i := 0; i < 3; i++ {
+		m.Next(context.Background(), nonceSender)
+	}
+
+	node.set(1) // nonces 1 and 2 are still to be broadcast
+	if err := m.Resync(context.Background(), nonceSender); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := m.Next(context.Background(), nonceSender); n != 3 {
+		t.Errorf("Next() after Resync behind = %d; want 3", n)
+	}
+
+	node.set(10) // the wallet sent transactions elsewhere
+	if err := m.Resync(context.Background(), nonceSender); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := m.Next(context.Background(), nonceSender); n != 10 {
+		t.Errorf("Next() after Resync ahead = %d; want 10", n)
+	}
+}
+
+// noChainID is a Backend failing to report its chain ID
+type noChainID struct {
+	Backend
+}
+
+func (noChainID) ChainID(ctx context.Context) (*big.Int, error) {
+	return nil, errors.New("connection refused")
+}
+
+// unit test: signing that fails takes no nonce, so it leaves no gap
+func TestSignTxFailingTakesNoNonce(t *testing.T) {
+	m := NewNonceManager(&pendingNonces{pending: 5}, nil)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SignTx(&TxInput{Client: noChainID{}, Nonces: m, From: nonceSender, Amount: big.NewInt(1),
+		GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(1), GasUnit: 21000, PrivateKey: key})
+	if err == nil {
+		t.Fatal("SignTx() succeeded without a chain ID")
+	}
+	if n, _ := m.Next(context.Background(), nonceSender); n != 5 {
+		t.Errorf("Next() after a failed SignTx = %d; want 5", n)
+	}
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Token is an ERC-20 token middleware wallets are swept of.
+type Token struct {
+	ChainID     uint64         `json:"chainId"`
+	Address     common.Address `json:"address"`
+	Symbol      string         `json:"symbol"`
+	Decimals    uint8          `json:"decimals"`
+	MinSweep    *big.Int       `json:"minSweep,omitempty"`    // smallest balance worth sweeping, in the smallest unit
+	Destination common.Address `json:"destination,omitempty"` // where this token is swept to; zero for the sweeper's destination
+}
+
+// TokenRegistry holds the tokens known on each chain.
+type TokenRegistry struct {
+	tokens []Token
+}
+
+// NewTokenRegistry checks tokens for duplicates and missing addresses.
+func NewTokenRegistry(tokens []Token) (*TokenRegistry, error) {
+	type key struct {
+		chainID uint64
+		address common.Address
+	}
+	seen := make(map[key]bool)
+	for _, t := range tokens {
+		if t.Address == (common.Address{}) {
+			return nil, fmt.Errorf("token %s on chain %d has no address", t.Symbol, t.ChainID)
+		}
+		k := key{t.ChainID, t.Address}
+		if seen[k] {
+			return nil, fmt.Errorf("token %s is listed twice on chain %d", t.Address.Hex(), t.ChainID)
+		}
+		seen[k] = true
+	}
+	return &TokenRegistry{tokens: tokens}, nil
+}
+
+// LoadTokenRegistry reads a JSON array of tokens, e.g.
+//
+//	[{"chainId": 11155111, "address": "0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238", "symbol": "USDC", "decimals": 6, "minSweep": 1000000}]
+func LoadTokenRegistry(path string) (*TokenRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("reading token registry %s: %w", path, err)
+	}
+	return NewTokenRegistry(tokens)
+}
+
+// Get returns the token at address on a chain, and false if it is not registered.
+func (r *TokenRegistry) Get(chainID uint64, address common.Address) (Token, bool) {
+	for _, t := range r.tokens {
+		if t.ChainID == chainID && t.Address == address {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
+// ForChain returns the tokens of a chain, in the order they were registered.
+func (r *TokenRegistry) ForChain(chainID uint64) []Token {
+	var tokens []Token
+	for _, t := range r.tokens {
+		if t.ChainID == chainID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
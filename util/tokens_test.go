@@ -0,0 +1,45 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLoadTokenRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	data := `[
+		{"chainId": 1, "address": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", "symbol": "USDC", "decimals": 6, "minSweep": 1000000},
+		{"chainId": 1, "address": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "symbol": "USDT", "decimals": 6},
+		{"chainId": 11155111, "address": "0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238", "symbol": "USDC", "decimals": 6}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := LoadTokenRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := reg.ForChain(1); len(tokens) != 2 || tokens[0].Symbol != "USDC" || tokens[1].Symbol != "USDT" {
+		t.Errorf("ForChain(1) = %v; want USDC, USDT", tokens)
+	}
+	usdc, ok := reg.Get(1, common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"))
+	if !ok || usdc.MinSweep.Int64() != 1000000 {
+		t.Errorf("Get(1, USDC) = %v, %v; want minSweep 1000000", usdc, ok)
+	}
+	if _, ok := reg.Get(11155111, usdc.Address); ok {
+		t.Errorf("Get(11155111, mainnet USDC) found a token")
+	}
+
+	_, err = NewTokenRegistry([]Token{{ChainID: 1, Address: usdc.Address}, {ChainID: 1, Address: usdc.Address}})
+	if err == nil {
+		t.Errorf("NewTokenRegistry accepted a duplicate token")
+	}
+	_, err = NewTokenRegistry([]Token{{ChainID: 1, Symbol: "USDC"}})
+	if err == nil {
+		t.Errorf("NewTokenRegistry accepted a token without an address")
+	}
+}
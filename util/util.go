@@ -3,40 +3,41 @@ package util
 import (
 	"context"
 	"crypto/ecdsa"
-	"fmt"
 	"math/big"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
 	"golang.org/x/crypto/sha3"
 
 	"allen-liaoo/payment-reciever/erc20"
 )
 
-type Contract struct {
-	Name     string
-	Decimals uint8
-}
+// Backend is the part of an Ethereum client that the sweep logic uses. *ethclient.Client,
+// go-ethereum's simulated backend client, and test fakes all satisfy it.
+type Backend interface {
+	bind.ContractCaller // CodeAt, CallContract (token reads, bind.WaitMined)
 
-var knownContracts = map[string]Contract{
-	"0x1c7D4B196Cb0C7B01d743Fbc6116a902379C7238": {
-		Name:     "USDC?",
-		Decimals: 6,
-	},
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	ChainID(ctx context.Context) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	FeeHistory(ctx context.Context, blockCount uint64, lastBlock *big.Int, rewardPercentiles []float64) (*ethereum.FeeHistory, error)
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
 }
 
-func GetContractDecimals(client *ethclient.Client, contractAddress common.Address) (uint8, error) {
-
-	con, ok := knownContracts[contractAddress.Hex()]
-	if ok {
-		return con.Decimals, nil
-	}
-
-	// otherwise, lookup contract decimals
-	contract, err := erc20.NewErc20(contractAddress, client)
+// GetContractDecimals reads a token's decimals from the chain. Registered tokens carry
+// their decimals, see TokenRegistry.
+func GetContractDecimals(client Backend, contractAddress common.Address) (uint8, error) {
+	contract, err := erc20.NewErc20Caller(contractAddress, client)
 	if err != nil {
 		return 0, err
 	}
@@ -45,15 +46,12 @@ func GetContractDecimals(client *ethclient.Client, contractAddress common.Addres
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println("New decimals ", decimals, " for contract address ", contractAddress.Hex())
-
 	return decimals, nil
-
 }
 
 // return balance, decimals, error
-func GetTokenBalance(client *ethclient.Client, contractAddress common.Address, walletAddress common.Address) (*big.Int, error) {
-	contract, err := erc20.NewErc20(contractAddress, client)
+func GetTokenBalance(client Backend, contractAddress common.Address, walletAddress common.Address) (*big.Int, error) {
+	contract, err := erc20.NewErc20Caller(contractAddress, client)
 	if err != nil {
 		return big.NewInt(0), err
 	}
@@ -81,9 +79,30 @@ func ToSmallestUnit(amount *big.Int, decimals uint8) *big.Int {
 	return &newAmount
 }
 
+// TxType is the envelope a transaction is signed in.
+type TxType uint8
+
+const (
+	DynamicFeeTx TxType = iota // EIP-1559, the default
+	LegacyTx                   // gas price only, for chains without a base fee
+	AccessListTx               // EIP-2930: gas price with an access list
+)
+
+// TxTypeOf returns the envelope of tx.
+func TxTypeOf(tx *types.Transaction) TxType {
+	switch tx.Type() {
+	case types.LegacyTxType:
+		return LegacyTx
+	case types.AccessListTxType:
+		return AccessListTx
+	}
+	return DynamicFeeTx
+}
+
 // returns the hash of the transaction (in hex)
 type TxInput struct {
-	Client     *ethclient.Client
+	Client     Backend
+	Type       TxType // legacy and access list transactions pay GasFeeCap as their gas price
 	From       common.Address
 	To         common.Address
 	Amount     *big.Int
@@ -91,21 +110,37 @@ type TxInput struct {
 	GasTipCap  *big.Int
 	GasUnit    uint64
 	Data       []byte
+	AccessList types.AccessList // access list transactions only
 	PrivateKey *ecdsa.PrivateKey
+	Nonce      *uint64       // optional; otherwise taken from Nonces
+	Nonces     *NonceManager // optional; otherwise the pending nonce of From is used
 }
 
-func sendTx(input *TxInput) (*types.Transaction, error) {
-	nonce, err := input.Client.PendingNonceAt(context.Background(), input.From)
-	if err != nil {
-		return nil, err
+// NewTx builds the unsigned transaction described by input, with the given chain ID and nonce.
+func NewTx(chainID *big.Int, nonce uint64, input *TxInput) *types.Transaction {
+	switch input.Type {
+	case LegacyTx:
+		return types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			To:       &input.To,
+			Value:    input.Amount,
+			GasPrice: input.GasFeeCap,
+			Gas:      input.GasUnit,
+			Data:     input.Data,
+		})
+	case AccessListTx:
+		return types.NewTx(&types.AccessListTx{
+			ChainID:    chainID,
+			Nonce:      nonce,
+			To:         &input.To,
+			Value:      input.Amount,
+			GasPrice:   input.GasFeeCap,
+			Gas:        input.GasUnit,
+			Data:       input.Data,
+			AccessList: input.AccessList,
+		})
 	}
-	chainID, err := input.Client.NetworkID(context.Background())
-	if err != nil {
-		return nil, err
-	}
-
-	// EIP1559 transaction
-	tx := types.NewTx(&types.DynamicFeeTx{
+	return types.NewTx(&types.DynamicFeeTx{
 		ChainID:   chainID,
 		Nonce:     nonce,
 		To:        &input.To,
@@ -115,12 +150,43 @@ func sendTx(input *TxInput) (*types.Transaction, error) {
 		Gas:       input.GasUnit,
 		Data:      input.Data,
 	})
-	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), input.PrivateKey)
+}
+
+// SignTx builds and signs the transaction described by input without sending it
+func SignTx(input *TxInput) (*types.Transaction, error) {
+	// asked before a nonce is handed out, so failing leaves no gap
+	chainID, err := input.Client.ChainID(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var nonce uint64
+	if input.Nonce != nil {
+		nonce = *input.Nonce
+	} else if input.Nonces != nil {
+		nonce, err = input.Nonces.Next(context.Background(), input.From)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nonce, err = input.Client.PendingNonceAt(context.Background(), input.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return types.SignTx(NewTx(chainID, nonce, input), types.LatestSignerForChainID(chainID), input.PrivateKey)
+}
+
+func sendTx(input *TxInput) (*types.Transaction, error) {
+	signedTx, err := SignTx(input)
 	if err != nil {
 		return nil, err
 	}
 	err = input.Client.SendTransaction(context.Background(), signedTx)
 	if err != nil {
+		if input.Nonces != nil && input.Nonce == nil && IsNonceTooLow(err) {
+			// the nonce handed out for this transaction was used elsewhere
+			input.Nonces.Resync(context.Background(), input.From)
+		}
 		return nil, err
 	}
 
@@ -156,20 +222,40 @@ func BuildTokenTxDataField(to common.Address, amount *big.Int) []byte {
 }
 
 // DeriveWallet derive wallet from mnemonic and path. It returns the account and private key.
+// Deriving several wallets, use an HDWallet, which stretches the mnemonic only once.
 func DeriveWallet(mnemonic string, path string) (*accounts.Account, *ecdsa.PrivateKey, error) {
-	derPath, err := hdwallet.ParseDerivationPath(path)
+	wallet, err := NewHDWallet(mnemonic)
 	if err != nil {
 		return nil, nil, err
 	}
+	return wallet.Derive(path)
+}
+
+// HDWallet derives the wallets of a mnemonic. Turning a mnemonic into its seed is
+// deliberately slow (2048 rounds of PBKDF2), so it is done once, when the HDWallet is made.
+type HDWallet struct {
+	wallet *hdwallet.Wallet
+}
+
+func NewHDWallet(mnemonic string) (*HDWallet, error) {
 	wallet, err := hdwallet.NewFromMnemonic(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	return &HDWallet{wallet: wallet}, nil
+}
+
+// Derive returns the account and private key at path.
+func (w *HDWallet) Derive(path string) (*accounts.Account, *ecdsa.PrivateKey, error) {
+	derPath, err := hdwallet.ParseDerivationPath(path)
 	if err != nil {
 		return nil, nil, err
 	}
-	account, err := wallet.Derive(derPath, false)
+	account, err := w.wallet.Derive(derPath, false)
 	if err != nil {
 		return nil, nil, err
 	}
-	privateKey, err := wallet.PrivateKey(account)
+	privateKey, err := w.wallet.PrivateKey(account)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -2,11 +2,13 @@ package util
 
 import (
 	"encoding/hex"
+	"fmt"
 	"math/big"
 	"slices"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 // unit test: BuildTokenTxDataField
@@ -27,6 +29,69 @@ func TestBuildTokenTxDataField(t *testing.T) {
 	})
 }
 
+// unit test: WatchOnlyWallet derives the same addresses as DeriveWallet
+func TestWatchOnlyWallet(t *testing.T) {
+	mnemonic := "test test test test test test test test test test test junk"
+	xpub, err := ExtendedPublicKey(mnemonic, "m/44'/60'/0'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := NewWatchOnlyWallet(xpub, "m/44'/60'/0'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("m/44'/60'/0'/0/%d", i)
+		account, _, err := DeriveWallet(mnemonic, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		address, err := wallet.Address(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != account.Address {
+			t.Errorf("Address(%s) = %s; want %s", path, address.Hex(), account.Address.Hex())
+		}
+	}
+
+	for _, path := range []string{"m/44'/60'/0'/0'/1", "m/44'/60'/1'/0/1", "m/44'/60'"} {
+		if _, err := wallet.Address(path); err == nil {
+			t.Errorf("Address(%s) should fail", path)
+		}
+	}
+	if _, err := NewWatchOnlyWallet(xpub, "m/44'/60'/0'/0"); err == nil {
+		t.Errorf("NewWatchOnlyWallet with a path of the wrong depth should fail")
+	}
+}
+
+// unit test: HDWallet derives the known accounts of a mnemonic
+func TestHDWallet(t *testing.T) {
+	wallet, err := NewHDWallet("test test test test test test test test test test test junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"m/44'/60'/0'/0/0": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266",
+		"m/44'/60'/0'/0/1": "0x70997970C51812dc3A010C7d01b50e0d17dc79C8",
+	} {
+		account, privateKey, err := wallet.Derive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Address.Hex() != want {
+			t.Errorf("Derive(%s) = %s; want %s", path, account.Address.Hex(), want)
+		}
+		if crypto.PubkeyToAddress(privateKey.PublicKey) != account.Address {
+			t.Errorf("Derive(%s) returned a key of another address", path)
+		}
+	}
+	if _, _, err := wallet.Derive("m/44'/60'/x"); err == nil {
+		t.Errorf("Derive with an invalid path should fail")
+	}
+}
+
 func equal(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
@@ -38,3 +103,24 @@ func equal(a, b []byte) bool {
 	}
 	return true
 }
+
+// unit test: NewTx builds each envelope
+func TestNewTx(t *testing.T) {
+	input := &TxInput{
+		To:        common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+		Amount:    big.NewInt(1),
+		GasFeeCap: big.NewInt(40),
+		GasTipCap: big.NewInt(2),
+		GasUnit:   21000,
+	}
+	for _, txType := range []TxType{DynamicFeeTx, LegacyTx, AccessListTx} {
+		input.Type = txType
+		tx := NewTx(big.NewInt(1337), 7, input)
+		if TxTypeOf(tx) != txType || tx.Nonce() != 7 || tx.GasFeeCap().Int64() != 40 {
+			t.Errorf("NewTx(%d) = type %d, nonce %d, fee cap %s", txType, tx.Type(), tx.Nonce(), tx.GasFeeCap())
+		}
+		if txType != DynamicFeeTx && tx.GasPrice().Int64() != 40 {
+			t.Errorf("NewTx(%d) gas price = %s; want the fee cap", txType, tx.GasPrice())
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+)
+
+// ExtendedPublicKey returns the extended public key (xpub) of the key at path, derived from
+// mnemonic the same way DeriveWallet derives it. Addresses below path can then be derived
+// from the xpub alone with WatchOnlyWallet.
+func ExtendedPublicKey(mnemonic string, path string) (string, error) {
+	derPath, err := hdwallet.ParseDerivationPath(path)
+	if err != nil {
+		return "", err
+	}
+	seed, err := hdwallet.NewSeedFromMnemonic(mnemonic)
+	if err != nil {
+		return "", err
+	}
+	key, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range derPath {
+		// hdwallet's default derivation, so hardened keys match DeriveWallet
+		key, err = key.DeriveNonStandard(n)
+		if err != nil {
+			return "", err
+		}
+	}
+	pub, err := key.Neuter()
+	if err != nil {
+		return "", err
+	}
+	return pub.String(), nil
+}
+
+// WatchOnlyWallet derives addresses below an extended public key. It holds no private
+// material, so it can only derive non-hardened children.
+type WatchOnlyWallet struct {
+	key  *hdkeychain.ExtendedKey
+	path accounts.DerivationPath
+}
+
+// NewWatchOnlyWallet takes an xpub and the derivation path it was exported at,
+// e.g. the account level m/44'/60'/0'.
+func NewWatchOnlyWallet(xpub string, path string) (*WatchOnlyWallet, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, err
+	}
+	if key.IsPrivate() {
+		return nil, fmt.Errorf("expected an extended public key, got a private one")
+	}
+	derPath, err := hdwallet.ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if int(key.Depth()) != len(derPath) {
+		return nil, fmt.Errorf("extended key is at depth %d, path %s has depth %d", key.Depth(), path, len(derPath))
+	}
+	return &WatchOnlyWallet{key: key, path: derPath}, nil
+}
+
+// Address derives the address at path, which must extend the wallet's own path with
+// non-hardened components only.
+func (w *WatchOnlyWallet) Address(path string) (common.Address, error) {
+	derPath, err := hdwallet.ParseDerivationPath(path)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if len(derPath) < len(w.path) {
+		return common.Address{}, fmt.Errorf("%s is not below %s", path, w.path)
+	}
+	for i := range w.path {
+		if derPath[i] != w.path[i] {
+			return common.Address{}, fmt.Errorf("%s is not below %s", path, w.path)
+		}
+	}
+
+	key := w.key
+	for _, n := range derPath[len(w.path):] {
+		if n >= hdkeychain.HardenedKeyStart {
+			return common.Address{}, fmt.Errorf("%s has a hardened component below %s", path, w.path)
+		}
+		key, err = key.Derive(n)
+		if err != nil {
+			return common.Address{}, err
+		}
+	}
+	pub, err := key.ECPubKey()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub.ToECDSA()), nil
+}
@@ -0,0 +1,221 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultBackoff     = 30 * time.Second
+	defaultMaxBackoff  = time.Hour
+	defaultClaim       = time.Minute
+	dispatchBatch      = 100 // deliveries read from the outbox at once
+)
+
+// Dispatcher POSTs the due events of an outbox to a URL, signed with a shared secret (see
+// Sign). A delivery the receiver does not answer with 2xx is retried after Backoff,
+// doubled after every failed attempt up to MaxBackoff, and failed after MaxAttempts.
+// Dispatchers of several processes can share an outbox: each delivery is claimed before
+// it is sent, so only one of them sends it.
+type Dispatcher struct {
+	Outbox      Outbox
+	URL         string
+	Secret      []byte
+	Client      *http.Client  // defaults to one with a 10s timeout
+	MaxAttempts int           // defaults to 10
+	Backoff     time.Duration // defaults to 30s
+	MaxBackoff  time.Duration // defaults to 1h
+	Claim       time.Duration // how long a delivery being sent is kept from other dispatchers; defaults to 1m
+}
+
+// Dispatch sends the due events, oldest first, and returns how many were delivered.
+// Receivers failing are not errors, their events are retried by later calls; errors are
+// the outbox's.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	delivered := 0
+	for ctx.Err() == nil {
+		due, err := d.Outbox.Due(time.Now(), dispatchBatch)
+		if err != nil {
+			return delivered, err
+		}
+		for _, delivery := range due {
+			if ctx.Err() != nil {
+				break
+			}
+			if claimed, err := d.Outbox.Claim(delivery, time.Now().Add(d.claim())); err != nil {
+				return delivered, err
+			} else if !claimed {
+				continue
+			}
+			delivery.Attempts++
+			if err := d.send(ctx, delivery.Event); err != nil {
+				delivery.LastError = err.Error()
+				if delivery.Attempts >= d.maxAttempts() {
+					delivery.Status = DeliveryFailed
+					log.Printf("webhook %s failed after %d attempts: %v", delivery.Event.ID, delivery.Attempts, err)
+				} else {
+					delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+				}
+			} else {
+				delivery.Status = DeliveryDelivered
+				delivery.LastError = ""
+				delivery.DeliveredAt = time.Now()
+				delivered++
+			}
+			if err := d.Outbox.Save(delivery); err != nil {
+				return delivered, err
+			}
+		}
+		if len(due) < dispatchBatch {
+			break
+		}
+	}
+	return delivered, nil
+}
+
+// send POSTs an event, with its ID and type in headers for receivers routing on them
+func (d *Dispatcher) send(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", e.ID)
+	req.Header.Set("X-Webhook-Event", string(e.Type))
+	req.Header.Set(SignatureHeader, Sign(d.Secret, time.Now(), body))
+
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *Dispatcher) claim() time.Duration {
+	if d.Claim > 0 {
+		return d.Claim
+	}
+	return defaultClaim
+}
+
+func (d *Dispatcher) maxAttempts() int {
+	if d.MaxAttempts > 0 {
+		return d.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// backoff returns the wait after the attempts-th failed attempt
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait, limit := d.Backoff, d.MaxBackoff
+	if wait <= 0 {
+		wait = defaultBackoff
+	}
+	if limit <= 0 {
+		limit = defaultMaxBackoff
+	}
+	for i := 1; i < attempts && wait < limit; i++ {
+		wait *= 2
+	}
+	return min(wait, limit)
+}
+
+// Replay queues an event again, delivered or not, to be sent by the next Dispatch with
+// fresh attempts.
+func Replay(outbox Outbox, id string) error {
+	d, err := outbox.Get(id)
+	if err != nil {
+		return err
+	}
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttempt = time.Now()
+	d.LastError = ""
+	d.DeliveredAt = time.Time{}
+	return outbox.Save(d)
+}
+
+// ReplayFailed queues every failed event again, and returns how many there were.
+func ReplayFailed(outbox Outbox) (int, error) {
+	failed, err := outbox.Failed()
+	if err != nil {
+		return 0, err
+	}
+	for i, d := range failed {
+		if err := Replay(outbox, d.Event.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(failed), nil
+}
+
+// Recorder queues the events of indexed deposits, settled invoices and sweeps in an outbox.
+type Recorder struct {
+	Outbox Outbox
+}
+
+// Deposits queues the deposit.detected and deposit.confirmed events of a poll.
+func (r *Recorder) Deposits(res *deposits.PollResult) error {
+	for _, d := range res.Detected {
+		if err := r.add(DepositEvent(DepositDetected, d)); err != nil {
+			return err
+		}
+	}
+	for _, d := range res.Confirmed {
+		if err := r.add(DepositEvent(DepositConfirmed, d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Invoices queues the invoice.paid events of invoices whose status changed.
+func (r *Recorder) Invoices(updated []*invoices.Invoice) error {
+	for _, inv := range updated {
+		if err := r.add(InvoicePaidEvent(inv)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sweep queues the event of a sweep's new state, if it has one. It suits
+// reciever.Config.OnStateChange, which has no error to return, so errors are logged.
+func (r *Recorder) Sweep(rec *reciever.SweepRecord) {
+	if err := r.add(SweepEvent(rec)); err != nil {
+		log.Printf("queueing webhook of sweep %s: %v", rec.ID, err)
+	}
+}
+
+// add queues e, if there is an event
+func (r *Recorder) add(e *Event, err error) error {
+	if err != nil || e == nil {
+		return err
+	}
+	_, err = r.Outbox.Add(e)
+	return err
+}
@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/testing/simchain"
+	"allen-liaoo/payment-reciever/util"
+)
+
+// receiver is a backend taking webhooks, failing the first failures requests
+type receiver struct {
+	t        *testing.T
+	secret   []byte
+	mu       sync.Mutex
+	failures int
+	events   []*Event
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(rc.t, err)
+	if err := Verify(rc.secret, r.Header.Get(SignatureHeader), body, time.Minute, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failures > 0 {
+		rc.failures--
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+		return
+	}
+	var e Event
+	assert.NoError(rc.t, json.Unmarshal(body, &e))
+	assert.Equal(rc.t, e.ID, r.Header.Get("X-Webhook-Id"))
+	assert.Equal(rc.t, string(e.Type), r.Header.Get("X-Webhook-Event"))
+	rc.events = append(rc.events, &e)
+}
+
+func TestDispatch(t *testing.T) {
+	rc := &receiver{t: t, secret: []byte("shh"), failures: 2}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	outbox := NewMemoryOutbox()
+	d := &Dispatcher{Outbox: outbox, URL: srv.URL, Secret: rc.secret, MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	recorder := &Recorder{Outbox: outbox}
+
+	deposit := &deposits.Deposit{ChainID: 1, TxHash: common.Hash{1}, Amount: big.NewInt(20), Status: deposits.StatusConfirmed}
+	assert.NoError(t, recorder.Deposits(&deposits.PollResult{Detected: []*deposits.Deposit{deposit}, Confirmed: []*deposits.Deposit{deposit}}))
+
+	// both fail, and are retried after the backoff
+	delivered, err := d.Dispatch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	delivered, err = d.Dispatch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered, "not due yet")
+	time.Sleep(20 * time.Millisecond)
+	delivered, err = d.Dispatch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	if assert.Len(t, rc.events, 2) {
+		assert.Equal(t, DepositDetected, rc.events[0].Type)
+		assert.Equal(t, DepositConfirmed, rc.events[1].Type)
+	}
+	got, err := outbox.Get(rc.events[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, DeliveryDelivered, got.Status)
+	assert.Equal(t, 2, got.Attempts)
+
+	// a receiver with the wrong secret never takes it
+	rc.secret = []byte("rotated")
+	assert.NoError(t, recorder.Deposits(&deposits.PollResult{Detected: []*deposits.Deposit{{ChainID: 1, TxHash: common.Hash{2}, Amount: big.NewInt(5)}}}))
+	for i := 0; i < 3; i++ {
+		_, err = d.Dispatch(context.Background())
+		assert.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	failed, err := outbox.Failed()
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, 3, failed[0].Attempts)
+		assert.Equal(t, "receiver answered 401 Unauthorized", failed[0].LastError)
+	}
+
+	rc.secret = d.Secret
+	replayed, err := ReplayFailed(outbox)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	delivered, err = d.Dispatch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+
+	// a delivered event is sent again on request
+	assert.NoError(t, Replay(outbox, rc.events[0].ID))
+	delivered, err = d.Dispatch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Len(t, rc.events, 4)
+	assert.ErrorIs(t, Replay(outbox, "nope"), ErrEventNotFound)
+}
+
+// Dispatchers sharing an outbox, as the API's and the sweeping process's do, send each
+// event once
+func TestDispatchShared(t *testing.T) {
+	rc := &receiver{t: t, secret: []byte("shh")}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	for name, outbox := range outboxes(t) {
+		t.Run(name, func(t *testing.T) {
+			rc.events = nil
+			recorder := &Recorder{Outbox: outbox}
+			for i := byte(0); i < 20; i++ {
+				assert.NoError(t, recorder.Deposits(&deposits.PollResult{Detected: []*deposits.Deposit{{ChainID: 1, TxHash: common.Hash{i}, Amount: big.NewInt(5)}}}))
+			}
+
+			var wg sync.WaitGroup
+			delivered := make([]int, 3)
+			for i := range delivered {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					d := &Dispatcher{Outbox: outbox, URL: srv.URL, Secret: rc.secret}
+					var err error
+					delivered[i], err = d.Dispatch(context.Background())
+					assert.NoError(t, err)
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, 20, delivered[0]+delivered[1]+delivered[2])
+			assert.Len(t, rc.events, 20)
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 4*time.Second, d.backoff(3))
+	assert.Equal(t, 5*time.Second, d.backoff(4))
+	assert.Equal(t, 30*time.Second, (&Dispatcher{}).backoff(1))
+	assert.Equal(t, time.Hour, (&Dispatcher{}).backoff(20))
+}
+
+// A sweeper notifying the recorder queues the events of its sweeps' states
+func TestSweepEvents(t *testing.T) {
+	chain := simchain.New(t)
+	providerKey := chain.FundedKey(t, big.NewInt(1e18))
+	outbox := NewMemoryOutbox()
+	s, err := reciever.NewSweeper(reciever.Config{
+		Client:        chain.Client,
+		TokenAddress:  chain.Token,
+		ProviderKey:   providerKey,
+		Destination:   common.HexToAddress("0xf3cE9fE9aD09d5540a4aa07367ebA056bEd45bd0"),
+		OnStateChange: (&Recorder{Outbox: outbox}).Sweep,
+	})
+	assert.NoError(t, err)
+
+	middlewareWallet, privateKey, err := util.DeriveWallet("test test test test test test test test test test test junk", "m/44'/60'/0'/0/25")
+	assert.NoError(t, err)
+	chain.SendToken(t, chain.Token, middlewareWallet.Address, big.NewInt(20))
+	results, err := s.SweepWallet(context.Background(), middlewareWallet, privateKey, big.NewInt(0))
+	assert.NoError(t, err)
+	_, err = s.Resume(context.Background(), func(common.Address) (*ecdsa.PrivateKey, error) { return privateKey, nil })
+	assert.NoError(t, err)
+
+	due, err := outbox.Due(time.Now(), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, "sweep.funded:"+results[0].SweepID, due[0].Event.ID)
+		assert.Equal(t, "sweep.completed:"+results[0].SweepID, due[1].Event.ID)
+		var data sweepData
+		assert.NoError(t, json.Unmarshal(due[1].Event.Data, &data))
+		assert.Equal(t, middlewareWallet.Address, data.Wallet)
+		assert.Equal(t, "20", data.Amount)
+		assert.Equal(t, results[0].MiddlewareToDestinationTx.Hash(), data.TokenTx)
+	}
+}
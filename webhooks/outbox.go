@@ -0,0 +1,131 @@
+package webhooks
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeliveryStatus is where an event is in the outbox. A delivery moves pending ->
+// delivered, or ends in failed after its last attempt; Replay makes it pending again.
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered" // the receiver answered 2xx
+	DeliveryFailed    DeliveryStatus = "failed"    // out of attempts
+)
+
+// Delivery is an event in the outbox and how sending it went.
+type Delivery struct {
+	Event       *Event
+	Status      DeliveryStatus
+	Attempts    int
+	NextAttempt time.Time // when a pending delivery is due
+	LastError   string
+	DeliveredAt time.Time
+}
+
+// Outbox persists events until they are delivered.
+type Outbox interface {
+	// Add queues an event for delivery now, reporting false if its ID was already queued.
+	Add(e *Event) (bool, error)
+	Get(id string) (*Delivery, error)
+	// Due returns up to limit pending deliveries due at now, oldest event first.
+	Due(now time.Time, limit int) ([]*Delivery, error)
+	// Failed returns the deliveries out of attempts, oldest event first.
+	Failed() ([]*Delivery, error)
+	// Claim takes a pending delivery read from the outbox for sending, by moving its next
+	// attempt to until, reporting false if it changed since it was read, such as by another
+	// dispatcher claiming it. The claim ends with the next Save, or lapses at until.
+	Claim(d *Delivery, until time.Time) (bool, error)
+	// Save replaces the delivery of the same event.
+	Save(d *Delivery) error
+}
+
+var ErrEventNotFound = errors.New("event not found")
+
+// MemoryOutbox keeps deliveries in a map, the outbox of runs without a registry: events
+// not delivered when the process exits are lost.
+type MemoryOutbox struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{deliveries: make(map[string]*Delivery)}
+}
+
+func (o *MemoryOutbox) Add(e *Event) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.deliveries[e.ID]; ok {
+		return false, nil
+	}
+	o.deliveries[e.ID] = &Delivery{Event: e, Status: DeliveryPending, NextAttempt: e.CreatedAt}
+	return true, nil
+}
+
+func (o *MemoryOutbox) Get(id string) (*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d, ok := o.deliveries[id]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	c := *d
+	return &c, nil
+}
+
+func (o *MemoryOutbox) Due(now time.Time, limit int) ([]*Delivery, error) {
+	due := o.find(func(d *Delivery) bool { return d.Status == DeliveryPending && !d.NextAttempt.After(now) })
+	return due[:min(len(due), limit)], nil
+}
+
+func (o *MemoryOutbox) Failed() ([]*Delivery, error) {
+	return o.find(func(d *Delivery) bool { return d.Status == DeliveryFailed }), nil
+}
+
+func (o *MemoryOutbox) Claim(d *Delivery, until time.Time) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stored, ok := o.deliveries[d.Event.ID]
+	if !ok {
+		return false, ErrEventNotFound
+	}
+	if stored.Status != DeliveryPending || !stored.NextAttempt.Equal(d.NextAttempt) {
+		return false, nil
+	}
+	stored.NextAttempt = until
+	d.NextAttempt = until
+	return true, nil
+}
+
+func (o *MemoryOutbox) Save(d *Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.deliveries[d.Event.ID]; !ok {
+		return ErrEventNotFound
+	}
+	c := *d
+	o.deliveries[d.Event.ID] = &c
+	return nil
+}
+
+// find returns copies of the deliveries matching fn, oldest event first
+func (o *MemoryOutbox) find(fn func(d *Delivery) bool) []*Delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var found []*Delivery
+	for _, d := range o.deliveries {
+		if fn(d) {
+			c := *d
+			found = append(found, &c)
+		}
+	}
+	sort.Slice(found, func(a, b int) bool {
+		return found[a].Event.CreatedAt.Before(found[b].Event.CreatedAt)
+	})
+	return found
+}
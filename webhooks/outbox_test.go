@@ -0,0 +1,199 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+	"allen-liaoo/payment-reciever/testing/testdb"
+)
+
+// outboxes returns every Outbox implementation, empty
+func outboxes(t *testing.T) map[string]Outbox {
+	db := testdb.Open(t)
+	sqlite, err := NewSQLiteOutbox(db)
+	assert.NoError(t, err)
+
+	return map[string]Outbox{
+		"memory": NewMemoryOutbox(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	event := func(id string, created int64) *Event {
+		return &Event{ID: id, Type: SweepCompleted, CreatedAt: time.Unix(created, 0), Data: json.RawMessage(`{"id":"` + id + `"}`)}
+	}
+	now := time.Unix(1700000100, 0)
+
+	for name, outbox := range outboxes(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, e := range []*Event{event("b", 1700000002), event("a", 1700000001), event("later", 1700000200)} {
+				added, err := outbox.Add(e)
+				assert.NoError(t, err)
+				assert.True(t, added)
+			}
+			added, err := outbox.Add(event("a", 1700000003))
+			assert.NoError(t, err)
+			assert.False(t, added, "an event is queued once")
+
+			due, err := outbox.Due(now, 10)
+			assert.NoError(t, err)
+			if assert.Len(t, due, 2) {
+				assert.Equal(t, "a", due[0].Event.ID)
+				assert.True(t, time.Unix(1700000001, 0).Equal(due[0].Event.CreatedAt))
+				assert.JSONEq(t, `{"id":"a"}`, string(due[0].Event.Data))
+				assert.Equal(t, DeliveryPending, due[0].Status)
+				assert.Equal(t, "b", due[1].Event.ID)
+			}
+			due, err = outbox.Due(now, 1)
+			assert.NoError(t, err)
+			assert.Len(t, due, 1)
+
+			retried := due[0]
+			retried.Attempts, retried.NextAttempt, retried.LastError = 1, now.Add(time.Minute), "receiver answered 500"
+			assert.NoError(t, outbox.Save(retried))
+			failed := &Delivery{Event: event("b", 1700000002), Status: DeliveryFailed, Attempts: 3, NextAttempt: now}
+			assert.NoError(t, outbox.Save(failed))
+			assert.ErrorIs(t, outbox.Save(&Delivery{Event: event("c", 1700000003)}), ErrEventNotFound)
+
+			due, err = outbox.Due(now, 10)
+			assert.NoError(t, err)
+			assert.Empty(t, due)
+			got, err := outbox.Get("a")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, got.Attempts)
+			assert.Equal(t, "receiver answered 500", got.LastError)
+			assert.True(t, now.Add(time.Minute).Equal(got.NextAttempt))
+			_, err = outbox.Get("c")
+			assert.ErrorIs(t, err, ErrEventNotFound)
+
+			found, err := outbox.Failed()
+			assert.NoError(t, err)
+			if assert.Len(t, found, 1) {
+				assert.Equal(t, "b", found[0].Event.ID)
+			}
+		})
+	}
+}
+
+// A delivery read by two dispatchers is claimed by one
+func TestOutboxClaim(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	for name, outbox := range outboxes(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := outbox.Add(&Event{ID: "a", Type: SweepCompleted, CreatedAt: time.Unix(1700000001, 0), Data: json.RawMessage(`{}`)})
+			assert.NoError(t, err)
+			first, err := outbox.Due(now, 10)
+			assert.NoError(t, err)
+			second, err := outbox.Due(now, 10)
+			assert.NoError(t, err)
+			if !assert.Len(t, first, 1) || !assert.Len(t, second, 1) {
+				return
+			}
+
+			claimed, err := outbox.Claim(first[0], now.Add(time.Minute))
+			assert.NoError(t, err)
+			assert.True(t, claimed)
+			claimed, err = outbox.Claim(second[0], now.Add(time.Minute))
+			assert.NoError(t, err)
+			assert.False(t, claimed, "already claimed")
+			due, err := outbox.Due(now, 10)
+			assert.NoError(t, err)
+			assert.Empty(t, due, "a claimed delivery is not due")
+
+			// an abandoned claim lapses
+			due, err = outbox.Due(now.Add(time.Minute), 10)
+			assert.NoError(t, err)
+			assert.Len(t, due, 1)
+		})
+	}
+}
+
+// Stores hooked to the SQLite outbox queue events with the writes raising them, or neither
+func TestSQLiteOutboxHooks(t *testing.T) {
+	db := testdb.Open(t)
+	outbox, err := NewSQLiteOutbox(db)
+	assert.NoError(t, err)
+	store, err := deposits.NewSQLiteStore(db)
+	assert.NoError(t, err)
+	store.OnSave = outbox.DepositSaved
+	journal, err := reciever.NewSQLiteJournal(db)
+	assert.NoError(t, err)
+	journal.OnSave = outbox.SweepSaved
+
+	d := &deposits.Deposit{ChainID: 1, TxHash: common.Hash{1}, Wallet: common.Address{2}, Amount: big.NewInt(20),
+		BlockNumber: 5, BlockHash: common.Hash{5}, BlockTime: time.Now(), Status: deposits.StatusPending, DetectedAt: time.Now()}
+	added, err := store.Add(d)
+	assert.NoError(t, err)
+	assert.True(t, added)
+	detected, err := DepositEvent(DepositDetected, d)
+	assert.NoError(t, err)
+	_, err = outbox.Get(detected.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetStatus(d, deposits.StatusConfirmed))
+	confirmed, err := DepositEvent(DepositConfirmed, d)
+	assert.NoError(t, err)
+	_, err = outbox.Get(confirmed.ID)
+	assert.NoError(t, err)
+
+	rec := &reciever.SweepRecord{ID: "s1", ChainID: 1, State: reciever.StateGasFunded, Amount: big.NewInt(20), CreatedAt: time.Now()}
+	assert.NoError(t, journal.Save(rec))
+	funded, err := SweepEvent(rec)
+	assert.NoError(t, err)
+	_, err = outbox.Get(funded.ID)
+	assert.NoError(t, err)
+
+	// a failing hook takes the write back with it
+	store.OnSave = func(tx *sql.Tx, d *deposits.Deposit) error { return errors.New("outbox full") }
+	_, err = store.Add(&deposits.Deposit{ChainID: 1, TxHash: common.Hash{2}, Wallet: d.Wallet, Amount: big.NewInt(5),
+		BlockNumber: 6, BlockHash: common.Hash{6}, BlockTime: time.Now(), Status: deposits.StatusPending, DetectedAt: time.Now()})
+	assert.Error(t, err)
+	stored, err := store.ByWallet(1, d.Wallet)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+}
+
+// An invoice settled by Refresh, as the API does, is notified of although Update later
+// sees no change
+func TestSQLiteOutboxInvoicePaid(t *testing.T) {
+	db := testdb.Open(t)
+	outbox, err := NewSQLiteOutbox(db)
+	assert.NoError(t, err)
+	depositStore, err := deposits.NewSQLiteStore(db)
+	assert.NoError(t, err)
+	invoiceStore, err := invoices.NewSQLiteStore(db)
+	assert.NoError(t, err)
+	invoiceStore.OnSave = outbox.InvoiceSaved
+	manager := &invoices.Manager{Store: invoiceStore, Deposits: depositStore}
+
+	wallet, token := common.Address{2}, common.Address{3}
+	assert.NoError(t, invoiceStore.Create(&invoices.Invoice{ID: "inv", ChainID: 1, Wallet: wallet, Token: token, Amount: big.NewInt(20),
+		Status: invoices.StatusUnpaid, Paid: big.NewInt(0), Pending: big.NewInt(0), CreatedAt: time.Now(), UpdatedAt: time.Now()}))
+	d := &deposits.Deposit{ChainID: 1, TxHash: common.Hash{1}, Token: token, Wallet: wallet, Amount: big.NewInt(20),
+		BlockNumber: 5, BlockHash: common.Hash{5}, BlockTime: time.Now(), Status: deposits.StatusConfirmed, DetectedAt: time.Now()}
+	_, err = depositStore.Add(d)
+	assert.NoError(t, err)
+
+	inv, err := manager.Refresh("inv")
+	assert.NoError(t, err)
+	assert.Equal(t, invoices.StatusPaid, inv.Status)
+	updated, err := manager.Update([]*deposits.Deposit{d})
+	assert.NoError(t, err)
+	assert.Empty(t, updated)
+
+	paid, err := InvoicePaidEvent(inv)
+	assert.NoError(t, err)
+	got, err := outbox.Get(paid.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, InvoicePaid, got.Event.Type)
+}
@@ -0,0 +1,201 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+)
+
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+	id           TEXT PRIMARY KEY,
+	created_at   INTEGER NOT NULL,
+	event        TEXT NOT NULL,
+	status       TEXT NOT NULL,
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	next_attempt INTEGER NOT NULL,
+	last_error   TEXT NOT NULL DEFAULT '',
+	delivered_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_due ON webhook_outbox (status, next_attempt)`
+
+const outboxColumns = `event, status, attempts, next_attempt, last_error, delivered_at`
+
+// SQLiteOutbox keeps a row per event, delivered ones included, so an event raised again is
+// queued once. Its hooks, such as DepositSaved, queue events in the transactions of the
+// other stores of its database writing what raises them, so a crash loses none.
+type SQLiteOutbox struct {
+	db *sql.DB
+}
+
+// NewSQLiteOutbox creates the outbox table in db if it does not exist.
+func NewSQLiteOutbox(db *sql.DB) (*SQLiteOutbox, error) {
+	if _, err := db.Exec(outboxSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteOutbox{db: db}, nil
+}
+
+func (o *SQLiteOutbox) Add(e *Event) (bool, error) {
+	return o.add(o.db, e)
+}
+
+// AddTx is Add in tx, a transaction of the outbox's database, so the event is queued if
+// and only if the rest of tx is committed.
+func (o *SQLiteOutbox) AddTx(tx *sql.Tx, e *Event) (bool, error) {
+	return o.add(tx, e)
+}
+
+// SweepSaved queues the event of a sweep's state, if it has one, in the transaction saving
+// the sweep; it suits reciever.SQLiteJournal.OnSave. Saves in the same state raise the
+// same event, queued once.
+func (o *SQLiteOutbox) SweepSaved(tx *sql.Tx, rec *reciever.SweepRecord) error {
+	e, err := SweepEvent(rec)
+	return o.addSaved(tx, e, err)
+}
+
+// DepositSaved queues deposit.detected for a deposit written in tx, and deposit.confirmed
+// too once it is confirmed; it suits deposits.SQLiteStore.OnSave.
+func (o *SQLiteOutbox) DepositSaved(tx *sql.Tx, d *deposits.Deposit) error {
+	if d.Status == deposits.StatusOrphaned {
+		return nil
+	}
+	e, err := DepositEvent(DepositDetected, d)
+	if err := o.addSaved(tx, e, err); err != nil {
+		return err
+	}
+	if d.Status != deposits.StatusConfirmed {
+		return nil
+	}
+	e, err = DepositEvent(DepositConfirmed, d)
+	return o.addSaved(tx, e, err)
+}
+
+// InvoiceSaved queues invoice.paid for an invoice written paid in tx; it suits
+// invoices.SQLiteStore.OnSave.
+func (o *SQLiteOutbox) InvoiceSaved(tx *sql.Tx, inv *invoices.Invoice) error {
+	e, err := InvoicePaidEvent(inv)
+	return o.addSaved(tx, e, err)
+}
+
+// addSaved queues e in tx, if there is an event
+func (o *SQLiteOutbox) addSaved(tx *sql.Tx, e *Event, err error) error {
+	if err != nil || e == nil {
+		return err
+	}
+	_, err = o.add(tx, e)
+	return err
+}
+
+// execer is a database or a transaction of one
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (o *SQLiteOutbox) add(db execer, e *Event) (bool, error) {
+	event, err := json.Marshal(e)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`INSERT OR IGNORE INTO webhook_outbox (id, created_at, event, status, next_attempt)
+		VALUES (?, ?, ?, ?, ?)`, e.ID, e.CreatedAt.UnixNano(), string(event), DeliveryPending, e.CreatedAt.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (o *SQLiteOutbox) Get(id string) (*Delivery, error) {
+	d, err := scanDelivery(o.db.QueryRow(`SELECT `+outboxColumns+` FROM webhook_outbox WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEventNotFound
+	}
+	return d, err
+}
+
+func (o *SQLiteOutbox) Due(now time.Time, limit int) ([]*Delivery, error) {
+	return o.query(`SELECT `+outboxColumns+` FROM webhook_outbox WHERE status = ? AND next_attempt <= ?
+		ORDER BY created_at LIMIT ?`, DeliveryPending, now.UnixNano(), limit)
+}
+
+func (o *SQLiteOutbox) Failed() ([]*Delivery, error) {
+	return o.query(`SELECT `+outboxColumns+` FROM webhook_outbox WHERE status = ? ORDER BY created_at`, DeliveryFailed)
+}
+
+func (o *SQLiteOutbox) Claim(d *Delivery, until time.Time) (bool, error) {
+	res, err := o.db.Exec(`UPDATE webhook_outbox SET next_attempt = ? WHERE id = ? AND status = ? AND next_attempt = ?`,
+		until.UnixNano(), d.Event.ID, DeliveryPending, d.NextAttempt.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	d.NextAttempt = until
+	return true, nil
+}
+
+func (o *SQLiteOutbox) Save(d *Delivery) error {
+	var deliveredAt int64
+	if !d.DeliveredAt.IsZero() {
+		deliveredAt = d.DeliveredAt.UnixNano()
+	}
+	res, err := o.db.Exec(`UPDATE webhook_outbox SET status = ?, attempts = ?, next_attempt = ?, last_error = ?, delivered_at = ?
+		WHERE id = ?`, d.Status, d.Attempts, d.NextAttempt.UnixNano(), d.LastError, deliveredAt, d.Event.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrEventNotFound
+	}
+	return nil
+}
+
+func (o *SQLiteOutbox) query(query string, args ...any) ([]*Delivery, error) {
+	rows, err := o.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDelivery(row scanner) (*Delivery, error) {
+	var d Delivery
+	var event, status string
+	var nextAttempt, deliveredAt int64
+	if err := row.Scan(&event, &status, &d.Attempts, &nextAttempt, &d.LastError, &deliveredAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(event), &d.Event); err != nil {
+		return nil, err
+	}
+	d.Status = DeliveryStatus(status)
+	d.NextAttempt = time.Unix(0, nextAttempt)
+	if deliveredAt != 0 {
+		d.DeliveredAt = time.Unix(0, deliveredAt)
+	}
+	return &d, nil
+}
@@ -0,0 +1,204 @@
+// Package webhooks notifies a backend of payment and sweep events. Events are written to
+// an outbox first and POSTed from there with retries, so an unreachable backend delays
+// notifications but loses none. A SQLiteOutbox queues events in the same transaction as
+// the deposit, invoice or sweep raising them, so a crash loses none either; events
+// queued by a Recorder, after what raised them was written, are lost by a crash in between.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+)
+
+type EventType string
+
+const (
+	DepositDetected  EventType = "deposit.detected"
+	DepositConfirmed EventType = "deposit.confirmed"
+	InvoicePaid      EventType = "invoice.paid" // paid in full, or overpaid
+	SweepFunded      EventType = "sweep.funded" // the middleware wallet has its gas
+	SweepCompleted   EventType = "sweep.completed"
+	SweepFailed      EventType = "sweep.failed"
+)
+
+// Event is the JSON body of a webhook. ID is derived from what happened, so the same
+// event raised twice (e.g. by a restarted run) is queued and delivered once; receivers
+// should still ignore IDs they have seen, as a delivery may be retried after it arrived.
+type Event struct {
+	ID        string          `json:"id"`
+	Type      EventType       `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func newEvent(typ EventType, subject string, data any) (*Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{ID: string(typ) + ":" + subject, Type: typ, CreatedAt: time.Now(), Data: raw}, nil
+}
+
+type depositData struct {
+	ChainID     uint64         `json:"chainId"`
+	TxHash      common.Hash    `json:"txHash"`
+	LogIndex    uint           `json:"logIndex"`
+	Token       common.Address `json:"token"`
+	From        common.Address `json:"from"`
+	Wallet      common.Address `json:"wallet"`
+	Amount      string         `json:"amount"`
+	BlockNumber uint64         `json:"blockNumber"`
+	BlockHash   common.Hash    `json:"blockHash"`
+}
+
+// DepositEvent returns the deposit.detected or deposit.confirmed event of d.
+func DepositEvent(typ EventType, d *deposits.Deposit) (*Event, error) {
+	if typ != DepositDetected && typ != DepositConfirmed {
+		return nil, fmt.Errorf("%s is not a deposit event", typ)
+	}
+	// a deposit found again after a reorg is in another block, and a new event
+	subject := fmt.Sprintf("%d:%s:%d:%s", d.ChainID, d.TxHash.Hex(), d.LogIndex, d.BlockHash.Hex())
+	return newEvent(typ, subject, depositData{
+		ChainID:     d.ChainID,
+		TxHash:      d.TxHash,
+		LogIndex:    d.LogIndex,
+		Token:       d.Token,
+		From:        d.From,
+		Wallet:      d.Wallet,
+		Amount:      d.Amount.String(),
+		BlockNumber: d.BlockNumber,
+		BlockHash:   d.BlockHash,
+	})
+}
+
+type invoiceData struct {
+	ID       string            `json:"id"`
+	ChainID  uint64            `json:"chainId"`
+	Wallet   common.Address    `json:"wallet"`
+	Token    common.Address    `json:"token"`
+	Amount   string            `json:"amount"`
+	Paid     string            `json:"paid"`
+	Status   invoices.Status   `json:"status"`
+	Customer string            `json:"customer,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	PaidAt   time.Time         `json:"paidAt"`
+}
+
+// InvoicePaidEvent returns the invoice.paid event of an invoice paid in full, or nil if it
+// is not.
+func InvoicePaidEvent(inv *invoices.Invoice) (*Event, error) {
+	if inv.Status != invoices.StatusPaid && inv.Status != invoices.StatusOverpaid {
+		return nil, nil
+	}
+	return newEvent(InvoicePaid, inv.ID, invoiceData{
+		ID:       inv.ID,
+		ChainID:  inv.ChainID,
+		Wallet:   inv.Wallet,
+		Token:    inv.Token,
+		Amount:   inv.Amount.String(),
+		Paid:     inv.Paid.String(),
+		Status:   inv.Status,
+		Customer: inv.Customer,
+		Metadata: inv.Metadata,
+		PaidAt:   inv.PaidAt,
+	})
+}
+
+type sweepData struct {
+	ID          string               `json:"id"`
+	ChainID     uint64               `json:"chainId"`
+	State       reciever.SweepState  `json:"state"`
+	Wallet      common.Address       `json:"wallet"`
+	Token       common.Address       `json:"token"`
+	Destination common.Address       `json:"destination"`
+	Amount      string               `json:"amount"`
+	FundingPath reciever.FundingPath `json:"fundingPath"`
+	FundingTx   common.Hash          `json:"fundingTx"`
+	TokenTx     common.Hash          `json:"tokenTx"`
+	Error       string               `json:"error,omitempty"`
+}
+
+// SweepEvent returns the event of a sweep reaching its current state: sweep.funded,
+// sweep.completed or sweep.failed, or nil for the other states.
+func SweepEvent(rec *reciever.SweepRecord) (*Event, error) {
+	var typ EventType
+	switch rec.State {
+	case reciever.StateGasFunded:
+		typ = SweepFunded
+	case reciever.StateConfirmed:
+		typ = SweepCompleted
+	case reciever.StateFailed:
+		typ = SweepFailed
+	default:
+		return nil, nil
+	}
+	return newEvent(typ, rec.ID, sweepData{
+		ID:          rec.ID,
+		ChainID:     rec.ChainID,
+		State:       rec.State,
+		Wallet:      rec.Middleware,
+		Token:       rec.Token,
+		Destination: rec.Destination,
+		Amount:      rec.Amount.String(),
+		FundingPath: rec.FundingPath,
+		FundingTx:   rec.FundingTx,
+		TokenTx:     rec.TokenTx,
+		Error:       rec.Error,
+	})
+}
+
+// SignatureHeader carries the signature of a webhook body: "t=<unix seconds>,v1=<hex
+// HMAC-SHA256 of "<t>.<body>" keyed with the shared secret>".
+const SignatureHeader = "X-Webhook-Signature"
+
+// Sign returns the SignatureHeader value of body sent at t.
+func Sign(secret []byte, t time.Time, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(mac(secret, t.Unix(), body)))
+}
+
+// Verify checks a SignatureHeader value against body, rejecting signatures made more
+// than tolerance before now (0 for no limit) so a captured request cannot be replayed
+// later by someone else.
+func Verify(secret []byte, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp int64
+	var signature []byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature, _ = hex.DecodeString(value)
+		}
+	}
+	if timestamp == 0 || signature == nil {
+		return errors.New("malformed signature header")
+	}
+	if !hmac.Equal(signature, mac(secret, timestamp, body)) {
+		return errors.New("signature mismatch")
+	}
+	if tolerance > 0 && now.Sub(time.Unix(timestamp, 0)) > tolerance {
+		return errors.New("signature too old")
+	}
+	return nil
+}
+
+func mac(secret []byte, timestamp int64, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%d.", timestamp)
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,76 @@
+package webhooks
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"allen-liaoo/payment-reciever/deposits"
+	"allen-liaoo/payment-reciever/invoices"
+	"allen-liaoo/payment-reciever/reciever"
+)
+
+func TestSignature(t *testing.T) {
+	secret := []byte("shh")
+	body := []byte(`{"id":"sweep.completed:1"}`)
+	sent := time.Unix(1700000000, 0)
+	header := Sign(secret, sent, body)
+	assert.Regexp(t, `^t=1700000000,v1=[0-9a-f]{64}$`, header)
+
+	assert.NoError(t, Verify(secret, header, body, time.Minute, sent.Add(time.Second)))
+	assert.NoError(t, Verify(secret, header, body, 0, sent.Add(time.Hour)))
+	assert.Error(t, Verify(secret, header, body, time.Minute, sent.Add(time.Hour)), "too old")
+	assert.Error(t, Verify([]byte("guess"), header, body, 0, sent), "wrong secret")
+	assert.Error(t, Verify(secret, header, []byte(`{"id":"sweep.failed:1"}`), 0, sent), "tampered body")
+	assert.Error(t, Verify(secret, "v1=00", body, 0, sent), "no timestamp")
+}
+
+func TestEvents(t *testing.T) {
+	d := &deposits.Deposit{ChainID: 1, TxHash: common.Hash{1}, LogIndex: 2, BlockHash: common.Hash{3}, Amount: big.NewInt(20)}
+	detected, err := DepositEvent(DepositDetected, d)
+	assert.NoError(t, err)
+	assert.Equal(t, DepositDetected, detected.Type)
+	again, err := DepositEvent(DepositDetected, d)
+	assert.NoError(t, err)
+	assert.Equal(t, detected.ID, again.ID, "the same event twice")
+	confirmed, err := DepositEvent(DepositConfirmed, d)
+	assert.NoError(t, err)
+	assert.NotEqual(t, detected.ID, confirmed.ID)
+	_, err = DepositEvent(SweepFunded, d)
+	assert.Error(t, err)
+
+	inv := &invoices.Invoice{ID: "order-1", Amount: big.NewInt(20), Paid: big.NewInt(5), Status: invoices.StatusPartiallyPaid}
+	e, err := InvoicePaidEvent(inv)
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+	inv.Status, inv.Paid = invoices.StatusOverpaid, big.NewInt(25)
+	e, err = InvoicePaidEvent(inv)
+	assert.NoError(t, err)
+	if assert.NotNil(t, e) {
+		assert.Equal(t, "invoice.paid:order-1", e.ID)
+		assert.JSONEq(t, `{"id":"order-1","chainId":0,"wallet":"0x0000000000000000000000000000000000000000",
+			"token":"0x0000000000000000000000000000000000000000","amount":"20","paid":"25","status":"overpaid",
+			"paidAt":"0001-01-01T00:00:00Z"}`, string(e.Data))
+	}
+
+	rec := &reciever.SweepRecord{ID: "1337-0xab-1", Amount: big.NewInt(20)}
+	for state, want := range map[reciever.SweepState]EventType{
+		reciever.StatePlanned:   "",
+		reciever.StateGasFunded: SweepFunded,
+		reciever.StateTokenSent: "",
+		reciever.StateConfirmed: SweepCompleted,
+		reciever.StateFailed:    SweepFailed,
+	} {
+		rec.State = state
+		e, err := SweepEvent(rec)
+		assert.NoError(t, err)
+		if want == "" {
+			assert.Nil(t, e, state)
+		} else if assert.NotNil(t, e, state) {
+			assert.Equal(t, want, e.Type)
+		}
+	}
+}